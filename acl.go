@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every ACL category a command can belong to, as listed by ACL CAT
+var ACLCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// ~pattern grants read and write, %R~ and %W~ only one of them
+type KeyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+func (kp KeyPattern) String() string {
+	switch {
+	case kp.read && kp.write:
+		return "~" + kp.pattern
+	case kp.read:
+		return "%R~" + kp.pattern
+	default:
+		return "%W~" + kp.pattern
+	}
+}
+
+// clients keep a pointer to their User, ACL SETUSER swaps its rules under acl.mu
+// so the name can be read without the lock
+type User struct {
+	name string
+	*userRules
+}
+
+// everything ACL SETUSER can change, only read and replaced with acl.mu held
+type userRules struct {
+	enabled   bool
+	nopass    bool
+	passwords []string        // sha256 hex digests, plain passwords are never kept
+	allowed   map[string]bool // full command names ("get", "client|kill") the user may run
+	cmdRules  []string        // command rules as applied, reported by ACL GETUSER/LIST
+	keys      []KeyPattern
+	channels  []string
+}
+
+// a new user can't do anything until rules are added
+func NewUser(name string) *User {
+	return &User{
+		name:      name,
+		userRules: &userRules{allowed: map[string]bool{}},
+	}
+}
+
+func (u *User) clone() *User {
+	cp := *u.userRules
+	cp.passwords = append([]string{}, u.passwords...)
+	cp.cmdRules = append([]string{}, u.cmdRules...)
+	cp.keys = append([]KeyPattern{}, u.keys...)
+	cp.channels = append([]string{}, u.channels...)
+	cp.allowed = make(map[string]bool, len(u.allowed))
+	for k, v := range u.allowed {
+		cp.allowed[k] = v
+	}
+	return &User{name: u.name, userRules: &cp}
+}
+
+func hashPassword(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:])
+}
+
+// compares against every password in constant time so timing doesn't leak which one, or how much of it, matched
+func (u *User) checkPassword(p string) bool {
+	hash := []byte(hashPassword(p))
+
+	match := 0
+	for _, stored := range u.passwords {
+		match |= subtle.ConstantTimeCompare(hash, []byte(stored))
+	}
+	return u.nopass || match == 1
+}
+
+// applies a single ACL SETUSER rule
+func (u *User) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+
+	switch lower {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case "allkeys":
+		u.keys = []KeyPattern{{pattern: "*", read: true, write: true}}
+	case "resetkeys":
+		u.keys = nil
+	case "allchannels":
+		u.channels = []string{"*"}
+	case "resetchannels":
+		u.channels = nil
+	case "allcommands":
+		return u.applyCommandRule("+@all")
+	case "nocommands":
+		return u.applyCommandRule("-@all")
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.applyRule(r)
+		}
+	default:
+		return u.applyPatternRule(rule)
+	}
+	return nil
+}
+
+func (u *User) applyPatternRule(rule string) error {
+	switch {
+	case rule == "":
+		return errors.New("Syntax error")
+	case rule[0] == '>':
+		hash := hashPassword(rule[1:])
+		if !contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case rule[0] == '<':
+		return u.removePassword(hashPassword(rule[1:]))
+	case rule[0] == '#':
+		hash := rule[1:]
+		if !validPasswordHash(hash) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if !contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case rule[0] == '!':
+		if !validPasswordHash(rule[1:]) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		return u.removePassword(rule[1:])
+	case rule[0] == '~':
+		u.keys = append(u.keys, KeyPattern{pattern: rule[1:], read: true, write: true})
+	case rule[0] == '%':
+		perms, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || perms == "" {
+			return errors.New("Syntax error")
+		}
+		kp := KeyPattern{pattern: pattern}
+		for _, p := range strings.ToUpper(perms) {
+			switch p {
+			case 'R':
+				kp.read = true
+			case 'W':
+				kp.write = true
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		u.keys = append(u.keys, kp)
+	case rule[0] == '&':
+		u.channels = append(u.channels, rule[1:])
+	case rule[0] == '+' || rule[0] == '-':
+		return u.applyCommandRule(rule)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (u *User) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("The password you are trying to remove from the user does not exist")
+}
+
+func validPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// +cmd, -cmd, +cmd|sub, +@category and -@category
+func (u *User) applyCommandRule(rule string) error {
+	allow := rule[0] == '+'
+	name := strings.ToLower(rule[1:])
+
+	if cat, ok := strings.CutPrefix(name, "@"); ok {
+		if cat == "all" {
+			u.allowed = map[string]bool{}
+			if allow {
+				for _, cmd := range Commands {
+					u.allowed[cmd.name] = true
+					for _, sub := range cmd.subcommands {
+						u.allowed[sub.name] = true
+					}
+				}
+			}
+			u.cmdRules = []string{rule[:1] + "@all"}
+			return nil
+		}
+
+		if !contains(ACLCategories, cat) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+
+		for _, cmd := range Commands {
+			if contains(cmd.categories, cat) {
+				u.allowed[cmd.name] = allow
+			}
+			for _, sub := range cmd.subcommands {
+				if contains(sub.categories, cat) {
+					u.allowed[sub.name] = allow
+				}
+			}
+		}
+	} else {
+		cmd, ok := lookupCommandOrSub(name)
+		if !ok {
+			return errors.New("Unknown command or category name in ACL")
+		}
+
+		u.allowed[cmd.name] = allow
+		for _, sub := range cmd.subcommands {
+			u.allowed[sub.name] = allow
+		}
+	}
+
+	u.cmdRules = append(u.cmdRules, rule[:1]+name)
+	return nil
+}
+
+func (u *User) commandsString() string {
+	if len(u.cmdRules) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.cmdRules, " ")
+}
+
+func (u *User) keysString() string {
+	var ks []string
+	for _, kp := range u.keys {
+		ks = append(ks, kp.String())
+	}
+	return strings.Join(ks, " ")
+}
+
+func (u *User) channelsString() string {
+	var cs []string
+	for _, ch := range u.channels {
+		cs = append(cs, "&"+ch)
+	}
+	return strings.Join(cs, " ")
+}
+
+// the user as a rule list, the format of ACL LIST and the aclfile
+func (u *User) describe() string {
+	parts := []string{"user", u.name}
+
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+
+	if ks := u.keysString(); ks != "" {
+		parts = append(parts, ks)
+	}
+
+	if cs := u.channelsString(); cs != "" {
+		parts = append(parts, cs)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+
+	parts = append(parts, u.commandsString())
+	return strings.Join(parts, " ")
+}
+
+// reasons an ACL check can fail, also used as the ACL LOG reason field
+const (
+	ACLDeniedCmd     = "command"
+	ACLDeniedKey     = "key"
+	ACLDeniedChannel = "channel"
+	ACLDeniedAuth    = "auth"
+)
+
+// checks the command and every key it touches, returns the failed reason and object
+func (u *User) canRun(cmd *Command, argv []Value) (reason string, object string) {
+	if !u.allowed[cmd.name] {
+		return ACLDeniedCmd, cmd.name
+	}
+
+	if len(cmd.keyFlags) == 0 {
+		return "", ""
+	}
+
+	// like redis the logical flags decide, access needs read and insert/update/delete need write.
+	// a key spec with neither only needs the key to match a pattern, e.g. EXISTS
+	needRead := contains(cmd.keyFlags, "access")
+	needWrite := contains(cmd.keyFlags, "insert") || contains(cmd.keyFlags, "update") || contains(cmd.keyFlags, "delete")
+
+	for _, pos := range cmd.keyPositions(len(argv)) {
+		key := argv[pos].bulk
+		if !u.canAccessKey(key, needRead, needWrite) {
+			return ACLDeniedKey, key
+		}
+	}
+	return "", ""
+}
+
+// like redis a single pattern must grant every permission needed, %R~x %W~x doesn't add up to ~x
+func (u *User) canAccessKey(key string, read bool, write bool) bool {
+	for _, kp := range u.keys {
+		if read && !kp.read || write && !kp.write {
+			continue
+		}
+		// allkeys and ~* match everything, no need to run the matcher
+		if kp.pattern == "*" || stringMatch(kp.pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// where a denied command was run, reported as the ACL LOG context field
+const (
+	ACLContextToplevel = "toplevel"
+	ACLContextMulti    = "multi"
+)
+
+// checks the client's user may run cmd with argv, denials are added to the ACL LOG
+func (state *AppState) checkACL(c *Client, cmd *Command, argv []Value, context string) error {
+	// AUTH and friends must work for every user
+	if contains(SafeCmds, cmd.root().name) {
+		return nil
+	}
+
+	u := c.getUser()
+
+	reason, object := state.acl.Check(u, cmd, argv)
+	if reason == "" {
+		return nil
+	}
+
+	state.acl.Log(c, reason, context, object, u.name)
+	if reason == ACLDeniedKey {
+		state.generalStats.acl_access_denied_key.Add(1)
+		return ErrNoPermKey
+	}
+	state.generalStats.acl_access_denied_cmd.Add(1)
+	return ErrNoPermCmd(u.name, cmd.name)
+}
+
+type ACLLogEntry struct {
+	id          int64
+	count       int
+	reason      string
+	context     string // toplevel or multi
+	object      string
+	username    string
+	clientInfo  string
+	createdAt   time.Time
+	lastUpdated time.Time
+}
+
+type ACL struct {
+	mu        sync.RWMutex
+	users     map[string]*User
+	log       []*ACLLogEntry // newest first
+	nextLogId int64
+	logMaxLen int
+	file      string
+}
+
+// starts with the default user, which can do everything and needs no password
+// unless requirepass is set, then adds the users from the config and the aclfile
+func NewACL(conf *Config) *ACL {
+	acl := &ACL{
+		users:     map[string]*User{},
+		logMaxLen: conf.acllogMaxLen,
+		file:      conf.aclfile,
+	}
+	acl.users["default"] = newDefaultUser(conf)
+
+	// redis refuses to start with broken ACL configuration, so do we
+	for _, rules := range conf.users {
+		if err := acl.SetUser(rules[0], rules[1:]); err != nil {
+			log.Fatalf("cannot load user %s from the config file: %v", rules[0], err)
+		}
+	}
+
+	if acl.file != "" {
+		if err := acl.Load(conf); err != nil {
+			log.Fatalf("cannot load the aclfile %s: %v", acl.file, err)
+		}
+	}
+	return acl
+}
+
+func newDefaultUser(conf *Config) *User {
+	u := NewUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "+@all"} {
+		u.applyRule(rule)
+	}
+	if conf.requirepass {
+		u.applyRule(">" + conf.password)
+	}
+	return u
+}
+
+func (acl *ACL) User(name string) (*User, bool) {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[name]
+	return u, ok
+}
+
+// clients start out authenticated only when the default user needs no password
+func (acl *ACL) defaultNoPass() bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u := acl.users["default"]
+	return u.enabled && u.nopass
+}
+
+// applies rules to the named user, creating it if needed. nothing changes when a rule fails
+func (acl *ACL) SetUser(name string, rules []string) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	u, exists := acl.users[name]
+	var updated *User
+	if exists {
+		updated = u.clone()
+	} else {
+		updated = NewUser(name)
+	}
+
+	for _, rule := range rules {
+		if err := updated.applyRule(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+
+	// the same User keeps serving connected clients, only its rules are replaced
+	if exists {
+		u.userRules = updated.userRules
+	} else {
+		acl.users[name] = updated
+	}
+	return nil
+}
+
+// stands in for unknown users during AUTH
+var missingUser = &User{userRules: &userRules{passwords: []string{hashPassword("")}}}
+
+// authenticates against a user, checks and the user lookup share one lock.
+// nopass reports the user takes any password, so nothing was verified
+func (acl *ACL) Authenticate(name string, password string) (u *User, nopass bool, ok bool) {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+
+	u, ok = acl.users[name]
+	if !ok {
+		// still hash and compare so unknown usernames take as long as wrong passwords
+		missingUser.checkPassword(password)
+		return nil, false, false
+	}
+
+	if !u.checkPassword(password) || !u.enabled {
+		return nil, false, false
+	}
+	return u, u.nopass, true
+}
+
+func (acl *ACL) Check(u *User, cmd *Command, argv []Value) (reason string, object string) {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	return u.canRun(cmd, argv)
+}
+
+// repeated denials for the same thing are folded into one entry, like redis
+func (acl *ACL) Log(c *Client, reason string, context string, object string, username string) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range acl.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username {
+			e.count++
+			e.lastUpdated = now
+			e.clientInfo = c.infoLine()
+			return
+		}
+	}
+
+	entry := &ACLLogEntry{
+		id:          acl.nextLogId,
+		count:       1,
+		reason:      reason,
+		context:     context,
+		object:      object,
+		username:    username,
+		clientInfo:  c.infoLine(),
+		createdAt:   now,
+		lastUpdated: now,
+	}
+	acl.nextLogId++
+
+	acl.log = append([]*ACLLogEntry{entry}, acl.log...)
+	if len(acl.log) > acl.logMaxLen {
+		acl.log = acl.log[:acl.logMaxLen]
+	}
+}
+
+func (acl *ACL) sortedUsers() []*User {
+	users := make([]*User, 0, len(acl.users))
+	for _, u := range acl.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i int, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users
+}
+
+// writes every user to the aclfile through a temp file so a crash never leaves it half written
+func (acl *ACL) Save() error {
+	if acl.file == "" {
+		return ErrNoACLFile
+	}
+
+	acl.mu.RLock()
+	var sb strings.Builder
+	for _, u := range acl.sortedUsers() {
+		sb.WriteString(u.describe())
+		sb.WriteString("\n")
+	}
+	acl.mu.RUnlock()
+
+	tmp := filepath.Join(filepath.Dir(acl.file), fmt.Sprintf("temp-acl-%d.acl", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(sb.String()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, acl.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return fsyncDir(filepath.Dir(acl.file))
+}
+
+// replaces every user with the ones in the aclfile, the file is validated
+// as a whole first so a bad line leaves the current users untouched
+func (acl *ACL) Load(conf *Config) error {
+	if acl.file == "" {
+		return ErrNoACLFile
+	}
+
+	f, err := os.Open(acl.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]*User{}
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		args := strings.Fields(line)
+		if len(args) < 2 || args[0] != "user" {
+			return fmt.Errorf("%s:%d should start with user keyword", acl.file, lineno)
+		}
+
+		u := NewUser(args[1])
+		for _, rule := range args[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return fmt.Errorf("%s:%d: %s. ", acl.file, lineno, err)
+			}
+		}
+		users[u.name] = u
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	if _, ok := users["default"]; !ok {
+		users["default"] = newDefaultUser(conf)
+	}
+
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	// existing users are updated in place so connected clients follow the new rules
+	for name, u := range acl.users {
+		if loaded, ok := users[name]; ok {
+			*u = *loaded
+			users[name] = u
+		}
+	}
+	acl.users = users
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func argv(args ...string) []Value {
+	var v []Value
+	for _, a := range args {
+		v = append(v, Value{typ: BULK, bulk: a})
+	}
+	return v
+}
+
+func TestACLKeyPatternsMatchSlashes(t *testing.T) {
+	acl := NewACL(NewConfig())
+	set := Commands["set"]
+	args := argv("SET", "a/b", "1")
+
+	u, _ := acl.User("default")
+	if reason, object := u.canRun(set, args); reason != "" {
+		t.Fatalf("default user denied SET a/b: %s %s", reason, object)
+	}
+
+	if err := acl.SetUser("app", []string{"on", "nopass", "~a/*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = acl.User("app")
+	if reason, _ := u.canRun(set, args); reason != "" {
+		t.Fatalf("~a/* denied SET a/b: %s", reason)
+	}
+	args[1].bulk = "b/a"
+	if reason, _ := u.canRun(set, args); reason != ACLDeniedKey {
+		t.Fatalf("~a/* allowed SET b/a")
+	}
+}
+
+// like redis ACLSelectorCheckKey: access needs R, insert/update/delete need W, no flags needs a match
+func TestACLKeyPermissionFlags(t *testing.T) {
+	acl := NewACL(NewConfig())
+	rules := map[string][]string{
+		"ro":    {"on", "nopass", "%R~*", "+@all"},
+		"wo":    {"on", "nopass", "%W~*", "+@all"},
+		"split": {"on", "nopass", "%R~k", "%W~k", "+@all"},
+	}
+	for name, r := range rules {
+		if err := acl.SetUser(name, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		user string
+		argv []Value
+		ok   bool
+	}{
+		{"ro", argv("GET", "k"), true},
+		{"ro", argv("EXISTS", "k"), true},
+		{"ro", argv("SET", "k", "v"), false},
+		{"wo", argv("GET", "k"), false},
+		{"wo", argv("EXISTS", "k"), true},
+		{"wo", argv("SET", "k", "v"), true},
+		{"split", argv("GET", "k"), true},
+		{"split", argv("SET", "k", "v"), true},
+		{"split", argv("EXISTS", "other"), false},
+	}
+
+	for _, tc := range cases {
+		u, _ := acl.User(tc.user)
+		cmd, err := resolveCommand(tc.argv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason, _ := u.canRun(cmd, tc.argv)
+		if ok := reason == ""; ok != tc.ok {
+			t.Errorf("%s running %s: allowed %v, want %v", tc.user, tc.argv[0].bulk, ok, tc.ok)
+		}
+	}
+
+	// R and W granted by different patterns don't add up to RW
+	u, _ := acl.User("split")
+	if u.canAccessKey("k", true, true) {
+		t.Error("%R~k %W~k granted read and write on k")
+	}
+}
+
+// SETUSER replaces the rules of a user connected clients are running commands as,
+// run with -race: the name and rules are read by other connections without a copy
+func TestSetUserWhileClientsRun(t *testing.T) {
+	state := NewAppState(NewConfig())
+	if err := state.acl.SetUser("worker", []string{"on", ">pw", "~acl:*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, state)
+
+	tc := dialTest(t, addr)
+	if got := tc.do(t, "AUTH", "worker", "pw"); got != "+OK" {
+		t.Fatalf("AUTH replied %q", got)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			rules := []string{"+get"}
+			if i%2 == 0 {
+				rules = []string{"-get"}
+			}
+			if err := state.acl.SetUser("worker", rules); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(100 * time.Microsecond) // a tight loop would starve the readers of acl.mu
+		}
+	}()
+
+	other := dialTest(t, addr)
+	for range 200 {
+		tc.do(t, "GET", "acl:k")
+		if got := tc.do(t, "ACL", "WHOAMI"); got != "worker" {
+			t.Fatalf("WHOAMI replied %q", got)
+		}
+		other.do(t, "CLIENT", "LIST")
+	}
+	close(stop)
+	<-done
+
+	// the connected client sees the latest rules on its next command
+	if err := state.acl.SetUser("worker", []string{"-get"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.do(t, "GET", "acl:k"); got != "-"+ErrNoPermCmd("worker", "get").Error() {
+		t.Fatalf("GET after -get replied %q", got)
+	}
+	if err := state.acl.SetUser("worker", []string{"+get"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.do(t, "GET", "acl:k"); got != "$-1" {
+		t.Fatalf("GET after +get replied %q", got)
+	}
+}
+
+func TestACLSave(t *testing.T) {
+	conf := NewConfig()
+	conf.aclfile = filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(conf.aclfile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	acl := NewACL(conf)
+	if err := acl.SetUser("app", []string{"on", ">pw", "~app:*", "+get"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(conf.aclfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "user app on #"+hashPassword("pw")+" ~app:* ") {
+		t.Fatalf("the saved file doesn't describe app:\n%s", data)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(conf.aclfile), "temp-acl-*"))
+	if len(matches) != 0 {
+		t.Fatalf("temp files were left behind: %v", matches)
+	}
+}
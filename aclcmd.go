@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func aclSetUser(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+
+	rules := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		rules = append(rules, arg.bulk)
+	}
+
+	if err := state.acl.SetUser(args[0].bulk, rules); err != nil {
+		return errReply(err)
+	}
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// same fields as redis 7, selectors are always empty
+func aclGetUser(c *Client, v *Value, state *AppState) *Value {
+	state.acl.mu.RLock()
+	defer state.acl.mu.RUnlock()
+
+	u, ok := state.acl.users[v.array[2].bulk]
+	if !ok {
+		return &Value{typ: NULL}
+	}
+
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+
+	passwords := Value{typ: ARRAY, array: []Value{}}
+	for _, p := range u.passwords {
+		passwords.array = append(passwords.array, Value{typ: BULK, bulk: p})
+	}
+
+	return &Value{typ: ARRAY, array: []Value{
+		{typ: BULK, bulk: "flags"},
+		statusArray(flags),
+		{typ: BULK, bulk: "passwords"},
+		passwords,
+		{typ: BULK, bulk: "commands"},
+		{typ: BULK, bulk: u.commandsString()},
+		{typ: BULK, bulk: "keys"},
+		{typ: BULK, bulk: u.keysString()},
+		{typ: BULK, bulk: "channels"},
+		{typ: BULK, bulk: u.channelsString()},
+		{typ: BULK, bulk: "selectors"},
+		{typ: ARRAY, array: []Value{}},
+	}}
+}
+
+// clients authenticated as a deleted user are disconnected
+func aclDelUser(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+
+	for _, arg := range args {
+		if arg.bulk == "default" {
+			return errReply(ErrDeleteDefaultACL)
+		}
+	}
+
+	var deleted []*User
+	state.acl.mu.Lock()
+	for _, arg := range args {
+		if u, ok := state.acl.users[arg.bulk]; ok {
+			delete(state.acl.users, arg.bulk)
+			deleted = append(deleted, u)
+		}
+	}
+	state.acl.mu.Unlock()
+
+	for _, u := range deleted {
+		state.killUserClients(c, u)
+	}
+	return &Value{typ: INTEGER, num: len(deleted)}
+}
+
+func (state *AppState) killUserClients(killer *Client, u *User) {
+	for _, cl := range state.sortedClients() {
+		if cl.getUser() == u {
+			killClient(killer, cl)
+		}
+	}
+}
+
+func aclList(c *Client, v *Value, state *AppState) *Value {
+	state.acl.mu.RLock()
+	defer state.acl.mu.RUnlock()
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, u := range state.acl.sortedUsers() {
+		reply.array = append(reply.array, Value{typ: BULK, bulk: u.describe()})
+	}
+	return &reply
+}
+
+func aclUsers(c *Client, v *Value, state *AppState) *Value {
+	state.acl.mu.RLock()
+	defer state.acl.mu.RUnlock()
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, u := range state.acl.sortedUsers() {
+		reply.array = append(reply.array, Value{typ: BULK, bulk: u.name})
+	}
+	return &reply
+}
+
+func aclWhoAmI(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: BULK, bulk: c.getUser().name}
+}
+
+// lists the categories, or the commands in one of them
+func aclCat(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+	if len(args) > 1 {
+		return errReply(ErrWrongArgs("acl|cat"))
+	}
+
+	if len(args) == 0 {
+		reply := Value{typ: ARRAY, array: []Value{}}
+		for _, cat := range ACLCategories {
+			reply.array = append(reply.array, Value{typ: BULK, bulk: cat})
+		}
+		return &reply
+	}
+
+	cat := strings.ToLower(args[0].bulk)
+	if !contains(ACLCategories, cat) {
+		return errReply(ErrUnknownACLCategory(args[0].bulk))
+	}
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, cmd := range sortedCommands() {
+		if contains(cmd.categories, cat) {
+			reply.array = append(reply.array, Value{typ: BULK, bulk: cmd.name})
+		}
+		for _, sub := range cmd.subcommands {
+			if contains(sub.categories, cat) {
+				reply.array = append(reply.array, Value{typ: BULK, bulk: sub.name})
+			}
+		}
+	}
+	return &reply
+}
+
+// ACL LOG [count | RESET]
+func aclLog(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+	if len(args) > 1 {
+		return errReply(ErrSyntax)
+	}
+
+	count := 10
+	if len(args) == 1 {
+		if strings.ToLower(args[0].bulk) == "reset" {
+			state.acl.mu.Lock()
+			state.acl.log = nil
+			state.acl.mu.Unlock()
+			return &Value{typ: STRING, str: "OK"}
+		}
+
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n < 0 {
+			return errReply(ErrNotInteger)
+		}
+		count = n
+	}
+
+	state.acl.mu.RLock()
+	defer state.acl.mu.RUnlock()
+
+	now := time.Now()
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, e := range state.acl.log[:min(count, len(state.acl.log))] {
+		reply.array = append(reply.array, Value{typ: ARRAY, array: []Value{
+			{typ: BULK, bulk: "count"},
+			{typ: INTEGER, num: e.count},
+			{typ: BULK, bulk: "reason"},
+			{typ: BULK, bulk: e.reason},
+			{typ: BULK, bulk: "context"},
+			{typ: BULK, bulk: e.context},
+			{typ: BULK, bulk: "object"},
+			{typ: BULK, bulk: e.object},
+			{typ: BULK, bulk: "username"},
+			{typ: BULK, bulk: e.username},
+			{typ: BULK, bulk: "age-seconds"},
+			{typ: BULK, bulk: strconv.FormatFloat(now.Sub(e.createdAt).Seconds(), 'f', 3, 64)},
+			{typ: BULK, bulk: "client-info"},
+			{typ: BULK, bulk: e.clientInfo},
+			{typ: BULK, bulk: "entry-id"},
+			{typ: INTEGER, num: int(e.id)},
+			{typ: BULK, bulk: "timestamp-created"},
+			{typ: INTEGER, num: int(e.createdAt.UnixMilli())},
+			{typ: BULK, bulk: "timestamp-last-updated"},
+			{typ: INTEGER, num: int(e.lastUpdated.UnixMilli())},
+		}})
+	}
+	return &reply
+}
+
+// ACL AUTHLOG [count | RESET], every failed AUTH with the address it came from
+func aclAuthLog(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+	if len(args) > 1 {
+		return errReply(ErrSyntax)
+	}
+
+	a := state.authAudit
+	count := 10
+	if len(args) == 1 {
+		if strings.ToLower(args[0].bulk) == "reset" {
+			a.mu.Lock()
+			a.log = nil
+			a.mu.Unlock()
+			return &Value{typ: STRING, str: "OK"}
+		}
+
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n < 0 {
+			return errReply(ErrNotInteger)
+		}
+		count = n
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, e := range a.log[:min(count, len(a.log))] {
+		reply.array = append(reply.array, Value{typ: ARRAY, array: []Value{
+			{typ: BULK, bulk: "entry-id"},
+			{typ: INTEGER, num: int(e.id)},
+			{typ: BULK, bulk: "timestamp"},
+			{typ: INTEGER, num: int(e.at.UnixMilli())},
+			{typ: BULK, bulk: "addr"},
+			{typ: BULK, bulk: e.addr},
+			{typ: BULK, bulk: "username"},
+			{typ: BULK, bulk: e.username},
+			{typ: BULK, bulk: "reason"},
+			{typ: BULK, bulk: e.reason},
+		}})
+	}
+	return &reply
+}
+
+// ACL DRYRUN <username> <command> [arg ...] checks permissions without running anything
+func aclDryRun(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+
+	u, ok := state.acl.User(args[0].bulk)
+	if !ok {
+		return errReply(fmt.Errorf("ERR User '%s' not found", args[0].bulk))
+	}
+
+	argv := args[1:]
+	cmd, err := resolveCommand(argv)
+	if cmd == nil {
+		return errReply(fmt.Errorf("ERR Command '%s' not found", argv[0].bulk))
+	}
+	if err != nil {
+		return errReply(err)
+	}
+
+	reason, object := state.acl.Check(u, cmd, argv)
+	switch reason {
+	case ACLDeniedCmd:
+		return &Value{typ: BULK, bulk: fmt.Sprintf("User %s has no permissions to run the '%s' command", u.name, object)}
+	case ACLDeniedKey:
+		return &Value{typ: BULK, bulk: fmt.Sprintf("User %s has no permissions to access the '%s' key", u.name, object)}
+	}
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// ACL GENPASS [bits], 256 bits of randomness by default
+func aclGenPass(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+	if len(args) > 1 {
+		return errReply(ErrWrongArgs("acl|genpass"))
+	}
+
+	bits := 256
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n <= 0 || n > 4096 {
+			return errReply(ErrGenPassBits)
+		}
+		bits = n
+	}
+
+	chars := (bits + 3) / 4 // one hex char per 4 bits
+	buf := make([]byte, (chars+1)/2)
+	if _, err := rand.Read(buf); err != nil {
+		return errReply(fmt.Errorf("ERR %v", err))
+	}
+	return &Value{typ: BULK, bulk: hex.EncodeToString(buf)[:chars]}
+}
+
+func aclSave(c *Client, v *Value, state *AppState) *Value {
+	if err := state.acl.Save(); err != nil {
+		if err == ErrNoACLFile {
+			return errReply(err)
+		}
+		log.Println("cannot save the aclfile. error: ", err)
+		return errReply(ErrACLSave)
+	}
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// users missing from the reloaded file are deleted and their clients disconnected
+func aclLoad(c *Client, v *Value, state *AppState) *Value {
+	state.acl.mu.RLock()
+	before := state.acl.sortedUsers()
+	state.acl.mu.RUnlock()
+
+	if err := state.acl.Load(state.conf); err != nil {
+		if err == ErrNoACLFile {
+			return errReply(err)
+		}
+		return errReply(fmt.Errorf("ERR %v", err))
+	}
+
+	for _, u := range before {
+		if cur, ok := state.acl.User(u.name); !ok || cur != u {
+			state.killUserClients(c, u)
+		}
+	}
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func aclHelp(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: ARRAY, array: statusArray([]string{
+		"ACL <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"AUTHLOG [<count> | RESET]",
+		"    Show the failed AUTH attempts, with the address and username used.",
+		"CAT [<category>]",
+		"    List all commands that belong to <category>, or all command categories",
+		"    when no category is specified.",
+		"DELUSER <username> [<username> ...]",
+		"    Delete a list of users.",
+		"DRYRUN <username> <command> [<arg> ...]",
+		"    Returns whether the user can execute the given command without executing the command.",
+		"GETUSER <username>",
+		"    Get the user's details.",
+		"GENPASS [<bits>]",
+		"    Generate a secure 256-bit user password. The optional `bits` argument can",
+		"    be used to specify a different size.",
+		"LIST",
+		"    Show users details in config file format.",
+		"LOAD",
+		"    Reload users from the ACL file.",
+		"LOG [<count> | RESET]",
+		"    Show the ACL log entries.",
+		"SAVE",
+		"    Save the current config to the ACL file.",
+		"SETUSER <username> <attribute> [<attribute> ...]",
+		"    Create or modify a user with the specified attributes.",
+		"USERS",
+		"    List all the registered usernames.",
+		"WHOAMI",
+		"    Return the current connection username.",
+		"HELP",
+		"    Print this help.",
+	}).array}
+}
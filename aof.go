@@ -2,81 +2,582 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
+// the AOF is a directory of files tracked by a manifest, like redis 7: a base file written
+// by the last rewrite and incremental files holding the commands written since
 type Aof struct {
-	w    *Writer
-	f    *os.File
-	conf *Config
+	mu       sync.Mutex // guards w, f and manifest, write commands hold it while they run so the log keeps their order
+	w        *Writer
+	enc      *encWriter // between w and f when the AOF is encrypted
+	f        *os.File   // the last incr file, new records are appended to it
+	conf     *Config
+	dir      string
+	manifest *AofManifest
+	stats    *AOFStats
+
+	// keys the server deleted by itself, see propagateDel
+	pendingMu  sync.Mutex
+	pending    []string
+	hasPending atomic.Bool
+}
+
+func NewAof(conf *Config, stats *AOFStats) *Aof {
+	aof := &Aof{conf: conf, dir: path.Join(conf.dir, conf.aofDirname), stats: stats}
+
+	if err := os.MkdirAll(aof.dir, 0755); err != nil {
+		log.Fatal("cannot create the AOF directory: ", err)
+	}
+
+	m, err := loadAofManifest(aof.manifestPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		m, err = aof.initManifest()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	aof.manifest = m
+
+	if err := aof.finishUpgrade(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, af := range m.files() {
+		if _, err := os.Stat(path.Join(aof.dir, af.name)); err != nil {
+			log.Fatalf("AOF file %s listed in the manifest cannot be opened: %v", af.name, err)
+		}
+	}
+
+	// files left over from a rewrite that was interrupted before cleaning up
+	aof.deleteHistory()
+
+	// a manifest that ends with a base, e.g. right after an upgrade, needs an incr file to append to.
+	// so does one whose last incr was written with another key, or before encryption was turned on or off
+	appendLast := len(m.incrs) > 0
+	if appendLast {
+		last := m.incrs[len(m.incrs)-1]
+		ok, err := conf.keys.canAppend(path.Join(aof.dir, last.name))
+		if err != nil {
+			log.Fatalf("cannot open AOF file %s: %v", last.name, err)
+		}
+		if !ok {
+			log.Printf("AOF file %s was written with other encryption settings, appending to a new incr file", last.name)
+		}
+		appendLast = ok
+	}
+
+	if !appendLast {
+		f, m, err := aof.addIncr(aof.manifest)
+		if err != nil {
+			log.Fatal("cannot create an AOF incr file: ", err)
+		}
+		aof.manifest = m
+		aof.f = f
+	} else {
+		last := m.incrs[len(m.incrs)-1]
+		f, err := os.OpenFile(path.Join(aof.dir, last.name), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("cannot open AOF file %s: %v", last.name, err)
+		}
+		aof.f = f
+	}
+
+	if err := aof.resetWriter(); err != nil {
+		log.Fatal("cannot open the AOF for writing: ", err)
+	}
+	if err := aof.resetSizes(); err != nil {
+		log.Fatal(err)
+	}
+	return aof
+}
+
+// points w at the end of f, through an encWriter when new files are encrypted
+// must be called with aof.mu held, or before the AOF is shared
+func (aof *Aof) resetWriter() error {
+	out := sizeWriter{w: aof.f, size: &aof.stats.aof_current_size}
+	if !aof.conf.keys.enabled() {
+		aof.w, aof.enc = NewWriter(out), nil
+		return nil
+	}
+
+	fi, err := aof.f.Stat()
+	if err != nil {
+		return err
+	}
+	aof.enc = newEncWriter(out, aof.conf.keys.cur, fi.Size(), false)
+	aof.w = NewWriter(aof.enc)
+	return nil
+}
+
+// counts what's written to the incr file into aof_current_size
+type sizeWriter struct {
+	w    io.Writer
+	size *atomic.Int64
+}
+
+func (sw sizeWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.size.Add(int64(n))
+	return n, err
+}
+
+// sets aof_current_size and aof_base_size to the size of the base and incr files,
+// at startup and once a rewrite replaced them. must be called with aof.mu held, or before the AOF is shared
+func (aof *Aof) resetSizes() error {
+	var size int64
+	for _, af := range aof.manifest.files() {
+		fi, err := os.Stat(path.Join(aof.dir, af.name))
+		if err != nil {
+			return fmt.Errorf("cannot stat AOF file %s: %w", af.name, err)
+		}
+		size += fi.Size()
+	}
+	aof.stats.aof_current_size.Store(size)
+	aof.stats.aof_base_size.Store(size)
+	return nil
+}
+
+func (aof *Aof) manifestPath() string {
+	return path.Join(aof.dir, aof.conf.aofFn+aofManifestExt)
+}
+
+// first start with this layout: an AOF from the single file layout becomes the base, keeping its name
+// the manifest is written before the file moves so a crash in between is picked up by finishUpgrade
+func (aof *Aof) initManifest() (*AofManifest, error) {
+	m := &AofManifest{}
+
+	legacy := path.Join(aof.conf.dir, aof.conf.aofFn)
+	if _, err := os.Stat(legacy); err != nil {
+		return m, nil
+	}
+
+	log.Println("moving AOF file", legacy, "into", aof.dir)
+	m.base = &AofFile{name: aof.conf.aofFn, seq: 1, typ: AofBase}
+	m.baseSeq = 1
+	if err := persistAofManifest(aof.dir, aof.manifestPath(), m); err != nil {
+		return nil, fmt.Errorf("cannot write the AOF manifest: %w", err)
+	}
+	return m, nil
+}
+
+func (aof *Aof) finishUpgrade() error {
+	m := aof.manifest
+	if m.base == nil || m.base.name != aof.conf.aofFn {
+		return nil
+	}
+
+	dst := path.Join(aof.dir, m.base.name)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	if err := os.Rename(path.Join(aof.conf.dir, aof.conf.aofFn), dst); err != nil {
+		return fmt.Errorf("cannot move the AOF file into %s: %w", aof.dir, err)
+	}
+	return fsyncDir(aof.conf.dir)
+}
+
+// creates the next incr file and persists a manifest that includes it
+// must be called with aof.mu held, or before the AOF is shared
+func (aof *Aof) addIncr(m *AofManifest) (*os.File, *AofManifest, error) {
+	m = m.clone()
+	m.incrSeq++
+	af := &AofFile{name: fmt.Sprintf("%s.%d.incr.aof", aof.conf.aofFn, m.incrSeq), seq: m.incrSeq, typ: AofIncr}
+	m.incrs = append(m.incrs, af)
+
+	fp := path.Join(aof.dir, af.name)
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := persistAofManifest(aof.dir, aof.manifestPath(), m); err != nil {
+		f.Close()
+		os.Remove(fp)
+		return nil, nil, err
+	}
+	return f, m, nil
+}
+
+// removes history files, then drops them from the manifest
+// must be called with aof.mu held, or before the AOF is shared
+func (aof *Aof) deleteHistory() {
+	if len(aof.manifest.history) == 0 {
+		return
+	}
+
+	for _, af := range aof.manifest.history {
+		if err := os.Remove(path.Join(aof.dir, af.name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("cannot delete AOF history file: ", err)
+			return
+		}
+	}
+
+	m := aof.manifest.clone()
+	m.history = nil
+	if err := persistAofManifest(aof.dir, aof.manifestPath(), m); err != nil {
+		log.Println("cannot write the AOF manifest: ", err)
+		return
+	}
+	aof.manifest = m
+}
+
+// must be called with aof.mu held
+func (aof *Aof) append(argv []Value) {
+	aof.w.Write(&Value{typ: ARRAY, array: argv})
+}
+
+// queues a DEL for a key that expired or was evicted, so replaying the log doesn't bring it back.
+// keys are deleted with DB.mu held, which can't take aof.mu, so call appends the DEL once
+// the command that deleted the key is done
+func (aof *Aof) propagateDel(k string) {
+	aof.pendingMu.Lock()
+	aof.pending = append(aof.pending, k)
+	aof.hasPending.Store(true)
+	aof.pendingMu.Unlock()
+}
+
+// appends the queued DELs, returns whether there were any. must be called with aof.mu held
+func (aof *Aof) appendPending() bool {
+	if !aof.hasPending.Load() {
+		return false
+	}
+
+	aof.pendingMu.Lock()
+	keys := aof.pending
+	aof.pending = nil
+	aof.hasPending.Store(false)
+	aof.pendingMu.Unlock()
+
+	for _, k := range keys {
+		aof.append([]Value{{typ: BULK, bulk: "DEL"}, {typ: BULK, bulk: k}})
+	}
+	return len(keys) > 0
 }
 
-func NewAof(conf *Config) *Aof {
-	// function to initialize aof rules
-	aof := Aof{conf: conf}
+// with appendfsync always every command is fsynced before it's replied to.
+// must be called with aof.mu held
+func (aof *Aof) flush() {
+	err := aof.write()
+	if err == nil && aof.conf.aofFsync == Always {
+		err = aof.f.Sync()
+	}
+	if err != nil {
+		log.Println("cannot write to AOF: ", err)
+	}
+	aof.stats.aof_last_write_err.Store(err != nil)
+}
 
-	fp := path.Join(aof.conf.dir, aof.conf.aofFn)
+// hands the buffered records to the OS, must be called with aof.mu held
+func (aof *Aof) write() error {
+	if err := aof.w.Flush(); err != nil {
+		return err
+	}
+	if aof.enc != nil {
+		return aof.enc.seal()
+	}
+	return nil
+}
 
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+// must be called with aof.mu held, once a command or a whole transaction is appended.
+// an encrypted AOF is only written at flushes so its frames end between commands,
+// with appendfsync no it's flushed whenever a frame's worth is buffered
+func (aof *Aof) appended() {
+	if aof.conf.aofFsync == Always || aof.enc != nil && aof.enc.buffered() >= encFrameSize {
+		aof.flush()
+	}
+}
+
+// run every second with appendfsync everysec. like redis the fsync happens without the lock
+// so writers aren't held up by the disk
+func (aof *Aof) Flush() {
+	aof.mu.Lock()
+	err := aof.write()
+	f := aof.f
+	aof.mu.Unlock()
+
+	if err == nil && aof.conf.aofFsync != No {
+		// a rewrite switched to a new incr file in between, it fsynced the old one before closing it
+		if err = f.Sync(); errors.Is(err, os.ErrClosed) {
+			err = nil
+		}
+	}
 	if err != nil {
-		fmt.Println("cannot open: ", fp)
-		return &aof
+		log.Println("cannot write to AOF: ", err)
+	}
+	aof.stats.aof_last_write_err.Store(err != nil)
+}
+
+// writes the buffered records and fsyncs the incr file, so they survive a power loss
+func (aof *Aof) Fsync() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	err := aof.write()
+	if err == nil {
+		err = aof.f.Sync()
 	}
+	aof.stats.aof_last_write_err.Store(err != nil)
+	return err
+}
+
+// replays the base and incr files through the command table, history files are never loaded.
+// with aof-load-truncated an incomplete command at the end of the last file is cut off and
+// loading goes on, any other bad record, e.g. an unknown command, stops the server
+func (aof *Aof) Sync(state *AppState) {
+	c := &Client{multi: -1} // fake client the records run as, nothing is written back to the AOF
 
-	aof.w = NewWriter(f)
-	aof.f = f
+	n := 0
+	files := aof.manifest.files()
+	for i, af := range files {
+		fp := path.Join(aof.dir, af.name)
+		records, valid, err := aof.replay(fp, c, state)
+		n += records
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, errAofTruncated) && i == len(files)-1 && aof.conf.aofTruncated {
+			log.Printf("!!! Warning: short read while loading the AOF file %s !!!", af.name)
+
+			// clients are served while loading, a SHUTDOWN may be fsyncing the file
+			aof.mu.Lock()
+			if err := os.Truncate(fp, valid); err != nil {
+				log.Fatalf("cannot truncate the AOF file %s: %v", af.name, err)
+			}
+			log.Printf("AOF %s truncated to %d bytes, loaded anyway because aof-load-truncated is enabled", af.name, valid)
+
+			// it's the file new records go to
+			if err := aof.resetWriter(); err != nil {
+				log.Fatalf("cannot open the AOF file %s for writing: %v", af.name, err)
+			}
+			if err := aof.resetSizes(); err != nil {
+				log.Fatal(err)
+			}
+			aof.mu.Unlock()
+			break
+		}
 
-	return &aof
+		log.Fatalf("cannot load the AOF file %s: %v. make a backup of it, then run 'goredis check-aof --fix %s'",
+			af.name, err, aof.manifestPath())
+	}
+	log.Printf("replayed %d AOF records", n)
 }
 
-func (aof *Aof) Sync(maxmem int64, evictionpolicy Eviction, memsamples int) {
-	r := bufio.NewReader(aof.f)
+// runs the records of one file, returns how many ran and the offset the file is valid up to.
+// a transaction cut short by the end of the file is dropped and counts as truncated
+func (aof *Aof) replay(fp string, c *Client, state *AppState) (int, int64, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	ar, err := newAofReader(f, aof.conf.keys, aof.conf.maxBulkLen, &state.loading)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// a base written with aof-use-rdb-preamble starts with a snapshot, commands may follow it
+	store, err := ar.snapshot()
+	if err != nil {
+		return 0, 0, err
+	}
+	if store != nil {
+		if err := state.loading.merge(store); err != nil {
+			return 0, 0, err
+		}
+		log.Printf("loaded %d keys from the RDB preamble of %s", len(store), path.Base(fp))
+	}
+
+	var tx []*TxCommand
+	var txStart int64
+	inTx := false
+	n := 0
+
+	// valid is counted in plaintext, where it is in the file is returned
+	fail := func(valid int64, err error) (int, int64, error) {
+		off, ferr := ar.fileOffset(valid)
+		if ferr != nil {
+			return n, 0, ferr
+		}
+		return n, off, err
+	}
+
 	for {
-		v := Value{}
-		err := v.readArray(r)
+		start := ar.off
+		argv, err := ar.next()
 		if err == io.EOF {
 			break
 		}
 
 		if err != nil {
-			log.Println("unexpected error while reading AOF records: ", err)
-			break
+			if inTx {
+				return fail(txStart, err)
+			}
+			return fail(ar.off, err)
+		}
+
+		v := Value{typ: ARRAY, array: argv}
+		// like redis, skipping a record would replay a different dataset than was written
+		cmd, err := resolveCommand(v.array)
+		if err != nil {
+			return fail(start, fmt.Errorf("cannot replay record %d: %w", n+1, err))
 		}
+		n++
 
-		blankState := NewAppState(&Config{
-			maxmem:        maxmem,
-			eviction:      evictionpolicy,
-			maxmemSamples: memsamples,
-		})
-		blankClient := Client{}
-		set(&blankClient, &v, blankState)
+		switch {
+		case cmd.name == "multi":
+			tx, txStart, inTx = nil, start, true
+		case cmd.name == "exec":
+			for _, txcmd := range tx {
+				txcmd.cmd.handler(c, txcmd.v, state)
+			}
+			tx, inTx = nil, false
+		case inTx:
+			tx = append(tx, &TxCommand{v: &v, cmd: cmd})
+		default:
+			cmd.handler(c, &v, state)
+		}
 	}
+
+	if inTx {
+		log.Printf("%s ends inside a MULTI block, discarding %d commands", path.Base(fp), len(tx))
+		return fail(txStart, errAofTruncated)
+	}
+	return n, ar.off, nil
 }
 
-// write all set commands to file
-func (aof *Aof) Rewrite(cp map[string]*Item) {
-	// reroute future AOF records to buffer temporarily
-	var buf bytes.Buffer
-	aof.w = NewWriter(&buf)
+// rewrites the log into a new base file, an RDB snapshot with aof-use-rdb-preamble or one SET
+// (and PEXPIREAT) per live key. new records go to a fresh incr file opened at the same point
+// the snapshot is taken, so nothing has to be buffered.
+// the old base and incr files only become history once the manifest naming the new base
+// is on disk, a crash at any point leaves a loadable AOF
+func (aof *Aof) Rewrite() error {
+	// no write is running while aof.mu is held, so the copy and the new incr start at the same point
+	aof.mu.Lock()
+	cp, release := DB.snapshot()
+	defer release()
 
-	// clear the file contents
-	if err := aof.f.Truncate(0); err != nil {
-		log.Println("aof rewrite trunaction failed: ", err)
-		return
+	// the old incr stays part of the AOF until the new base is in, it must be on disk before it's closed
+	err := aof.write()
+	if err == nil {
+		err = aof.f.Sync()
+	}
+	aof.stats.aof_last_write_err.Store(err != nil)
+	if err != nil {
+		aof.mu.Unlock()
+		return fmt.Errorf("cannot fsync the AOF incr file: %w", err)
 	}
 
-	if _, err := aof.f.Seek(0, 0); err != nil {
-		log.Println("aof rewrite seek failed: ", err)
-		return
+	f, m, err := aof.addIncr(aof.manifest)
+	if err != nil {
+		aof.mu.Unlock()
+		return err
+	}
+	aof.f.Close()
+	aof.f, aof.manifest = f, m
+	if err := aof.resetWriter(); err != nil {
+		aof.mu.Unlock()
+		return err
+	}
+	firstIncr := m.incrs[len(m.incrs)-1].seq
+	aof.mu.Unlock()
+
+	tmp := path.Join(aof.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	if err := aof.writeSnapshot(tmp, cp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	m = aof.manifest.clone()
+	m.baseSeq++
+	ext := "aof"
+	if aof.conf.aofPreamble {
+		ext = "rdb"
+	}
+	base := &AofFile{name: fmt.Sprintf("%s.%d.base.%s", aof.conf.aofFn, m.baseSeq, ext), seq: m.baseSeq, typ: AofBase}
+	if err := os.Rename(tmp, path.Join(aof.dir, base.name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// the new base covers the old one and every incr written before the snapshot
+	if m.base != nil {
+		m.history = append(m.history, &AofFile{name: m.base.name, seq: m.base.seq, typ: AofHistory})
+	}
+	var incrs []*AofFile
+	for _, af := range m.incrs {
+		if af.seq < firstIncr {
+			m.history = append(m.history, &AofFile{name: af.name, seq: af.seq, typ: AofHistory})
+		} else {
+			incrs = append(incrs, af)
+		}
 	}
+	m.base, m.incrs = base, incrs
 
-	fwriter := NewWriter(aof.f)
+	if err := persistAofManifest(aof.dir, aof.manifestPath(), m); err != nil {
+		os.Remove(path.Join(aof.dir, base.name))
+		return err
+	}
+	aof.manifest = m
 
+	aof.deleteHistory()
+	if err := aof.resetSizes(); err != nil {
+		log.Println(err) // the rewrite itself went through
+	}
+	return nil
+}
+
+// writes and fsyncs the snapshot to a new temp file, as RDB or as SET and PEXPIREAT commands.
+// it's encrypted with the current key, this is how files written with an old key are replaced
+func (aof *Aof) writeSnapshot(tmp string, cp map[string]*Item) error {
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var out io.Writer = f
+	var enc *encWriter
+	if aof.conf.keys.enabled() {
+		enc = newEncWriter(f, aof.conf.keys.cur, 0, true)
+		out = enc
+	}
+	finish := func() error {
+		if enc != nil {
+			if err := enc.seal(); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}
+
+	if aof.conf.aofPreamble {
+		w := bufio.NewWriter(out)
+		if err := writeRDB(w, cp, aof.conf, true); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return finish()
+	}
+
+	fwriter := NewWriter(out)
 	for k, v := range cp {
 		cmd := Value{typ: BULK, bulk: "SET"}
 		key := Value{typ: BULK, bulk: k}
@@ -84,13 +585,17 @@ func (aof *Aof) Rewrite(cp map[string]*Item) {
 
 		arr := Value{typ: ARRAY, array: []Value{cmd, key, val}}
 		fwriter.Write(&arr)
-	}
-	fwriter.Flush()
 
-	if _, err := buf.WriteTo(aof.f); err != nil {
-		log.Println("aof - cannot write to file: ", err)
+		// absolute, so the key expires at the same time however late the log is replayed
+		if !v.exp.IsZero() {
+			ms := Value{typ: BULK, bulk: strconv.FormatInt(v.exp.UnixMilli(), 10)}
+			arr := Value{typ: ARRAY, array: []Value{{typ: BULK, bulk: "PEXPIREAT"}, key, ms}}
+			fwriter.Write(&arr)
+		}
 	}
-	// reroute AOF future records to file
 
-	aof.w = NewWriter(aof.f)
+	if err := fwriter.Flush(); err != nil {
+		return err
+	}
+	return finish()
 }
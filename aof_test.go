@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an AOF in a temp dir, unless told otherwise fsynced on every write so the files can be read back right away
+func newTestAof(t *testing.T, conf *Config) *AppState {
+	t.Helper()
+
+	if conf.dir == "" {
+		conf.dir = t.TempDir()
+	}
+	conf.aofEnabled = true
+	if conf.aofFsync == "" {
+		conf.aofFsync = Always
+	}
+	state := NewAppState(conf)
+	t.Cleanup(func() { state.aof.f.Close() })
+	return state
+}
+
+// runs a command the way the dispatcher does, logging it to the AOF
+func runCmd(t *testing.T, state *AppState, c *Client, args ...string) *Value {
+	t.Helper()
+
+	v := &Value{typ: ARRAY, array: argv(args...)}
+	cmd, err := resolveCommand(v.array)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return call(c, cmd, v, state)
+}
+
+// the commands in one AOF file, after its RDB preamble if it has one
+func aofFileRecords(t *testing.T, fp string, keys *Keyring) [][]string {
+	t.Helper()
+
+	f, err := os.Open(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ar, err := newAofReader(f, keys, NewConfig().maxBulkLen, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ar.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records [][]string
+	for {
+		args, err := ar.next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec []string
+		for _, a := range args {
+			rec = append(rec, a.bulk)
+		}
+		records = append(records, rec)
+	}
+}
+
+// the commands in the incr files, in the order they were logged
+func aofRecords(t *testing.T, state *AppState) [][]string {
+	t.Helper()
+
+	var records [][]string
+	for _, af := range state.aof.manifest.incrs {
+		records = append(records, aofFileRecords(t, path.Join(state.aof.dir, af.name), state.conf.keys)...)
+	}
+	return records
+}
+
+// deletes the keys a test created from the shared keyspace
+func dropKeys(prefix string) {
+	DB.mu.Lock()
+	for k := range DB.store {
+		if strings.HasPrefix(k, prefix) {
+			DB.Delete(k)
+		}
+	}
+	DB.mu.Unlock()
+}
+
+// loading a snapshot needs an empty keyspace, whatever other tests left in it is dropped
+func emptyDB() {
+	dropKeys("")
+}
+
+func keysWithPrefix(prefix string) map[string]string {
+	DB.mu.RLock()
+	defer DB.mu.RUnlock()
+
+	m := map[string]string{}
+	for k, item := range DB.store {
+		if strings.HasPrefix(k, prefix) {
+			m[k] = item.V
+		}
+	}
+	return m
+}
+
+func writeAofFile(t *testing.T, fp string, records ...[]string) {
+	t.Helper()
+
+	f, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	for _, rec := range records {
+		w.Write(&Value{typ: ARRAY, array: argv(rec...)})
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// skipping a record the command table rejects would load a different dataset than was written
+func TestAofReplayStopsAtInvalidRecords(t *testing.T) {
+	state := newTestAof(t, NewConfig())
+	t.Cleanup(func() { dropKeys("aofbad:") })
+
+	for _, bad := range [][]string{{"NOPE", "x"}, {"GET"}, {"CLIENT", "NOPE"}} {
+		dropKeys("aofbad:")
+		fp := path.Join(t.TempDir(), "bad.aof")
+		writeAofFile(t, fp, []string{"SET", "aofbad:a", "1"}, bad, []string{"SET", "aofbad:b", "2"})
+
+		n, _, err := state.aof.replay(fp, &Client{multi: -1}, state)
+		if err == nil || errors.Is(err, errAofTruncated) {
+			t.Fatalf("replaying %q returned %v, want a bad record error", bad, err)
+		}
+		if n != 1 {
+			t.Errorf("replaying %q ran %d records before stopping, want 1", bad, n)
+		}
+		if got := keysWithPrefix("aofbad:"); len(got) != 1 || got["aofbad:a"] != "1" {
+			t.Errorf("replaying %q left %v", bad, got)
+		}
+	}
+}
+
+// evicted and lazily expired keys are logged as DELs, replaying the log must not bring them back
+func TestAofLogsEvictionsAndExpiries(t *testing.T) {
+	conf := NewConfig()
+	conf.eviction = AllKeysRandom
+	conf.maxmemSamples = 3
+	state := newTestAof(t, conf)
+	t.Cleanup(func() { dropKeys("aofev:") })
+	c := &Client{multi: -1}
+
+	runCmd(t, state, c, "SET", "aofev:exp", "v")
+	runCmd(t, state, c, "PEXPIREAT", "aofev:exp", fmt.Sprint(time.Now().Add(time.Millisecond).UnixMilli()))
+	time.Sleep(5 * time.Millisecond)
+	if got := runCmd(t, state, c, "GET", "aofev:exp"); got.typ != NULL {
+		t.Fatalf("GET of the expired key replied %v", got)
+	}
+
+	// room for a few more keys only, every further SET evicts
+	DB.mu.Lock()
+	item := &Item{V: "value"}
+	conf.maxmem = DB.mem + 4*item.approxMemUsage("aofev:00")
+	DB.mu.Unlock()
+	t.Cleanup(func() { conf.maxmem = 0 })
+
+	evictedBefore := state.generalStats.evicted_keys.Load()
+	for i := range 10 {
+		runCmd(t, state, c, "SET", fmt.Sprintf("aofev:%02d", i), "value")
+	}
+	evicted := state.generalStats.evicted_keys.Load() - evictedBefore
+	if evicted == 0 {
+		t.Fatal("nothing was evicted")
+	}
+
+	records := aofRecords(t, state)
+	expiry := slices.IndexFunc(records, func(r []string) bool { return slices.Equal(r, []string{"DEL", "aofev:exp"}) })
+	if expiry < 0 || records[expiry-1][0] != "PEXPIREAT" {
+		t.Fatalf("the expired key wasn't logged as a DEL after its PEXPIREAT: %q", records)
+	}
+
+	var dels int64
+	for _, r := range records[expiry+1:] {
+		if r[0] != "DEL" {
+			continue
+		}
+		dels++
+		if _, ok := keysWithPrefix(r[1])[r[1]]; ok {
+			t.Errorf("DEL %s was logged, but the key is still there", r[1])
+		}
+	}
+	if dels != evicted {
+		t.Fatalf("logged %d DELs for %d evictions", dels, evicted)
+	}
+
+	// the log replays to the same keyspace
+	want := keysWithPrefix("aofev:")
+	dropKeys("aofev:")
+	conf.maxmem = 0
+	state.aof.Sync(state)
+	if got := keysWithPrefix("aofev:"); !mapsEqual(got, want) {
+		t.Fatalf("replaying the log loaded %v, want %v", got, want)
+	}
+}
+
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// a transaction is logged as one MULTI/EXEC block holding its writes, in their replayable form
+func TestAofLogsTransactions(t *testing.T) {
+	state := newTestAof(t, NewConfig())
+	t.Cleanup(func() { dropKeys("aoftx:") })
+	c := &Client{multi: -1}
+	c.user, _ = state.acl.User("default") // EXEC checks the queued commands against the ACL
+
+	runCmd(t, state, c, "MULTI")
+	for _, args := range [][]string{{"SET", "aoftx:a", "1"}, {"GET", "aoftx:a"}, {"EXPIRE", "aoftx:a", "100"}} {
+		v := &Value{typ: ARRAY, array: argv(args...)}
+		cmd, _ := resolveCommand(v.array)
+		c.tx.cmds = append(c.tx.cmds, &TxCommand{v: v, cmd: cmd})
+	}
+	runCmd(t, state, c, "EXEC")
+
+	records := aofRecords(t, state)
+	var names []string
+	for _, r := range records {
+		names = append(names, r[0])
+	}
+	if want := []string{"MULTI", "SET", "PEXPIREAT", "EXEC"}; !slices.Equal(names, want) {
+		t.Fatalf("logged %q, want %q", names, want)
+	}
+}
+
+func incrSize(t *testing.T, state *AppState) int64 {
+	t.Helper()
+
+	fi, err := state.aof.f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// always writes every command before it's replied to, everysec and no leave it to the next flush
+func TestAofFsyncPolicy(t *testing.T) {
+	t.Cleanup(func() { dropKeys("aoffsync:") })
+
+	for _, mode := range []FSyncMode{Always, EverySec, No} {
+		conf := NewConfig()
+		conf.aofFsync = mode
+		state := newTestAof(t, conf)
+
+		runCmd(t, state, &Client{multi: -1}, "SET", "aoffsync:k", string(mode))
+		written := incrSize(t, state) > 0
+		if written != (mode == Always) {
+			t.Errorf("appendfsync %s: the record was written before the flush: %v", mode, written)
+		}
+
+		state.aof.Flush()
+		if incrSize(t, state) == 0 {
+			t.Errorf("appendfsync %s: the record wasn't written by the flush", mode)
+		}
+		if state.aofStats.aof_last_write_err.Load() {
+			t.Errorf("appendfsync %s: the flush failed", mode)
+		}
+	}
+}
+
+// writes still buffered when the rewrite starts and writes after it all survive a reload
+func TestAofRewriteKeepsBufferedWrites(t *testing.T) {
+	conf := NewConfig()
+	conf.aofFsync = EverySec
+	state := newTestAof(t, conf)
+	t.Cleanup(func() { dropKeys("aofrw:") })
+	c := &Client{multi: -1}
+
+	runCmd(t, state, c, "SET", "aofrw:before", "1")
+	oldIncr := path.Join(state.aof.dir, state.aof.manifest.incrs[0].name)
+	if err := state.aof.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldIncr); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("the incr file the new base replaced is still there: %v", err)
+	}
+
+	runCmd(t, state, c, "SET", "aofrw:after", "2")
+	runCmd(t, state, c, "DEL", "aofrw:before")
+	state.aof.Flush()
+
+	want := keysWithPrefix("aofrw:")
+	emptyDB()
+	state.aof.f.Close()
+	reloaded := newTestAof(t, conf)
+	reloaded.aof.Sync(reloaded)
+	if got := keysWithPrefix("aofrw:"); !mapsEqual(got, want) {
+		t.Fatalf("the rewritten AOF loaded %v, want %v", got, want)
+	}
+}
+
+// a rewrite with aof-use-rdb-preamble leaves an RDB snapshot as the base, the incr file after it
+// holds commands. commands appended to the base after its snapshot are replayed as well
+func TestAofLoadPreambleBaseAndIncr(t *testing.T) {
+	conf := NewConfig()
+	conf.aofPreamble = true
+	state := newTestAof(t, conf)
+	t.Cleanup(func() { dropKeys("aofpre:") })
+	c := &Client{multi: -1}
+
+	runCmd(t, state, c, "SET", "aofpre:a", "1")
+	runCmd(t, state, c, "SET", "aofpre:b", "2")
+	runCmd(t, state, c, "SET", "aofpre:gone", "x")
+	runCmd(t, state, c, "PEXPIREAT", "aofpre:b", fmt.Sprint(time.Now().Add(time.Hour).UnixMilli()))
+	if err := state.aof.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, state, c, "SET", "aofpre:a", "changed")
+	runCmd(t, state, c, "DEL", "aofpre:gone")
+	runCmd(t, state, c, "SET", "aofpre:c", "3")
+
+	base := path.Join(state.aof.dir, state.aof.manifest.base.name)
+	data, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "REDIS") {
+		t.Fatalf("the base doesn't start with an RDB snapshot: %q", data[:min(len(data), 16)])
+	}
+
+	f, err := os.OpenFile(base, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	w.Write(&Value{typ: ARRAY, array: argv("SET", "aofpre:tail", "t")})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	DB.mu.RLock()
+	wantExp := DB.store["aofpre:b"].exp.UnixMilli()
+	DB.mu.RUnlock()
+
+	emptyDB()
+	state.aof.f.Close()
+	reloaded := newTestAof(t, conf)
+	reloaded.aof.Sync(reloaded)
+
+	want := map[string]string{"aofpre:a": "changed", "aofpre:b": "2", "aofpre:c": "3", "aofpre:tail": "t"}
+	if got := keysWithPrefix("aofpre:"); !mapsEqual(got, want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	DB.mu.RLock()
+	gotExp := DB.store["aofpre:b"].exp.UnixMilli()
+	DB.mu.RUnlock()
+	if gotExp != wantExp {
+		t.Fatalf("aofpre:b expires at %d, want %d", gotExp, wantExp)
+	}
+}
+
+// relative expiries are logged as the absolute PEXPIREAT, an expire that changed nothing isn't logged
+func TestAofLogsAbsoluteExpiries(t *testing.T) {
+	state := newTestAof(t, NewConfig())
+	t.Cleanup(func() { dropKeys("aofexp:") })
+	c := &Client{multi: -1}
+
+	if got := runCmd(t, state, c, "EXPIRE", "aofexp:missing", "100"); got.num != 0 {
+		t.Fatalf("EXPIRE of a missing key replied %d", got.num)
+	}
+	if got := runCmd(t, state, c, "PEXPIREAT", "aofexp:missing", fmt.Sprint(time.Now().Add(time.Hour).UnixMilli())); got.num != 0 {
+		t.Fatalf("PEXPIREAT of a missing key replied %d", got.num)
+	}
+	if records := aofRecords(t, state); len(records) != 0 {
+		t.Fatalf("expiring missing keys logged %q", records)
+	}
+
+	runCmd(t, state, c, "SET", "aofexp:k", "v")
+	before := time.Now().Add(100 * time.Second).UnixMilli()
+	runCmd(t, state, c, "EXPIRE", "aofexp:k", "100")
+	after := time.Now().Add(100 * time.Second).UnixMilli()
+
+	records := aofRecords(t, state)
+	if len(records) != 2 || records[1][0] != "PEXPIREAT" || records[1][1] != "aofexp:k" {
+		t.Fatalf("EXPIRE was logged as %q", records)
+	}
+	if ms, err := strconv.ParseInt(records[1][2], 10, 64); err != nil || ms < before || ms > after {
+		t.Fatalf("EXPIRE 100 was logged as PEXPIREAT %s, want between %d and %d", records[1][2], before, after)
+	}
+}
+
+// a rewrite keeps every expiry as an absolute time, a key that expires while the server is down
+// is gone once it's loaded again
+func TestAofRewriteKeepsExpiries(t *testing.T) {
+	t.Cleanup(func() { dropKeys("aofexp:") })
+
+	for _, preamble := range []bool{false, true} {
+		conf := NewConfig()
+		conf.aofPreamble = preamble
+		state := newTestAof(t, conf)
+		c := &Client{multi: -1}
+
+		runCmd(t, state, c, "SET", "aofexp:long", "1")
+		runCmd(t, state, c, "SET", "aofexp:short", "2")
+		runCmd(t, state, c, "SET", "aofexp:none", "3")
+		runCmd(t, state, c, "PEXPIREAT", "aofexp:long", fmt.Sprint(time.Now().Add(time.Hour).UnixMilli()))
+		runCmd(t, state, c, "PEXPIREAT", "aofexp:short", fmt.Sprint(time.Now().Add(50*time.Millisecond).UnixMilli()))
+		if err := state.aof.Rewrite(); err != nil {
+			t.Fatal(err)
+		}
+
+		DB.mu.RLock()
+		long, short := DB.store["aofexp:long"].exp.UnixMilli(), DB.store["aofexp:short"].exp.UnixMilli()
+		DB.mu.RUnlock()
+
+		if !preamble {
+			base := aofFileRecords(t, path.Join(state.aof.dir, state.aof.manifest.base.name), nil)
+			var expiries []string
+			for _, rec := range base {
+				if rec[0] == "PEXPIREAT" {
+					expiries = append(expiries, rec[1]+" "+rec[2])
+				}
+			}
+			slices.Sort(expiries)
+			if want := []string{fmt.Sprintf("aofexp:long %d", long), fmt.Sprintf("aofexp:short %d", short)}; !slices.Equal(expiries, want) {
+				t.Fatalf("the rewritten base holds the expiries %q, want %q", expiries, want)
+			}
+		}
+
+		time.Sleep(time.Until(time.UnixMilli(short)) + 10*time.Millisecond)
+		state.aof.f.Close()
+		emptyDB()
+		reloaded := newTestAof(t, conf)
+		reloaded.load()
+
+		if got := keysWithPrefix("aofexp:"); !mapsEqual(got, map[string]string{"aofexp:long": "1", "aofexp:none": "3"}) {
+			t.Fatalf("preamble %v: loaded %v", preamble, got)
+		}
+		DB.mu.RLock()
+		gotLong, gotNone := DB.store["aofexp:long"].exp, DB.store["aofexp:none"].exp
+		DB.mu.RUnlock()
+		if gotLong.UnixMilli() != long || !gotNone.IsZero() {
+			t.Fatalf("preamble %v: loaded the expiries %v and %v", preamble, gotLong, gotNone)
+		}
+		dropKeys("aofexp:")
+	}
+}
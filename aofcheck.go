@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// the file ends in the middle of a command, what a crash during a write leaves behind
+var errAofTruncated = errors.New("unexpected end of file")
+
+// reads AOF records strictly, unlike readArray a record cut short is an error.
+// off is where the last complete record ends, so a bad tail can be truncated there.
+// in an encrypted file off counts plaintext, fileOffset maps it to the file
+type aofReader struct {
+	f   *os.File
+	dec *decReader // nil for a plain file
+	r   *bufio.Reader
+	off int64
+
+	maxLen   int64    // proto-max-bulk-len, caps the argument count and each bulk length
+	progress *Loading // fed while the AOF is loaded, nil otherwise
+}
+
+func newAofReader(f *os.File, keys *Keyring, maxLen int64, progress *Loading) (*aofReader, error) {
+	var src io.Reader = f
+	if progress != nil {
+		src = progressReader{r: f, loaded: &progress.loaded}
+	}
+	r, dec, err := keys.open(src)
+	if err != nil {
+		return nil, err
+	}
+	return &aofReader{f: f, dec: dec, r: r, maxLen: maxLen, progress: progress}, nil
+}
+
+// loads the RDB preamble if the file starts with one, nil when it doesn't
+func (ar *aofReader) snapshot() (map[string]*Item, error) {
+	if !isRDB(ar.r) {
+		return nil, nil
+	}
+
+	var onKey func(string)
+	if ar.progress != nil {
+		onKey = ar.progress.read
+	}
+	store, err := readRDB(ar.r, onKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad RDB preamble: %w", err)
+	}
+
+	pos, err := ar.pos()
+	if err != nil {
+		return nil, err
+	}
+	ar.off = pos - int64(ar.r.Buffered())
+	return store, nil
+}
+
+// how much of the file, or of its plaintext, went into r
+func (ar *aofReader) pos() (int64, error) {
+	if ar.dec != nil {
+		return ar.dec.plain - int64(len(ar.dec.pending)), nil
+	}
+	return ar.f.Seek(0, io.SeekCurrent)
+}
+
+func (ar *aofReader) fileOffset(off int64) (int64, error) {
+	if ar.dec != nil {
+		return ar.dec.fileOffset(off)
+	}
+	return off, nil
+}
+
+// returns io.EOF at the end of the file, errAofTruncated if the last record is incomplete
+func (ar *aofReader) next() ([]Value, error) {
+	var n int64
+
+	line, err := ar.line(&n)
+	if err == io.EOF && n == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if line[0] != '*' {
+		return nil, ar.badFormat("expected '*', got '%c'", line[0])
+	}
+	// counts and lengths are checked before anything is allocated for them, a corrupt
+	// header must not claim gigabytes the file doesn't have
+	argc, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || argc < 1 || argc > ar.maxLen {
+		return nil, ar.badFormat("invalid number of arguments %q", line[1:])
+	}
+
+	var argv []Value
+	for range argc {
+		line, err := ar.line(&n)
+		if err == io.EOF {
+			return nil, errAofTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line[0] != '$' {
+			return nil, ar.badFormat("expected '$', got '%c'", line[0])
+		}
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 || size > ar.maxLen {
+			return nil, ar.badFormat("invalid bulk length %q", line[1:])
+		}
+
+		bulk, err := ar.bulk(size)
+		if err != nil {
+			return nil, err
+		}
+		n += size + 2
+		argv = append(argv, Value{typ: BULK, bulk: bulk})
+	}
+
+	ar.off += n
+	return argv, nil
+}
+
+// bulks up to this size are read in one go, larger ones grow with what the file holds
+const aofBulkChunk = 64 * 1024
+
+// reads a bulk of size bytes and its CRLF
+func (ar *aofReader) bulk(size int64) (string, error) {
+	var buf []byte
+	if size+2 <= aofBulkChunk {
+		buf = make([]byte, size+2)
+		if _, err := io.ReadFull(ar.r, buf); err != nil {
+			return "", errAofTruncated
+		}
+	} else {
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, ar.r, size+2); err != nil {
+			return "", errAofTruncated
+		}
+		buf = b.Bytes()
+	}
+
+	if string(buf[size:]) != "\r\n" {
+		return "", ar.badFormat("bulk string is not terminated by CRLF")
+	}
+	return string(buf[:size]), nil
+}
+
+// reads one CRLF terminated line, adding its length to n
+func (ar *aofReader) line(n *int64) (string, error) {
+	line, err := ar.r.ReadString('\n')
+	*n += int64(len(line))
+	if err == io.EOF {
+		if len(line) == 0 {
+			return "", io.EOF
+		}
+		return "", errAofTruncated
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", ar.badFormat("malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (ar *aofReader) badFormat(format string, args ...any) error {
+	return fmt.Errorf("bad file format at offset %d: %s", ar.off, fmt.Sprintf(format, args...))
+}
+
+// reads a whole AOF file without running anything, returns how far it's valid.
+// like loading, a MULTI without its EXEC counts as truncated
+func checkAofFile(fp string, keys *Keyring, maxLen int64) (valid int64, err error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ar, err := newAofReader(f, keys, maxLen, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := ar.snapshot(); err != nil {
+		return 0, err
+	}
+	valid, err = ar.check()
+	off, ferr := ar.fileOffset(valid)
+	if ferr != nil {
+		return 0, ferr
+	}
+	return off, err
+}
+
+// reads the records after the preamble, valid is an offset of the plaintext
+func (ar *aofReader) check() (valid int64, err error) {
+	txStart := int64(-1)
+	for {
+		start := ar.off
+		argv, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if txStart >= 0 {
+				return txStart, err
+			}
+			return ar.off, err
+		}
+
+		switch strings.ToLower(argv[0].bulk) {
+		case "multi":
+			txStart = start
+		case "exec":
+			txStart = -1
+		}
+	}
+
+	if txStart >= 0 {
+		return txStart, errAofTruncated
+	}
+	return ar.off, nil
+}
+
+// goredis check-aof [--fix] [--key-file <file>]... <file>
+// checks a single AOF file, or every file a manifest lists. --fix truncates an incomplete
+// tail, which is only safe for the last file: anything after it would be lost.
+// encrypted files need the keys they were written with
+func checkAof(args []string) int {
+	fix := false
+	var keyFiles []string
+	for len(args) > 1 {
+		if args[0] == "--fix" {
+			fix, args = true, args[1:]
+		} else if args[0] == "--key-file" && len(args) > 2 {
+			keyFiles, args = append(keyFiles, args[1]), args[2:]
+		} else {
+			break
+		}
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: goredis check-aof [--fix] [--key-file <file>]... <file.aof|file.manifest>")
+		return 1
+	}
+
+	var keys *Keyring
+	if len(keyFiles) > 0 {
+		var err error
+		if keys, err = loadKeyring("", keyFiles); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	files := []string{args[0]}
+	if strings.HasSuffix(args[0], aofManifestExt) {
+		m, err := loadAofManifest(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		files = files[:0]
+		for _, af := range m.files() {
+			files = append(files, path.Join(path.Dir(args[0]), af.name))
+		}
+	}
+
+	for i, fp := range files {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		// records are held to the default proto-max-bulk-len
+		valid, err := checkAofFile(fp, keys, NewConfig().maxBulkLen)
+		fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", path.Base(fp), fi.Size(), valid, fi.Size()-valid)
+		if err == nil {
+			fmt.Printf("AOF %s is valid\n", path.Base(fp))
+			continue
+		}
+
+		fmt.Printf("AOF %s is not valid: %v\n", path.Base(fp), err)
+		if !fix {
+			fmt.Println("Use the --fix option to try fixing it.")
+			return 1
+		}
+		if i != len(files)-1 {
+			fmt.Println("Only the last AOF file can be truncated, the files after it would be lost.")
+			return 1
+		}
+
+		if err := os.Truncate(fp, valid); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to truncate AOF: ", err)
+			return 1
+		}
+		fmt.Printf("Successfully truncated AOF %s to %d bytes\n", path.Base(fp), valid)
+	}
+	return 0
+}
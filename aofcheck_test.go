@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// a record checkAofFile and loading both accept, the bad ones below follow it
+const aofGoodRecord = "*3\r\n$3\r\nSET\r\n$11\r\naofcheck:ok\r\n$1\r\n1\r\n"
+
+func TestAofReaderRejectsBadLengths(t *testing.T) {
+	good := int64(len(aofGoodRecord))
+	cases := []struct {
+		name      string
+		tail      string
+		maxLen    int64
+		truncated bool // errAofTruncated rather than a format error
+	}{
+		{"huge argument count", "*9999999999999\r\n", 0, false},
+		{"argument count overflowing int64", "*99999999999999999999\r\n", 0, false},
+		{"negative argument count", "*-3\r\n", 0, false},
+		{"argument count over proto-max-bulk-len", "*17\r\n$3\r\nSET\r\n", 16, false},
+		{"huge bulk length", "*1\r\n$9999999999999\r\nSET\r\n", 0, false},
+		{"negative bulk length", "*1\r\n$-5\r\nSET\r\n", 0, false},
+		{"bulk length over proto-max-bulk-len", "*1\r\n$17\r\naofcheck:toolarge\r\n", 16, false},
+		{"bulk not terminated by CRLF", "*1\r\n$3\r\nSETXX", 0, false},
+		{"cut in a header", "*3\r\n$3\r\nSET\r\n$1", 0, true},
+		{"cut in a bulk", "*3\r\n$3\r\nSET\r\n$5\r\nab", 0, true},
+		{"missing arguments", "*3\r\n$3\r\nSET\r\n", 0, true},
+		// allowed by the cap, the file just doesn't hold it: nothing of that size is allocated up front
+		{"bulk longer than the file", "*1\r\n$400000000\r\nSET\r\n", 0, true},
+	}
+
+	dir := t.TempDir()
+	for _, tc := range cases {
+		maxLen := tc.maxLen
+		if maxLen == 0 {
+			maxLen = NewConfig().maxBulkLen
+		}
+		fp := path.Join(dir, "bad.aof")
+		if err := os.WriteFile(fp, []byte(aofGoodRecord+tc.tail), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		valid, err := checkAofFile(fp, nil, maxLen)
+		if err == nil {
+			t.Errorf("%s: the file passed the check", tc.name)
+			continue
+		}
+		if valid != good {
+			t.Errorf("%s: valid up to %d, want %d", tc.name, valid, good)
+		}
+		if errors.Is(err, errAofTruncated) != tc.truncated {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+		if !tc.truncated && !strings.Contains(err.Error(), fmt.Sprintf("at offset %d:", good)) {
+			t.Errorf("%s: the error doesn't say where the bad record starts: %v", tc.name, err)
+		}
+	}
+}
+
+// loading replays up to the bad record and reports it instead of crashing
+func TestAofReplayRejectsBadLengths(t *testing.T) {
+	t.Cleanup(func() { dropKeys("aofcheck:") })
+
+	for _, tail := range []string{"*9999999999999\r\n", "*1\r\n$9999999999999\r\nSET\r\n", "*1\r\n$-5\r\nSET\r\n"} {
+		state := newTestAof(t, NewConfig())
+		fp := path.Join(state.aof.dir, "bad.aof")
+		if err := os.WriteFile(fp, []byte(aofGoodRecord+tail), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		n, valid, err := state.aof.replay(fp, &Client{multi: -1}, state)
+		if err == nil || errors.Is(err, errAofTruncated) || n != 1 || valid != int64(len(aofGoodRecord)) {
+			t.Fatalf("replaying %q: %d records, valid up to %d, %v", tail, n, valid, err)
+		}
+		if got := keysWithPrefix("aofcheck:"); got["aofcheck:ok"] != "1" {
+			t.Fatalf("the record before the bad one wasn't replayed: %v", got)
+		}
+	}
+}
+
+// bulks bigger than one read are read whole
+func TestAofReaderLargeBulk(t *testing.T) {
+	fp := path.Join(t.TempDir(), "large.aof")
+	value := strings.Repeat("v", 3*aofBulkChunk+7)
+	writeAofFile(t, fp, []string{"SET", "aofcheck:large", value})
+
+	records := aofFileRecords(t, fp, nil)
+	if len(records) != 1 || len(records[0]) != 3 || records[0][2] != value {
+		t.Fatalf("read %d records", len(records))
+	}
+}
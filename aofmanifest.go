@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// file types in the manifest, same letters as redis
+const (
+	AofBase        = 'b'
+	AofIncr        = 'i'
+	AofHistory     = 'h'
+	aofManifestExt = ".manifest"
+)
+
+type AofFile struct {
+	name string
+	seq  int
+	typ  byte
+}
+
+// the manifest lists the files that make up the AOF: at most one base followed by
+// incremental files in sequence order. files replaced by a rewrite are kept as
+// history until they're deleted and are never loaded
+type AofManifest struct {
+	base    *AofFile
+	incrs   []*AofFile
+	history []*AofFile
+	baseSeq int // last sequence numbers handed out
+	incrSeq int
+}
+
+func (m *AofManifest) clone() *AofManifest {
+	cp := *m
+	cp.incrs = append([]*AofFile{}, m.incrs...)
+	cp.history = append([]*AofFile{}, m.history...)
+	return &cp
+}
+
+// files to replay, in order
+func (m *AofManifest) files() []*AofFile {
+	var files []*AofFile
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *AofManifest) encode() string {
+	var sb strings.Builder
+	line := func(f *AofFile) {
+		fmt.Fprintf(&sb, "file %s seq %d type %c\n", f.name, f.seq, f.typ)
+	}
+
+	if m.base != nil {
+		line(m.base)
+	}
+	for _, f := range m.history {
+		line(f)
+	}
+	for _, f := range m.incrs {
+		line(f)
+	}
+	return sb.String()
+}
+
+// parses and validates a manifest, each line is "file <name> seq <n> type <b|i|h>"
+func loadAofManifest(fp string) (*AofManifest, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &AofManifest{}
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		af, err := parseAofManifestLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest %s line %d: %w", fp, lineno, err)
+		}
+
+		switch af.typ {
+		case AofBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest %s: more than one base file", fp)
+			}
+			m.base = af
+			m.baseSeq = af.seq
+		case AofIncr:
+			m.incrs = append(m.incrs, af)
+			m.incrSeq = max(m.incrSeq, af.seq)
+		case AofHistory:
+			m.history = append(m.history, af)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(m.incrs, func(i int, j int) bool {
+		return m.incrs[i].seq < m.incrs[j].seq
+	})
+	for i := 1; i < len(m.incrs); i++ {
+		if m.incrs[i].seq == m.incrs[i-1].seq {
+			return nil, fmt.Errorf("invalid AOF manifest %s: duplicate incr sequence %d", fp, m.incrs[i].seq)
+		}
+	}
+
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, fmt.Errorf("invalid AOF manifest %s: no base or incr files", fp)
+	}
+	return m, nil
+}
+
+func parseAofManifestLine(line string) (*AofFile, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("odd number of fields")
+	}
+
+	af := &AofFile{}
+	for i := 0; i < len(fields); i += 2 {
+		val := fields[i+1]
+		switch fields[i] {
+		case "file":
+			if strings.ContainsAny(val, "/\\") {
+				return nil, fmt.Errorf("file name %s is not in the AOF directory", val)
+			}
+			af.name = val
+		case "seq":
+			seq, err := strconv.Atoi(val)
+			if err != nil || seq < 1 {
+				return nil, fmt.Errorf("invalid sequence %s", val)
+			}
+			af.seq = seq
+		case "type":
+			if len(val) != 1 || (val[0] != AofBase && val[0] != AofIncr && val[0] != AofHistory) {
+				return nil, fmt.Errorf("invalid file type %s", val)
+			}
+			af.typ = val[0]
+		}
+		// unknown keys are skipped so newer manifests still load
+	}
+
+	if af.name == "" || af.seq == 0 || af.typ == 0 {
+		return nil, errors.New("missing file, seq or type")
+	}
+	return af, nil
+}
+
+// writes the manifest to a temp file and renames it into place so it's always complete on disk
+func persistAofManifest(dir string, fp string, m *AofManifest) error {
+	tmp := path.Join(dir, fmt.Sprintf("temp-%s", path.Base(fp)))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(m.encode()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, fp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return fsyncDir(dir)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func manifestNames(files []*AofFile) []string {
+	var names []string
+	for _, af := range files {
+		names = append(names, af.name)
+	}
+	return names
+}
+
+func TestAofManifestRoundtrip(t *testing.T) {
+	dir := t.TempDir()
+	fp := path.Join(dir, "appendonly.aof"+aofManifestExt)
+
+	m := &AofManifest{
+		base:    &AofFile{name: "appendonly.aof.3.base.rdb", seq: 3, typ: AofBase},
+		incrs:   []*AofFile{{name: "appendonly.aof.7.incr.aof", seq: 7, typ: AofIncr}, {name: "appendonly.aof.8.incr.aof", seq: 8, typ: AofIncr}},
+		history: []*AofFile{{name: "appendonly.aof.2.base.rdb", seq: 2, typ: AofHistory}},
+		baseSeq: 3,
+		incrSeq: 8,
+	}
+	if err := persistAofManifest(dir, fp, m); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file appendonly.aof.3.base.rdb seq 3 type b\n" +
+		"file appendonly.aof.2.base.rdb seq 2 type h\n" +
+		"file appendonly.aof.7.incr.aof seq 7 type i\n" +
+		"file appendonly.aof.8.incr.aof seq 8 type i\n"
+	if string(data) != want {
+		t.Fatalf("wrote\n%s\nwant\n%s", data, want)
+	}
+
+	got, err := loadAofManifest(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.encode() != m.encode() || got.baseSeq != 3 || got.incrSeq != 8 {
+		t.Fatalf("loaded\n%s(base seq %d, incr seq %d)", got.encode(), got.baseSeq, got.incrSeq)
+	}
+	if names := manifestNames(got.files()); !slices.Equal(names, []string{"appendonly.aof.3.base.rdb", "appendonly.aof.7.incr.aof", "appendonly.aof.8.incr.aof"}) {
+		t.Fatalf("files to replay are %v", names)
+	}
+}
+
+func TestAofManifestParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		manifest string
+		ok       bool
+	}{
+		{"comments, blank lines and unknown keys", "# written by redis\n\nfile a.1.base.rdb seq 1 type b startoffset 0\nfile a.2.incr.aof seq 2 type i\n", true},
+		{"incrs out of order", "file a.3.incr.aof seq 3 type i\nfile a.2.incr.aof seq 2 type i\n", true},
+		{"two bases", "file a.1.base.rdb seq 1 type b\nfile a.2.base.rdb seq 2 type b\n", false},
+		{"duplicate incr seq", "file a.1.incr.aof seq 1 type i\nfile b.1.incr.aof seq 1 type i\n", false},
+		{"only history", "file a.1.base.rdb seq 1 type h\n", false},
+		{"empty", "", false},
+		{"path in the name", "file ../a.1.incr.aof seq 1 type i\n", false},
+		{"bad seq", "file a.1.incr.aof seq 0 type i\n", false},
+		{"bad type", "file a.1.incr.aof seq 1 type x\n", false},
+		{"odd fields", "file a.1.incr.aof seq 1 type\n", false},
+		{"missing type", "file a.1.incr.aof seq 1\n", false},
+	}
+
+	for _, tc := range cases {
+		fp := path.Join(t.TempDir(), "m.manifest")
+		if err := os.WriteFile(fp, []byte(tc.manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := loadAofManifest(fp)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+		if err == nil && !slices.IsSortedFunc(m.incrs, func(a, b *AofFile) int { return a.seq - b.seq }) {
+			t.Errorf("%s: incrs aren't sorted by seq", tc.name)
+		}
+	}
+}
+
+// the files in the AOF directory besides the manifest
+func aofDirFiles(t *testing.T, state *AppState) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(state.aof.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), aofManifestExt) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// each rewrite hands out the next base and incr sequence numbers and deletes what it replaced
+func TestAofManifestTransitions(t *testing.T) {
+	for _, preamble := range []bool{true, false} {
+		conf := NewConfig()
+		conf.aofPreamble = preamble
+		state := newTestAof(t, conf)
+		ext := "aof"
+		if preamble {
+			ext = "rdb"
+		}
+
+		m := state.aof.manifest
+		if m.base != nil || !slices.Equal(manifestNames(m.incrs), []string{"appendonly.aof.1.incr.aof"}) {
+			t.Fatalf("a new AOF starts with\n%s", m.encode())
+		}
+
+		for round := 1; round <= 2; round++ {
+			if err := state.aof.Rewrite(); err != nil {
+				t.Fatal(err)
+			}
+
+			base := fmt.Sprintf("appendonly.aof.%d.base.%s", round, ext)
+			incr := fmt.Sprintf("appendonly.aof.%d.incr.aof", round+1)
+			m := state.aof.manifest
+			if m.base == nil || m.base.name != base || m.base.typ != AofBase || len(m.history) != 0 ||
+				!slices.Equal(manifestNames(m.incrs), []string{incr}) {
+				t.Fatalf("after rewrite %d the manifest is\n%s", round, m.encode())
+			}
+
+			// the manifest on disk says the same, and the replaced files are gone
+			onDisk, err := loadAofManifest(state.aof.manifestPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if onDisk.encode() != m.encode() {
+				t.Fatalf("after rewrite %d the manifest on disk is\n%s", round, onDisk.encode())
+			}
+			if files := aofDirFiles(t, state); !slices.Equal(files, []string{base, incr}) {
+				t.Fatalf("after rewrite %d the AOF directory holds %v", round, files)
+			}
+		}
+	}
+}
+
+// history files left behind by a rewrite that crashed before deleting them are cleaned up at startup
+func TestAofHistoryDeletedAtStartup(t *testing.T) {
+	conf := NewConfig()
+	conf.dir = t.TempDir()
+	dir := path.Join(conf.dir, conf.aofDirname)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &AofManifest{
+		base:    &AofFile{name: "appendonly.aof.2.base.aof", seq: 2, typ: AofBase},
+		incrs:   []*AofFile{{name: "appendonly.aof.3.incr.aof", seq: 3, typ: AofIncr}},
+		history: []*AofFile{{name: "appendonly.aof.1.base.aof", seq: 1, typ: AofHistory}, {name: "appendonly.aof.2.incr.aof", seq: 2, typ: AofHistory}},
+		baseSeq: 2,
+		incrSeq: 3,
+	}
+	for _, af := range append(m.files(), m.history...) {
+		if err := os.WriteFile(path.Join(dir, af.name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := persistAofManifest(dir, path.Join(dir, conf.aofFn+aofManifestExt), m); err != nil {
+		t.Fatal(err)
+	}
+
+	state := newTestAof(t, conf)
+	if len(state.aof.manifest.history) != 0 {
+		t.Fatalf("the manifest still lists history:\n%s", state.aof.manifest.encode())
+	}
+	if files := aofDirFiles(t, state); !slices.Equal(files, []string{"appendonly.aof.2.base.aof", "appendonly.aof.3.incr.aof"}) {
+		t.Fatalf("the AOF directory holds %v", files)
+	}
+}
+
+// a single file AOF from before the manifest becomes the base, keeping its name
+func TestAofUpgradeFromLegacyFile(t *testing.T) {
+	t.Cleanup(func() { dropKeys("aoflegacy:") })
+
+	for _, crashed := range []bool{false, true} {
+		dropKeys("aoflegacy:")
+		conf := NewConfig()
+		conf.dir = t.TempDir()
+		legacy := path.Join(conf.dir, conf.aofFn)
+		writeAofFile(t, legacy, []string{"SET", "aoflegacy:a", "1"}, []string{"SET", "aoflegacy:b", "2"})
+
+		// the manifest naming the base is written before the file moves, a crash in between leaves both
+		if crashed {
+			dir := path.Join(conf.dir, conf.aofDirname)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			m := &AofManifest{base: &AofFile{name: conf.aofFn, seq: 1, typ: AofBase}, baseSeq: 1}
+			if err := persistAofManifest(dir, path.Join(dir, conf.aofFn+aofManifestExt), m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		state := newTestAof(t, conf)
+		m := state.aof.manifest
+		if m.base == nil || m.base.name != conf.aofFn || m.base.seq != 1 ||
+			!slices.Equal(manifestNames(m.incrs), []string{"appendonly.aof.1.incr.aof"}) {
+			t.Fatalf("crashed %v: the upgraded manifest is\n%s", crashed, m.encode())
+		}
+		if _, err := os.Stat(legacy); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("crashed %v: the legacy file wasn't moved: %v", crashed, err)
+		}
+
+		state.aof.Sync(state)
+		if got := keysWithPrefix("aoflegacy:"); !mapsEqual(got, map[string]string{"aoflegacy:a": "1", "aoflegacy:b": "2"}) {
+			t.Fatalf("crashed %v: the upgraded AOF loaded %v", crashed, got)
+		}
+	}
+}
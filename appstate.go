@@ -1,52 +1,118 @@
 package main
 
-import "time"
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type RDBStats struct {
-	rdb_last_save_ts int64
-	rdb_saves        int
+	rdb_last_save_ts            atomic.Int64 // LASTSAVE, the server start until a save succeeds
+	rdb_saves                   atomic.Int64
+	rdb_last_bgsave_err         atomic.Bool  // set once a save fails, until one succeeds, checked on every write
+	rdb_changes_since_last_save atomic.Int64 // keys changed, counted while db.mu is held
+	rdb_bgsave_start            atomic.Int64 // unix nanoseconds, of the running BGSAVE
+	rdb_last_bgsave_time_sec    atomic.Int64 // -1 until a BGSAVE finishes
 }
 
 type AOFStats struct {
-	aof_rewrites int
+	aof_rewrites           atomic.Int64
+	aof_last_bgrewrite_err atomic.Bool  // set when the last rewrite failed
+	aof_last_write_err     atomic.Bool  // set when writing or fsyncing the AOF fails, until a write succeeds
+	aof_current_size       atomic.Int64 // of the base and incr files
+	aof_base_size          atomic.Int64 // aof_current_size at startup or after the last rewrite
 }
 
 type GeneralStats struct {
-	total_connections_received int
-	total_commands_processed   int
-	expired_keys               int
-	evicted_keys               int
+	total_connections_received atomic.Int64
+	rejected_connections       atomic.Int64
+	total_commands_processed   atomic.Int64
+	expired_keys               atomic.Int64
+	evicted_keys               atomic.Int64
+
+	client_output_buffer_limit_disconnections atomic.Int64
+
+	acl_access_denied_auth atomic.Int64
+	acl_access_denied_cmd  atomic.Int64
+	acl_access_denied_key  atomic.Int64
+	auth_rate_limited      atomic.Int64 // AUTH attempts refused without checking the password
 }
 
 type AppState struct { // defines the app state with conf + aof rules
 	conf              *Config
 	aof               *Aof
-	bgsaveRunning     bool
-	aofRewriteRunning bool
-	dbCopy            map[string]*Item
-	tx                *Transaction
-	monitors          []*Client
+	bgsaveRunning     atomic.Bool
+	bgsaveScheduled   atomic.Bool // BGSAVE SCHEDULE came in during a rewrite, it runs once that's done
+	aofRewriteRunning atomic.Bool
+	monitors          []*Client // MONITOR clients, guarded by monitorsMu
+	monitorsMu        sync.Mutex
+	clients           map[int64]*Client // every connected client by id
+	clientsMu         sync.RWMutex
+	reservedClients   int // accepted connections not in clients yet, guarded by clientsMu
+	nextClientId      atomic.Int64
+	pause             *ClientPause
+	acl               *ACL
+	authAudit         *AuthAudit
 	serverStart       time.Time
-	clientCount       int
 	peakMem           int64
-	info              *Info
 	rdbStats          RDBStats
 	aofStats          AOFStats
 	generalStats      GeneralStats
+	loading           Loading
+
+	// shutdown, see Shutdown
+	listeners     []net.Listener
+	gate          sync.RWMutex // read locked by every running write, Shutdown takes it to stop them all
+	shutdownMu    sync.Mutex   // one shutdown at a time
+	shuttingDown  atomic.Bool  // until it goes through or is aborted
+	shutdownAbort atomic.Bool  // set by SHUTDOWN ABORT
+	exiting       atomic.Bool  // past the point of no return, commands are dropped
+	exited        chan struct{}
+}
+
+// with stop-writes-on-bgsave-error, writes are refused while snapshots can't be saved
+func (state *AppState) writesDenied() bool {
+	return state.conf.stopWritesOnBgsaveErr && len(state.conf.rdb) > 0 && state.rdbStats.rdb_last_bgsave_err.Load()
+}
+
+// counts n keys changed for rdb_changes_since_last_save and the save points, must be called with db.mu held
+func (state *AppState) keysChanged(n int) {
+	if n == 0 {
+		return
+	}
+	state.rdbStats.rdb_changes_since_last_save.Add(int64(n))
+	if len(state.conf.rdb) > 0 {
+		IncrRDBTrackers(n)
+	}
+}
+
+// logs a DEL for a key that expired or was evicted. not while loading: the records
+// being replayed are already in the AOF, and the key is deleted again when they run
+func (state *AppState) propagateDel(k string) {
+	if state.aof == nil || state.loading.loading.Load() {
+		return
+	}
+	state.aof.propagateDel(k)
 }
 
 func NewAppState(conf *Config) *AppState {
 	state := AppState{
 		conf:         conf,
+		clients:      map[int64]*Client{},
+		pause:        &ClientPause{},
+		acl:          NewACL(conf),
+		authAudit:    NewAuthAudit(conf),
 		serverStart:  time.Now(),
-		info:         NewInfo(),
-		rdbStats:     RDBStats{},
-		aofStats:     AOFStats{},
 		generalStats: GeneralStats{},
+		exited:       make(chan struct{}),
 	}
+	// like redis the dataset counts as saved at startup
+	state.rdbStats.rdb_last_save_ts.Store(state.serverStart.Unix())
+	state.rdbStats.rdb_last_bgsave_time_sec.Store(-1)
 
 	if conf.aofEnabled {
-		state.aof = NewAof(conf)
+		state.aof = NewAof(conf, &state.aofStats)
 
 		if conf.aofFsync == EverySec {
 			go func() {
@@ -54,7 +120,7 @@ func NewAppState(conf *Config) *AppState {
 				defer t.Stop()
 
 				for range t.C {
-					state.aof.w.Flush()
+					state.aof.Flush()
 				}
 			}()
 		}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// reasons recorded in the auth failure log
+const (
+	AuthFailWrongPass   = "wrongpass"
+	AuthFailRateLimited = "rate-limited"
+)
+
+type AuthFailure struct {
+	id       int64
+	at       time.Time
+	addr     string
+	username string
+	reason   string
+}
+
+// failures from one source address, blockedUntil grows exponentially once the limit is hit
+type authBackoff struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// tracks failed AUTH attempts: per address backoff against brute forcing plus an audit log
+type AuthAudit struct {
+	mu         sync.Mutex
+	sources    map[string]*authBackoff
+	log        []*AuthFailure // newest first
+	nextId     int64
+	maxLen     int
+	limit      int           // failures allowed before backoff kicks in, 0 disables it
+	backoff    time.Duration // first delay, doubled on every further failure
+	maxBackoff time.Duration
+}
+
+// stale addresses are only swept once this many are tracked
+const authSourcesPruneAt = 1024
+
+func NewAuthAudit(conf *Config) *AuthAudit {
+	return &AuthAudit{
+		sources:    map[string]*authBackoff{},
+		maxLen:     conf.authlogMaxLen,
+		limit:      conf.authFailureLimit,
+		backoff:    conf.authFailureBackoff,
+		maxBackoff: conf.authFailureMaxBackoff,
+	}
+}
+
+// clients are limited by IP so reconnecting doesn't reset the backoff, unix socket clients share one bucket
+func sourceIP(c *Client) string {
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "unix"
+}
+
+// how long the client's address must wait before AUTH is tried again, 0 if it may go ahead
+func (a *AuthAudit) Blocked(c *Client) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	src, ok := a.sources[sourceIP(c)]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(src.blockedUntil), 0)
+}
+
+func (a *AuthAudit) Fail(c *Client, username string, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.record(c, username, reason, now)
+
+	// a rejected attempt while blocked doesn't make the backoff longer
+	if reason == AuthFailRateLimited || a.limit == 0 {
+		return
+	}
+
+	ip := sourceIP(c)
+	src, ok := a.sources[ip]
+	// an address that behaved for a full max backoff starts over
+	if !ok || now.Sub(src.lastFailure) > a.maxBackoff {
+		if len(a.sources) >= authSourcesPruneAt {
+			a.prune(now)
+		}
+		src = &authBackoff{}
+		a.sources[ip] = src
+	}
+
+	src.failures++
+	src.lastFailure = now
+	if src.failures >= a.limit {
+		delay := a.maxBackoff
+		if shift := src.failures - a.limit; shift < 32 {
+			delay = min(a.backoff<<shift, a.maxBackoff)
+		}
+		src.blockedUntil = now.Add(delay)
+	}
+}
+
+// only called when a password was verified, AUTH as a nopass user accepts any
+// password and must not wipe the failures of guesses against other users
+func (a *AuthAudit) Succeed(c *Client) {
+	a.mu.Lock()
+	delete(a.sources, sourceIP(c))
+	a.mu.Unlock()
+}
+
+// must be called with a.mu held
+func (a *AuthAudit) record(c *Client, username string, reason string, now time.Time) {
+	entry := &AuthFailure{
+		id:       a.nextId,
+		at:       now,
+		addr:     c.conn.RemoteAddr().String(),
+		username: username,
+		reason:   reason,
+	}
+	a.nextId++
+
+	a.log = append([]*AuthFailure{entry}, a.log...)
+	if len(a.log) > a.maxLen {
+		a.log = a.log[:a.maxLen]
+	}
+}
+
+// drops addresses whose failures are old enough to be forgotten, must be called with a.mu held
+func (a *AuthAudit) prune(now time.Time) {
+	for key, src := range a.sources {
+		if now.Sub(src.lastFailure) > a.maxBackoff {
+			delete(a.sources, key)
+		}
+	}
+}
+
+// number of addresses currently waiting out a backoff
+func (a *AuthAudit) blockedSources() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for _, src := range a.sources {
+		if src.blockedUntil.After(now) {
+			n++
+		}
+	}
+	return n
+}
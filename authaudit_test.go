@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthTestServer(t *testing.T, limit int) (*AppState, *testConn) {
+	t.Helper()
+
+	conf := NewConfig()
+	conf.authFailureLimit = limit
+	conf.authFailureBackoff = time.Minute
+	state := NewAppState(conf)
+	if err := state.acl.SetUser("admin", []string{"on", ">secret", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	return state, dialTest(t, startTestServer(t, state))
+}
+
+func authFails(t *testing.T, tc *testConn, username string) {
+	t.Helper()
+	if got := tc.do(t, "AUTH", username, "guess"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("a wrong password for %s replied %q", username, got)
+	}
+}
+
+// AUTH as a nopass user accepts any password, it must not reset the backoff of the address
+func TestAuthBackoffSurvivesNopassAuth(t *testing.T) {
+	_, tc := newAuthTestServer(t, 3)
+
+	authFails(t, tc, "admin")
+	authFails(t, tc, "admin")
+	if got := tc.do(t, "AUTH", "default", "anything"); got != "+OK" {
+		t.Fatalf("AUTH as the nopass default user replied %q", got)
+	}
+	authFails(t, tc, "admin")
+
+	if got := tc.do(t, "AUTH", "admin", "secret"); got == "+OK" || strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("AUTH after the third failure replied %q, want it rate limited", got)
+	}
+}
+
+// guessing a different username every time still counts against the one address
+func TestAuthBackoffIsPerAddress(t *testing.T) {
+	state, tc := newAuthTestServer(t, 3)
+
+	for i := range 3 {
+		authFails(t, tc, fmt.Sprintf("user%d", i))
+	}
+	if got := tc.do(t, "AUTH", "admin", "secret"); got == "+OK" || strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("AUTH after guessing three usernames replied %q, want it rate limited", got)
+	}
+
+	state.authAudit.mu.Lock()
+	n := len(state.authAudit.sources)
+	state.authAudit.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("tracking %d sources for one address", n)
+	}
+}
+
+func TestAuthSuccessClearsBackoff(t *testing.T) {
+	_, tc := newAuthTestServer(t, 3)
+
+	authFails(t, tc, "admin")
+	authFails(t, tc, "admin")
+	if got := tc.do(t, "AUTH", "admin", "secret"); got != "+OK" {
+		t.Fatalf("the right password replied %q", got)
+	}
+
+	// the count started over, two more failures stay under the limit
+	authFails(t, tc, "admin")
+	authFails(t, tc, "admin")
+	if got := tc.do(t, "AUTH", "admin", "secret"); got != "+OK" {
+		t.Fatalf("the right password after the reset replied %q", got)
+	}
+}
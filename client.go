@@ -1,34 +1,256 @@
 package main
 
 import (
-	"fmt"
+	"bufio"
 	"log"
 	"net"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Client struct {
+	id            int64
 	conn          net.Conn
-	authenticated bool
+	r             *bufio.Reader // query buffer, fills from conn only once every buffered command ran
+	w             *Writer       // encodes replies into out, reused for every reply on this connection
+	out           *OutputBuffer // pending output, drained to conn by its own goroutine
+	class         ClientClass   // picks the client-output-buffer-limit that applies
+	authenticated bool          // false until AUTH succeeds, unless the default user needs no password
+	tx            *Transaction  // open MULTI, nil outside of a transaction
+	createdAt     time.Time
+
+	closeAfterReply bool // set by CLIENT KILL on itself
+
+	propagateArgv []Value // set by handlers whose command must be logged differently to replay the same
+	noPropagate   bool    // set by handlers whose command changed nothing, it isn't logged
+
+	// CLIENT REPLY state, skipReply silences the command being run
+	replyOff  bool
+	skipNext  bool
+	skipReply bool
+
+	// read by CLIENT LIST from other connections
+	mu              sync.Mutex
+	name            string
+	lastCmd         string
+	lastInteraction time.Time
+	multi           int // commands queued in MULTI, -1 outside of a transaction
+	qbuf            int // unread bytes in the query buffer
+	monitor         bool
+	blocked         bool // waiting on CLIENT PAUSE
+	noEvict         bool
+	noTouch         bool  // commands from this client don't update LRU/LFU metadata
+	user            *User // ACL user, default until AUTH switches it
+
+	// MONITOR line encoder, reused for every command fanned out to this monitor
+	monitorMu  sync.Mutex
+	monitorBuf []byte
+}
+
+func NewClient(conn net.Conn, state *AppState) *Client {
+	now := time.Now()
+	c := &Client{
+		id:              state.nextClientId.Add(1),
+		conn:            conn,
+		out:             NewOutputBuffer(),
+		class:           ClassNormal,
+		createdAt:       now,
+		lastInteraction: now,
+		multi:           -1,
+		authenticated:   state.acl.defaultNoPass(),
+	}
+	c.user, _ = state.acl.User("default")
+	c.w = NewWriter(c.out)
+	c.r = bufio.NewReader(clientReader{c: c})
+
+	c.out.limit = func() OutputBufferLimit {
+		return state.conf.outputLimits[c.class]
+	}
+	c.out.onLimit = func(size int) {
+		log.Printf("client %s closed for overcoming of output buffer limits (class: %s, size: %d)", conn.RemoteAddr().String(), c.class, size)
+		state.generalStats.client_output_buffer_limit_disconnections.Add(1)
+		conn.Close() // unblocks the reader so handleConn cleans the client up
+	}
+
+	return c
+}
+
+func (c *Client) getUser() *User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+func (c *Client) setUser(u *User) {
+	c.mu.Lock()
+	c.user = u
+	c.mu.Unlock()
+}
+
+// takes a slot for a connection that was just accepted unless maxclients are connected,
+// it's checked and taken at once so a burst of connections can't get past the limit
+func (state *AppState) reserveClient() bool {
+	state.clientsMu.Lock()
+	defer state.clientsMu.Unlock()
+
+	if len(state.clients)+state.reservedClients >= state.conf.maxclients {
+		return false
+	}
+	state.reservedClients++
+	return true
+}
+
+// gives back a reserved slot of a connection that's closed before it became a client
+func (state *AppState) releaseClient() {
+	state.clientsMu.Lock()
+	state.reservedClients--
+	state.clientsMu.Unlock()
+}
+
+// adds a client in the slot reserved for its connection
+func (state *AppState) addClient(c *Client) {
+	state.clientsMu.Lock()
+	state.reservedClients--
+	state.clients[c.id] = c
+	state.clientsMu.Unlock()
+}
+
+func (state *AppState) removeClient(c *Client) {
+	state.clientsMu.Lock()
+	delete(state.clients, c.id)
+	state.clientsMu.Unlock()
+}
+
+func (state *AppState) addMonitor(c *Client) {
+	state.monitorsMu.Lock()
+	state.monitors = append(state.monitors, c)
+	state.monitorsMu.Unlock()
+}
+
+func (state *AppState) removeMonitor(c *Client) {
+	state.monitorsMu.Lock()
+	state.monitors = slices.DeleteFunc(state.monitors, func(mon *Client) bool { return mon == c })
+	state.monitorsMu.Unlock()
+}
+
+// a copy of the monitors, fan-out writes to them without holding the lock
+func (state *AppState) monitorList() []*Client {
+	state.monitorsMu.Lock()
+	defer state.monitorsMu.Unlock()
+	return slices.Clone(state.monitors)
+}
+
+func (state *AppState) clientCount() int {
+	state.clientsMu.RLock()
+	defer state.clientsMu.RUnlock()
+	return len(state.clients)
+}
+
+// writes every pending reply to the socket, used before the client blocks
+func (c *Client) flush() error {
+	c.w.Flush()
+	return c.out.drain(c.conn)
+}
+
+// queues a reply unless CLIENT REPLY turned replies off, nil means no reply at all
+func (c *Client) reply(v *Value) {
+	if v == nil || c.replyOff || c.skipReply {
+		return
+	}
+	c.w.Write(v)
+}
+
+func (c *Client) setBlocked(blocked bool) {
+	c.mu.Lock()
+	c.blocked = blocked
+	c.mu.Unlock()
 }
 
-func NewClient(conn net.Conn) *Client {
-	return &Client{
-		conn: conn,
+func (c *Client) recordCommand(cmd *Command) {
+	c.mu.Lock()
+	c.lastCmd = cmd.name
+	c.lastInteraction = time.Now()
+	c.qbuf = c.r.Buffered()
+	c.multi = -1
+	if c.tx != nil {
+		c.multi = len(c.tx.cmds)
+	}
+	c.mu.Unlock()
+}
+
+// reader handed to bufio.Reader, it only hits the socket once every buffered
+// command has been handled so that's when the pending replies get flushed
+// this batches replies for pipelined clients into a single write
+// the client's own replies are written inline, writeLoop only handles output
+// pushed by other goroutines (e.g. monitor fan-out)
+type clientReader struct {
+	c *Client
+}
+
+func (cr clientReader) Read(p []byte) (int, error) {
+	if err := cr.c.flush(); err != nil {
+		return 0, err
+	}
+
+	n, err := cr.c.conn.Read(p)
+	if n > 0 {
+		cr.c.mu.Lock()
+		cr.c.lastInteraction = time.Now()
+		cr.c.mu.Unlock()
+	}
+	return n, err
+}
+
+// closes clients idle for longer than the timeout directive, like redis it
+// leaves alone clients that are expected to sit quiet: monitors, pub/sub
+// subscribers and clients blocked by CLIENT PAUSE
+func (state *AppState) closeIdleClients() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for range t.C {
+		timeout := time.Duration(state.conf.timeout) * time.Second
+
+		for _, c := range state.sortedClients() {
+			c.mu.Lock()
+			idle := time.Since(c.lastInteraction)
+			exempt := c.monitor || c.blocked || c.class == ClassPubSub
+			c.mu.Unlock()
+
+			if !exempt && idle > timeout {
+				log.Println("closing idle client: ", c.conn.RemoteAddr().String())
+				c.conn.Close()
+			}
+		}
 	}
 }
 
+// appends the redis MONITOR line for v, e.g. +1339518083.107412 [0 127.0.0.1:60866] "keys" "*",
+// straight to the monitor's output buffer so a stuck monitor can't block the sender
 func (c *Client) writeMonitorLog(sender *Client, v *Value) {
-	log.Println("relaying command to monitor: ", c.conn.LocalAddr().String())
+	c.monitorMu.Lock()
+	defer c.monitorMu.Unlock()
 
-	msg := fmt.Sprintf("%d [%s]", time.Now().Unix(), sender.conn.LocalAddr().String())
+	now := time.Now()
+	buf := append(c.monitorBuf[:0], '+')
+	buf = strconv.AppendInt(buf, now.Unix(), 10)
+	buf = append(buf, '.')
+	usec := len(buf)
+	buf = strconv.AppendInt(buf, int64(1_000_000+now.Nanosecond()/1000), 10)
+	buf = append(buf[:usec], buf[usec+1:]...) // zero padded to 6 digits
+	buf = append(buf, " [0 "...)
+	buf = append(buf, sender.conn.RemoteAddr().String()...)
+	buf = append(buf, ']')
 
-	for _, v := range v.array {
-		msg += fmt.Sprintf("\"%s\"", v.bulk)
+	// quoting escapes CR and LF, the line stays a valid status reply
+	for i := range v.array {
+		buf = append(buf, ' ')
+		buf = strconv.AppendQuote(buf, v.array[i].bulk)
 	}
+	buf = append(buf, '\r', '\n')
 
-	reply := Value{typ: STRING, str: msg}
-	w := NewWriter(c.conn)
-	w.Write(&reply)
-	w.Flush()
+	c.out.Write(buf)
+	c.monitorBuf = buf
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// GET against a missing key, depth commands written at once before their replies are read
+func BenchmarkPipeline(b *testing.B) {
+	addr := startTestServer(b, NewAppState(NewConfig()))
+
+	const get = "*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n"
+	const reply = "$-1\r\n"
+
+	for _, depth := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			tc := dialTest(b, addr)
+			batch := []byte(strings.Repeat(get, depth))
+			replies := make([]byte, len(reply)*depth)
+
+			b.ResetTimer()
+			for sent := 0; sent < b.N; sent += depth {
+				if _, err := tc.Write(batch); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(tc.r, replies); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
+
+func TestMonitorLine(t *testing.T) {
+	addr := startTestServer(t, NewAppState(NewConfig()))
+
+	mon := dialTest(t, addr)
+	if got := mon.do(t, "MONITOR"); got != "+OK" {
+		t.Fatalf("MONITOR replied %q", got)
+	}
+
+	tc := dialTest(t, addr)
+	tc.do(t, "SET", "k", "a b\r\n")
+	tc.do(t, "GET", "k")
+
+	line := regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] (.*)$`)
+	for _, want := range []string{`"SET" "k" "a b\r\n"`, `"GET" "k"`} {
+		got, err := readLine(mon.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := line.FindStringSubmatch(got)
+		if m == nil || m[1] != want {
+			t.Fatalf("monitor got %q, want the args %s", got, want)
+		}
+		if !strings.HasSuffix(m[0], tc.LocalAddr().String()+"] "+want) {
+			t.Errorf("%q doesn't name the sending client %s", got, tc.LocalAddr())
+		}
+	}
+}
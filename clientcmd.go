@@ -0,0 +1,476 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CLIENT PAUSE state shared by every connection
+type ClientPause struct {
+	mu    sync.Mutex
+	mode  string // "all" or "write", empty when nothing is paused
+	until time.Time
+	done  chan struct{} // closed on CLIENT UNPAUSE to wake every paused client
+}
+
+// a new pause never shortens or relaxes one already in progress
+func (p *ClientPause) Pause(mode string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.active() {
+		if until.Before(p.until) {
+			until = p.until
+		}
+		if p.mode == "all" {
+			mode = "all"
+		}
+	} else {
+		p.done = make(chan struct{})
+	}
+
+	p.mode = mode
+	p.until = until
+}
+
+func (p *ClientPause) Unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.mode = ""
+}
+
+// must be called with p.mu held
+func (p *ClientPause) active() bool {
+	return p.mode != "" && time.Now().Before(p.until)
+}
+
+// ALL pauses every command, WRITE only the ones that could modify the dataset
+func (p *ClientPause) blocks(c *Client, cmd *Command) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.active() {
+		return false
+	}
+	return p.mode == "all" || isWriteCmd(c, cmd)
+}
+
+// blocks until the pause ends or gets lifted
+func (p *ClientPause) wait(c *Client, cmd *Command) {
+	for {
+		p.mu.Lock()
+		if !p.active() || (p.mode == "write" && !isWriteCmd(c, cmd)) {
+			p.mu.Unlock()
+			return
+		}
+		done := p.done
+		timer := time.NewTimer(time.Until(p.until))
+		p.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// EXEC counts as a write when anything it queued does
+func isWriteCmd(c *Client, cmd *Command) bool {
+	if cmd.has(CmdWrite) {
+		return true
+	}
+
+	return cmd.name == "exec" && c.tx != nil && c.tx.hasWrites()
+}
+
+func clientId(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: INTEGER, num: int(c.id)}
+}
+
+func clientInfo(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: BULK, bulk: c.infoLine() + "\n"}
+}
+
+func clientList(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+	filter := func(cl *Client) bool { return true }
+
+	if len(args) > 0 {
+		switch strings.ToLower(args[0].bulk) {
+		case "type":
+			if len(args) != 2 {
+				return errReply(ErrSyntax)
+			}
+			class, ok := parseClientType(args[1].bulk)
+			if !ok {
+				return errReply(ErrUnknownClientType(args[1].bulk))
+			}
+			filter = func(cl *Client) bool { return cl.class == class }
+		case "id":
+			if len(args) < 2 {
+				return errReply(ErrSyntax)
+			}
+			ids := map[int64]bool{}
+			for _, arg := range args[1:] {
+				id, err := strconv.ParseInt(arg.bulk, 10, 64)
+				if err != nil || id <= 0 {
+					return errReply(ErrInvalidClientId)
+				}
+				ids[id] = true
+			}
+			filter = func(cl *Client) bool { return ids[cl.id] }
+		default:
+			return errReply(ErrSyntax)
+		}
+	}
+
+	var lines []string
+	for _, cl := range state.sortedClients() {
+		if filter(cl) {
+			lines = append(lines, cl.infoLine()+"\n")
+		}
+	}
+	return &Value{typ: BULK, bulk: strings.Join(lines, "")}
+}
+
+func clientSetName(c *Client, v *Value, state *AppState) *Value {
+	name := v.array[2].bulk
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return errReply(ErrClientName)
+		}
+	}
+
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func clientGetName(c *Client, v *Value, state *AppState) *Value {
+	c.mu.Lock()
+	name := c.name
+	c.mu.Unlock()
+
+	if name == "" {
+		return &Value{typ: NULL}
+	}
+	return &Value{typ: BULK, bulk: name}
+}
+
+// CLIENT KILL addr (old form) or CLIENT KILL <filter> <value> ... (new form)
+func clientKill(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+
+	if len(args) == 1 {
+		addr := args[0].bulk
+		for _, cl := range state.sortedClients() {
+			if cl.conn.RemoteAddr().String() == addr {
+				killClient(c, cl)
+				return &Value{typ: STRING, str: "OK"}
+			}
+		}
+		return errReply(ErrNoSuchClient)
+	}
+
+	if len(args)%2 != 0 {
+		return errReply(ErrSyntax)
+	}
+
+	skipme := true
+	var filters []func(cl *Client) bool
+
+	for i := 0; i < len(args); i += 2 {
+		val := args[i+1].bulk
+
+		switch strings.ToLower(args[i].bulk) {
+		case "id":
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || id <= 0 {
+				return errReply(ErrClientIdRange)
+			}
+			filters = append(filters, func(cl *Client) bool { return cl.id == id })
+		case "type":
+			class, ok := parseClientType(val)
+			if !ok {
+				return errReply(ErrUnknownClientType(val))
+			}
+			filters = append(filters, func(cl *Client) bool { return cl.class == class })
+		case "addr":
+			filters = append(filters, func(cl *Client) bool { return cl.conn.RemoteAddr().String() == val })
+		case "laddr":
+			filters = append(filters, func(cl *Client) bool { return cl.conn.LocalAddr().String() == val })
+		case "user":
+			u, ok := state.acl.User(val)
+			if !ok {
+				return errReply(ErrNoSuchUser(val))
+			}
+			filters = append(filters, func(cl *Client) bool { return cl.getUser() == u })
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			default:
+				return errReply(ErrSyntax)
+			}
+		case "maxage":
+			maxage, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return errReply(ErrNotInteger)
+			}
+			filters = append(filters, func(cl *Client) bool {
+				return int64(time.Since(cl.createdAt).Seconds()) >= maxage
+			})
+		default:
+			return errReply(ErrSyntax)
+		}
+	}
+
+	var n int
+	for _, cl := range state.sortedClients() {
+		if skipme && cl == c {
+			continue
+		}
+
+		matched := true
+		for _, f := range filters {
+			if !f(cl) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			killClient(c, cl)
+			n++
+		}
+	}
+
+	return &Value{typ: INTEGER, num: n}
+}
+
+// a client killing itself still gets the reply before the connection drops
+func killClient(killer *Client, target *Client) {
+	if target == killer {
+		target.closeAfterReply = true
+		return
+	}
+	target.conn.Close()
+}
+
+func clientPause(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+
+	ms, err := strconv.ParseInt(args[0].bulk, 10, 64)
+	if err != nil {
+		return errReply(ErrPauseTimeout)
+	}
+	if ms < 0 {
+		return errReply(ErrPauseNegative)
+	}
+
+	mode := "all"
+	if len(args) == 2 {
+		mode = strings.ToLower(args[1].bulk)
+	}
+	if len(args) > 2 || (mode != "all" && mode != "write") {
+		return errReply(ErrSyntax)
+	}
+
+	state.pause.Pause(mode, time.Now().Add(time.Duration(ms)*time.Millisecond))
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func clientUnpause(c *Client, v *Value, state *AppState) *Value {
+	state.pause.Unpause()
+	return &Value{typ: STRING, str: "OK"}
+}
+
+// OFF and SKIP are not replied to, a nil reply is dropped by handle
+func clientReply(c *Client, v *Value, state *AppState) *Value {
+	switch strings.ToLower(v.array[2].bulk) {
+	case "on":
+		c.replyOff = false
+		return &Value{typ: STRING, str: "OK"}
+	case "off":
+		c.replyOff = true
+		return nil
+	case "skip":
+		if !c.replyOff {
+			c.skipNext = true
+		}
+		return nil
+	}
+	return errReply(ErrSyntax)
+}
+
+func clientNoEvict(c *Client, v *Value, state *AppState) *Value {
+	on, ok := parseOnOff(v.array[2].bulk)
+	if !ok {
+		return errReply(ErrSyntax)
+	}
+
+	c.mu.Lock()
+	c.noEvict = on
+	c.mu.Unlock()
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func clientNoTouch(c *Client, v *Value, state *AppState) *Value {
+	on, ok := parseOnOff(v.array[2].bulk)
+	if !ok {
+		return errReply(ErrSyntax)
+	}
+
+	c.mu.Lock()
+	c.noTouch = on
+	c.mu.Unlock()
+
+	return &Value{typ: STRING, str: "OK"}
+}
+
+func clientHelp(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: ARRAY, array: statusArray([]string{
+		"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"GETNAME",
+		"    Return the name of the current connection.",
+		"ID",
+		"    Return the ID of the current connection.",
+		"INFO",
+		"    Return information about the current client connection.",
+		"KILL <ip:port>",
+		"    Kill connection made from <ip:port>.",
+		"KILL <option> <value> [<option> <value> [...]]",
+		"    Kill connections. Options are:",
+		"    * ADDR (<ip:port>|<unixsocket>:0)",
+		"      Kill connections made from the specified address",
+		"    * LADDR (<ip:port>|<unixsocket>:0)",
+		"      Kill connections made to specified local address",
+		"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+		"      Kill connections by type.",
+		"    * USER <username>",
+		"      Kill connections authenticated by <username>.",
+		"    * SKIPME (YES|NO)",
+		"      Skip killing current connection (default: yes).",
+		"    * ID <client-id>",
+		"      Kill connections by client id.",
+		"    * MAXAGE <maxage>",
+		"      Kill connections older than the specified age.",
+		"LIST [options ...]",
+		"    Return information about client connections. Options:",
+		"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+		"      Return clients of specified type.",
+		"    * ID <client-id> [<client-id> ...]",
+		"      Return clients of specified IDs only.",
+		"PAUSE <timeout> [WRITE|ALL]",
+		"    Suspend all, or just write, clients for <timeout> milliseconds.",
+		"UNPAUSE",
+		"    Stop the current client pause, resuming traffic.",
+		"SETNAME <name>",
+		"    Assign the name <name> to the current connection.",
+		"REPLY (ON|OFF|SKIP)",
+		"    Control the replies sent to the current connection.",
+		"NO-EVICT (ON|OFF)",
+		"    Protect current client connection from eviction.",
+		"NO-TOUCH (ON|OFF)",
+		"    Will not touch LRU/LFU stats when this mode is on.",
+		"HELP",
+		"    Print this help.",
+	}).array}
+}
+
+// one CLIENT LIST line, same field names as redis so existing tooling can parse it
+func (c *Client) infoLine() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flags := ""
+	if c.monitor {
+		flags += "O"
+	}
+	if c.blocked {
+		flags += "b"
+	}
+	if c.multi >= 0 {
+		flags += "x"
+	}
+	if c.noEvict {
+		flags += "e"
+	}
+	if c.noTouch {
+		flags += "T"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	return fmt.Sprintf(
+		"id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=0 psub=0 ssub=0 multi=%d qbuf=%d omem=%d cmd=%s user=%s resp=2",
+		c.id,
+		c.conn.RemoteAddr().String(),
+		c.conn.LocalAddr().String(),
+		c.name,
+		int(time.Since(c.createdAt).Seconds()),
+		int(time.Since(c.lastInteraction).Seconds()),
+		flags,
+		c.multi,
+		c.qbuf,
+		c.out.Len(),
+		c.lastCmd,
+		c.user.name,
+	)
+}
+
+func (state *AppState) sortedClients() []*Client {
+	state.clientsMu.RLock()
+	clients := make([]*Client, 0, len(state.clients))
+	for _, cl := range state.clients {
+		clients = append(clients, cl)
+	}
+	state.clientsMu.RUnlock()
+
+	sort.Slice(clients, func(i int, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+// redis still accepts "slave" for replicas, there is no master link here so
+// master is valid but never matches
+func parseClientType(s string) (ClientClass, bool) {
+	switch strings.ToLower(s) {
+	case "normal":
+		return ClassNormal, true
+	case "replica", "slave":
+		return ClassReplica, true
+	case "pubsub":
+		return ClassPubSub, true
+	case "master":
+		return "master", true
+	}
+	return "", false
+}
+
+func parseOnOff(s string) (on bool, ok bool) {
+	switch strings.ToLower(s) {
+	case "on":
+		return true, true
+	case "off":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientSetNameAndList(t *testing.T) {
+	addr := startTestServer(t, NewAppState(NewConfig()))
+	tc := dialTest(t, addr)
+	other := dialTest(t, addr)
+	other.do(t, "DBSIZE")
+
+	if got := tc.do(t, "CLIENT", "GETNAME"); got != "$-1" {
+		t.Fatalf("GETNAME before SETNAME replied %q", got)
+	}
+	if got := tc.do(t, "CLIENT", "SETNAME", "bad name"); got != "-"+ErrClientName.Error() {
+		t.Fatalf("a name with a space replied %q", got)
+	}
+	if got := tc.do(t, "CLIENT", "SETNAME", "worker"); got != "+OK" {
+		t.Fatalf("SETNAME replied %q", got)
+	}
+	if got := tc.do(t, "CLIENT", "GETNAME"); got != "worker" {
+		t.Fatalf("GETNAME replied %q", got)
+	}
+
+	id := strings.TrimPrefix(tc.do(t, "CLIENT", "ID"), ":")
+
+	list := tc.do(t, "CLIENT", "LIST")
+	if lines := strings.Split(strings.TrimSuffix(list, "\n"), "\n"); len(lines) != 2 {
+		t.Fatalf("CLIENT LIST has %d lines, want 2:\n%s", len(lines), list)
+	}
+
+	line := tc.do(t, "CLIENT", "LIST", "ID", id)
+	for _, field := range []string{
+		"id=" + id + " ",
+		"addr=" + tc.LocalAddr().String() + " ",
+		"name=worker ",
+		"flags=N ",
+		"cmd=client|list ",
+		"user=default ",
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("CLIENT LIST ID %s is missing %q: %s", id, field, line)
+		}
+	}
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("CLIENT LIST ID returned more than one client: %s", line)
+	}
+
+	if got := tc.do(t, "CLIENT", "LIST", "ID", "0"); got != "-"+ErrInvalidClientId.Error() {
+		t.Errorf("LIST ID 0 replied %q", got)
+	}
+	if got := tc.do(t, "CLIENT", "LIST", "TYPE", "nope"); got != "-"+ErrUnknownClientType("nope").Error() {
+		t.Errorf("LIST TYPE nope replied %q", got)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	addr := startTestServer(t, NewAppState(NewConfig()))
+	tc := dialTest(t, addr)
+
+	victim := dialTest(t, addr)
+	id := strings.TrimPrefix(victim.do(t, "CLIENT", "ID"), ":")
+	if got := tc.do(t, "CLIENT", "KILL", "ID", id); got != ":1" {
+		t.Fatalf("KILL ID replied %q", got)
+	}
+	if _, err := readLine(victim.r); err == nil {
+		t.Fatal("the killed client is still connected")
+	}
+
+	// the old form takes the address and errors when nobody matches
+	victim = dialTest(t, addr)
+	victim.do(t, "DBSIZE")
+	if got := tc.do(t, "CLIENT", "KILL", victim.LocalAddr().String()); got != "+OK" {
+		t.Fatalf("KILL addr replied %q", got)
+	}
+	if _, err := readLine(victim.r); err == nil {
+		t.Fatal("the client killed by address is still connected")
+	}
+	if got := tc.do(t, "CLIENT", "KILL", "127.0.0.1:1"); got != "-"+ErrNoSuchClient.Error() {
+		t.Fatalf("KILL of an unknown address replied %q", got)
+	}
+
+	// SKIPME defaults to yes, with no the caller gets its reply and is then disconnected
+	self := strings.TrimPrefix(tc.do(t, "CLIENT", "ID"), ":")
+	if got := tc.do(t, "CLIENT", "KILL", "ID", self); got != ":0" {
+		t.Fatalf("KILL of itself without SKIPME no replied %q", got)
+	}
+	if got := tc.do(t, "CLIENT", "KILL", "ID", self, "SKIPME", "no"); got != ":1" {
+		t.Fatalf("KILL of itself with SKIPME no replied %q", got)
+	}
+	if _, err := readLine(tc.r); err == nil {
+		t.Fatal("the client that killed itself is still connected")
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	tc := dialTest(t, startTestServer(t, NewAppState(NewConfig())))
+
+	tc.send(t, "CLIENT", "REPLY", "OFF")
+	tc.send(t, "SET", "reply:k", "v")
+	if got := tc.do(t, "CLIENT", "REPLY", "ON"); got != "+OK" {
+		t.Fatalf("the first reply after REPLY OFF was %q, want ON's +OK", got)
+	}
+
+	tc.send(t, "CLIENT", "REPLY", "SKIP")
+	tc.send(t, "GET", "reply:k")
+	if got := tc.do(t, "GET", "reply:k"); got != "v" {
+		t.Fatalf("the first reply after REPLY SKIP was %q, want the second GET", got)
+	}
+
+	if got := tc.do(t, "CLIENT", "REPLY", "MAYBE"); got != "-"+ErrSyntax.Error() {
+		t.Fatalf("REPLY MAYBE replied %q", got)
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	addr := startTestServer(t, NewAppState(NewConfig()))
+	tc := dialTest(t, addr)
+	other := dialTest(t, addr)
+
+	if got := tc.do(t, "CLIENT", "PAUSE", "-1"); got != "-"+ErrPauseNegative.Error() {
+		t.Fatalf("a negative timeout replied %q", got)
+	}
+	if got := tc.do(t, "CLIENT", "PAUSE", "10", "SOME"); got != "-"+ErrSyntax.Error() {
+		t.Fatalf("an unknown mode replied %q", got)
+	}
+
+	other.do(t, "DEL", "pause:k")
+
+	// WRITE lets reads through and holds writes until the pause runs out
+	const pause = 300 * time.Millisecond
+	start := time.Now()
+	if got := tc.do(t, "CLIENT", "PAUSE", "300", "WRITE"); got != "+OK" {
+		t.Fatalf("PAUSE replied %q", got)
+	}
+	if got := other.do(t, "GET", "pause:k"); got != "$-1" {
+		t.Fatalf("GET during a write pause replied %q", got)
+	}
+	if elapsed := time.Since(start); elapsed >= pause {
+		t.Fatalf("GET was held for %v by a write pause", elapsed)
+	}
+	if got := other.do(t, "SET", "pause:k", "v"); got != "+OK" {
+		t.Fatalf("SET replied %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < pause {
+		t.Fatalf("SET went through after %v, during the pause", elapsed)
+	}
+
+	// UNPAUSE releases a held client long before the timeout. Like redis an ALL pause
+	// would hold UNPAUSE too, so this one only pauses writes
+	start = time.Now()
+	tc.do(t, "CLIENT", "PAUSE", "10000", "WRITE")
+	other.send(t, "DEL", "pause:k")
+	time.Sleep(50 * time.Millisecond)
+	if got := tc.do(t, "CLIENT", "UNPAUSE"); got != "+OK" {
+		t.Fatalf("UNPAUSE replied %q", got)
+	}
+	if got := other.reply(t); got != ":1" {
+		t.Fatalf("DEL replied %q", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the paused client was released after %v", elapsed)
+	}
+}
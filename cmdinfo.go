@@ -0,0 +1,281 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// COMMAND and its subcommands, generated from the command table so clients can
+// learn arity and key positions at connect time
+
+func command(c *Client, v *Value, state *AppState) *Value {
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, cmd := range sortedCommands() {
+		reply.array = append(reply.array, commandInfoReply(cmd))
+	}
+	return &reply
+}
+
+func commandCount(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: INTEGER, num: len(Commands)}
+}
+
+func commandInfo(c *Client, v *Value, state *AppState) *Value {
+	names := v.array[2:]
+	if len(names) == 0 {
+		return command(c, v, state)
+	}
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, name := range names {
+		cmd, ok := lookupCommandOrSub(name.bulk)
+		if !ok {
+			reply.array = append(reply.array, Value{typ: NULL})
+			continue
+		}
+		reply.array = append(reply.array, commandInfoReply(cmd))
+	}
+	return &reply
+}
+
+func commandDocs(c *Client, v *Value, state *AppState) *Value {
+	var cmds []*Command
+	if len(v.array) == 2 {
+		cmds = sortedCommands()
+	}
+	for _, name := range v.array[2:] {
+		if cmd, ok := lookupCommandOrSub(name.bulk); ok {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, cmd := range cmds {
+		reply.array = append(reply.array, Value{typ: BULK, bulk: cmd.name}, commandDocsReply(cmd))
+	}
+	return &reply
+}
+
+func commandList(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[2:]
+	filter := func(cmd *Command) bool { return true }
+
+	if len(args) > 0 {
+		if len(args) != 3 || strings.ToLower(args[0].bulk) != "filterby" {
+			return errReply(ErrSyntax)
+		}
+
+		val := args[2].bulk
+		switch strings.ToLower(args[1].bulk) {
+		case "module":
+			// there are no modules, nothing can match
+			filter = func(cmd *Command) bool { return false }
+		case "aclcat":
+			filter = func(cmd *Command) bool {
+				return contains(cmd.categories, strings.ToLower(val))
+			}
+		case "pattern":
+			filter = func(cmd *Command) bool {
+				return stringMatch(val, cmd.name, true)
+			}
+		default:
+			return errReply(ErrSyntax)
+		}
+	}
+
+	reply := Value{typ: ARRAY, array: []Value{}}
+	for _, cmd := range sortedCommands() {
+		if filter(cmd) {
+			reply.array = append(reply.array, Value{typ: BULK, bulk: cmd.name})
+		}
+		for _, sub := range cmd.subcommands {
+			if filter(sub) {
+				reply.array = append(reply.array, Value{typ: BULK, bulk: sub.name})
+			}
+		}
+	}
+	return &reply
+}
+
+// handles both GETKEYS and GETKEYSANDFLAGS, the latter pairs every key with its spec flags
+func commandGetKeys(c *Client, v *Value, state *AppState) *Value {
+	withFlags := strings.EqualFold(v.array[1].bulk, "getkeysandflags")
+	argv := v.array[2:]
+
+	cmd, err := resolveCommand(argv)
+	if cmd == nil {
+		return errReply(ErrGetKeysInvalidCmd)
+	}
+	if err != nil {
+		return errReply(ErrGetKeysInvalidArgs)
+	}
+
+	pos := cmd.keyPositions(len(argv))
+	if len(pos) == 0 {
+		return errReply(ErrGetKeysNoKeys)
+	}
+
+	reply := Value{typ: ARRAY}
+	for _, p := range pos {
+		key := Value{typ: BULK, bulk: argv[p].bulk}
+		if withFlags {
+			key = Value{typ: ARRAY, array: []Value{key, statusArray(cmd.keyFlags)}}
+		}
+		reply.array = append(reply.array, key)
+	}
+	return &reply
+}
+
+func commandHelp(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: ARRAY, array: statusArray([]string{
+		"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"(no subcommand)",
+		"    Return details about all Redis commands.",
+		"COUNT",
+		"    Return the total number of commands in this Redis server.",
+		"LIST",
+		"    Return a list of all commands in this Redis server.",
+		"INFO [<command-name> ...]",
+		"    Return details about multiple Redis commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"DOCS [<command-name> ...]",
+		"    Return documentation details about multiple Redis commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"GETKEYS <full-command>",
+		"    Return the keys from a full Redis command.",
+		"GETKEYSANDFLAGS <full-command>",
+		"    Return the keys and the access flags from a full Redis command.",
+		"HELP",
+		"    Print this help.",
+	}).array}
+}
+
+// reply layout matches redis 7: name, arity, flags, first key, last key, step,
+// acl categories, tips, key specs, subcommands
+func commandInfoReply(cmd *Command) Value {
+	cats := make([]string, len(cmd.categories))
+	for i, cat := range cmd.categories {
+		cats[i] = "@" + cat
+	}
+
+	subs := Value{typ: ARRAY, array: []Value{}}
+	for _, sub := range cmd.subcommands {
+		subs.array = append(subs.array, commandInfoReply(sub))
+	}
+
+	return Value{typ: ARRAY, array: []Value{
+		{typ: BULK, bulk: cmd.name},
+		{typ: INTEGER, num: cmd.arity},
+		statusArray(cmd.flags.Names()),
+		{typ: INTEGER, num: cmd.firstKey},
+		{typ: INTEGER, num: cmd.lastKey},
+		{typ: INTEGER, num: cmd.step},
+		statusArray(cats),
+		{typ: ARRAY, array: []Value{}},
+		keySpecsReply(cmd),
+		subs,
+	}}
+}
+
+// every command here has its keys in a single range, so one spec describes it
+func keySpecsReply(cmd *Command) Value {
+	if cmd.firstKey <= 0 {
+		return Value{typ: ARRAY, array: []Value{}}
+	}
+
+	// find_keys lastkey is relative to the begin index unless it counts from the end
+	lastKey := cmd.lastKey
+	if lastKey >= 0 {
+		lastKey -= cmd.firstKey
+	}
+
+	spec := Value{typ: ARRAY, array: []Value{
+		{typ: BULK, bulk: "flags"},
+		statusArray(cmd.keyFlags),
+		{typ: BULK, bulk: "begin_search"},
+		{typ: ARRAY, array: []Value{
+			{typ: BULK, bulk: "type"},
+			{typ: BULK, bulk: "index"},
+			{typ: BULK, bulk: "spec"},
+			{typ: ARRAY, array: []Value{
+				{typ: BULK, bulk: "index"},
+				{typ: INTEGER, num: cmd.firstKey},
+			}},
+		}},
+		{typ: BULK, bulk: "find_keys"},
+		{typ: ARRAY, array: []Value{
+			{typ: BULK, bulk: "type"},
+			{typ: BULK, bulk: "range"},
+			{typ: BULK, bulk: "spec"},
+			{typ: ARRAY, array: []Value{
+				{typ: BULK, bulk: "lastkey"},
+				{typ: INTEGER, num: lastKey},
+				{typ: BULK, bulk: "keystep"},
+				{typ: INTEGER, num: cmd.step},
+				{typ: BULK, bulk: "limit"},
+				{typ: INTEGER, num: 0},
+			}},
+		}},
+	}}
+
+	return Value{typ: ARRAY, array: []Value{spec}}
+}
+
+// RESP2 has no maps, so docs are flattened into key/value arrays like redis does
+func commandDocsReply(cmd *Command) Value {
+	docs := Value{typ: ARRAY, array: []Value{
+		{typ: BULK, bulk: "summary"},
+		{typ: BULK, bulk: cmd.summary},
+	}}
+
+	// commands redis doesn't have were never in one of its releases
+	if cmd.since != "" {
+		docs.array = append(docs.array, Value{typ: BULK, bulk: "since"}, Value{typ: BULK, bulk: cmd.since})
+	}
+	docs.array = append(docs.array, Value{typ: BULK, bulk: "group"}, Value{typ: BULK, bulk: cmd.group})
+
+	if cmd.complexity != "" {
+		docs.array = append(docs.array, Value{typ: BULK, bulk: "complexity"}, Value{typ: BULK, bulk: cmd.complexity})
+	}
+
+	if len(cmd.subcommands) > 0 {
+		subs := Value{typ: ARRAY}
+		for _, sub := range cmd.subcommands {
+			subs.array = append(subs.array, Value{typ: BULK, bulk: sub.name}, commandDocsReply(sub))
+		}
+		docs.array = append(docs.array, Value{typ: BULK, bulk: "subcommands"}, subs)
+	}
+
+	return docs
+}
+
+// accepts both "get" and "command|info" style names
+func lookupCommandOrSub(name string) (*Command, bool) {
+	parent, sub, isSub := strings.Cut(name, "|")
+	cmd, ok := lookupCommand(parent)
+	if !ok || !isSub {
+		return cmd, ok
+	}
+	return cmd.subcommand(sub)
+}
+
+func sortedCommands() []*Command {
+	cmds := make([]*Command, 0, len(Commands))
+	for _, cmd := range Commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i int, j int) bool {
+		return cmds[i].name < cmds[j].name
+	})
+	return cmds
+}
+
+func statusArray(ss []string) Value {
+	arr := Value{typ: ARRAY, array: []Value{}}
+	for _, s := range ss {
+		arr.array = append(arr.array, Value{typ: STRING, str: s})
+	}
+	return arr
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// runs a COMMAND subcommand through the table the way the dispatcher does
+func runCommand(t *testing.T, args ...string) *Value {
+	t.Helper()
+
+	v := &Value{typ: ARRAY, array: argv(args...)}
+	cmd, err := resolveCommand(v.array)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd.handler(&Client{multi: -1}, v, nil)
+}
+
+func bulks(v Value) []string {
+	var ss []string
+	for _, e := range v.array {
+		switch e.typ {
+		case BULK:
+			ss = append(ss, e.bulk)
+		case STRING:
+			ss = append(ss, e.str)
+		}
+	}
+	return ss
+}
+
+func TestCommandInfoShape(t *testing.T) {
+	reply := runCommand(t, "COMMAND", "INFO", "del", "nope")
+	if len(reply.array) != 2 || reply.array[1].typ != NULL {
+		t.Fatalf("got %d entries, want del and a null for the unknown command", len(reply.array))
+	}
+
+	info := reply.array[0].array
+	if len(info) != 10 {
+		t.Fatalf("the info entry has %d fields, want 10", len(info))
+	}
+	if info[0].bulk != "del" || info[1].num != -2 {
+		t.Errorf("name and arity are %q %d", info[0].bulk, info[1].num)
+	}
+	if got := bulks(info[2]); !slices.Equal(got, []string{"write"}) {
+		t.Errorf("flags are %v", got)
+	}
+	if info[3].num != 1 || info[4].num != -1 || info[5].num != 1 {
+		t.Errorf("first/last/step are %d %d %d, want 1 -1 1", info[3].num, info[4].num, info[5].num)
+	}
+	if got := bulks(info[6]); !slices.Equal(got, []string{"@keyspace", "@write", "@slow"}) {
+		t.Errorf("categories are %v", got)
+	}
+
+	specs := info[8].array
+	if len(specs) != 1 {
+		t.Fatalf("got %d key specs, want 1", len(specs))
+	}
+	spec := specs[0].array
+	if spec[0].bulk != "flags" || !slices.Equal(bulks(spec[1]), []string{"RM", "delete"}) {
+		t.Errorf("key spec flags are %v", bulks(spec[1]))
+	}
+	if begin := spec[3].array[3].array; begin[1].num != 1 {
+		t.Errorf("begin_search index is %d, want 1", begin[1].num)
+	}
+	if find := spec[5].array[3].array; find[1].num != -1 || find[3].num != 1 || find[5].num != 0 {
+		t.Errorf("find_keys range is lastkey %d keystep %d limit %d", find[1].num, find[3].num, find[5].num)
+	}
+}
+
+func TestCommandDocsShape(t *testing.T) {
+	reply := runCommand(t, "COMMAND", "DOCS", "del")
+	if len(reply.array) != 2 || reply.array[0].bulk != "del" {
+		t.Fatalf("got %v, want a del name/docs pair", bulks(*reply))
+	}
+
+	want := []string{
+		"summary", "Deletes one or more keys.",
+		"since", "1.0.0",
+		"group", "generic",
+		"complexity", "O(N) where N is the number of keys that will be removed.",
+	}
+	if got := bulks(reply.array[1]); !slices.Equal(got, want) {
+		t.Fatalf("docs are %q, want %q", got, want)
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	all := bulks(*runCommand(t, "COMMAND", "LIST"))
+	for _, name := range []string{"del", "exists", "command", "command|info"} {
+		if !slices.Contains(all, name) {
+			t.Errorf("COMMAND LIST is missing %s", name)
+		}
+	}
+
+	got := bulks(*runCommand(t, "COMMAND", "LIST", "FILTERBY", "PATTERN", "ex*"))
+	for _, name := range got {
+		if !stringMatch("ex*", name, true) {
+			t.Errorf("pattern ex* listed %s", name)
+		}
+	}
+	if !slices.Contains(got, "exists") {
+		t.Errorf("pattern ex* did not list exists: %v", got)
+	}
+
+	if reply := runCommand(t, "COMMAND", "LIST", "FILTERBY", "BOGUS", "x"); reply.typ != ERROR {
+		t.Errorf("an unknown filter replied %v", reply.typ)
+	}
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	got := bulks(*runCommand(t, "COMMAND", "GETKEYS", "DEL", "a", "b", "c"))
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("GETKEYS DEL returned %v", got)
+	}
+
+	reply := runCommand(t, "COMMAND", "GETKEYSANDFLAGS", "DEL", "a", "b")
+	if len(reply.array) != 2 {
+		t.Fatalf("GETKEYSANDFLAGS returned %d keys, want 2", len(reply.array))
+	}
+	for i, key := range []string{"a", "b"} {
+		pair := reply.array[i].array
+		if len(pair) != 2 || pair[0].bulk != key || !slices.Equal(bulks(pair[1]), []string{"RM", "delete"}) {
+			t.Errorf("entry %d is %v", i, pair)
+		}
+	}
+
+	errs := []struct {
+		args []string
+		want error
+	}{
+		{[]string{"NOPE", "a"}, ErrGetKeysInvalidCmd},
+		{[]string{"GET"}, ErrGetKeysInvalidArgs},
+		{[]string{"KEYS", "*"}, ErrGetKeysNoKeys},
+	}
+	for _, tc := range errs {
+		reply := runCommand(t, append([]string{"COMMAND", "GETKEYS"}, tc.args...)...)
+		if reply.typ != ERROR || reply.err != tc.want.Error() {
+			t.Errorf("GETKEYS %v replied %q, want %q", tc.args, reply.err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,594 @@
+package main
+
+import "strings"
+
+type CmdFlag int
+
+const (
+	CmdWrite    CmdFlag = 1 << iota // may modify the keyspace
+	CmdReadonly                     // only reads data
+	CmdDenyOOM                      // rejected when over maxmemory
+	CmdAdmin                        // server administration
+	CmdPubSub                       // pub/sub related
+	CmdNoScript                     // not allowed from scripts
+	CmdLoading                      // allowed while the dataset is loading
+	CmdStale                        // allowed while a replica has stale data
+	CmdFast                         // O(1) or O(log N), never blocks
+	CmdNoMulti                      // refused inside MULTI
+)
+
+var cmdFlagNames = []struct {
+	flag CmdFlag
+	name string
+}{
+	{CmdWrite, "write"},
+	{CmdReadonly, "readonly"},
+	{CmdDenyOOM, "denyoom"},
+	{CmdAdmin, "admin"},
+	{CmdPubSub, "pubsub"},
+	{CmdNoScript, "noscript"},
+	{CmdLoading, "loading"},
+	{CmdStale, "stale"},
+	{CmdFast, "fast"},
+	{CmdNoMulti, "no_multi"},
+}
+
+func (f CmdFlag) Names() []string {
+	names := []string{}
+	for _, fn := range cmdFlagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+type Command struct {
+	name       string // full name, subcommands are written as "parent|sub"
+	handler    Handler
+	arity      int // positive is exact, negative is a minimum, both count the command name
+	flags      CmdFlag
+	firstKey   int      // position of the first key in argv, 0 when the command takes no keys
+	lastKey    int      // position of the last key, negative counts from the end
+	step       int      // distance between keys
+	keyFlags   []string // key spec flags reported by COMMAND, e.g. RO access
+	categories []string
+
+	// documentation reported by COMMAND DOCS
+	summary    string
+	since      string
+	group      string
+	complexity string
+
+	subcommands []*Command
+	parent      *Command
+}
+
+func (cmd *Command) has(f CmdFlag) bool {
+	return cmd.flags&f != 0
+}
+
+// checks argc (command name included) against the command's arity
+func (cmd *Command) arityOk(argc int) bool {
+	if cmd.arity > 0 {
+		return argc == cmd.arity
+	}
+	return argc >= -cmd.arity
+}
+
+func (cmd *Command) subcommand(name string) (*Command, bool) {
+	full := cmd.name + "|" + strings.ToLower(name)
+	for _, sub := range cmd.subcommands {
+		if sub.name == full {
+			return sub, true
+		}
+	}
+	return nil, false
+}
+
+// top level command, used for checks that don't care about subcommands
+func (cmd *Command) root() *Command {
+	if cmd.parent != nil {
+		return cmd.parent
+	}
+	return cmd
+}
+
+// returns the argv positions holding keys, following firstKey/lastKey/step
+func (cmd *Command) keyPositions(argc int) []int {
+	if cmd.firstKey <= 0 {
+		return nil
+	}
+
+	last := cmd.lastKey
+	if last < 0 {
+		last = argc + last
+	}
+
+	step := max(cmd.step, 1)
+
+	var pos []int
+	for i := cmd.firstKey; i <= last && i < argc; i += step {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+// filled in init since some handlers look commands up, which would otherwise be an initialization cycle
+var Commands = map[string]*Command{}
+
+func init() {
+	table := []*Command{
+		{
+			name: "command", handler: command, arity: -1,
+			flags:      CmdLoading | CmdStale,
+			categories: []string{"slow", "connection"},
+			summary:    "Returns detailed information about all commands.",
+			since:      "2.8.13", group: "server",
+			complexity: "O(N) where N is the total number of Redis commands",
+			subcommands: []*Command{
+				{
+					name: "count", handler: commandCount, arity: 2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns a count of commands.",
+					since:      "2.8.13", group: "server", complexity: "O(1)",
+				},
+				{
+					name: "docs", handler: commandDocs, arity: -2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns documentary information about one, multiple or all commands.",
+					since:      "7.0.0", group: "server",
+					complexity: "O(N) where N is the number of commands to look up",
+				},
+				{
+					name: "getkeys", handler: commandGetKeys, arity: -3,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Extracts the key names from an arbitrary command.",
+					since:      "2.8.13", group: "server",
+					complexity: "O(N) where N is the number of arguments to the command",
+				},
+				{
+					name: "getkeysandflags", handler: commandGetKeys, arity: -3,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Extracts the key names and access flags for an arbitrary command.",
+					since:      "7.0.0", group: "server",
+					complexity: "O(N) where N is the number of arguments to the command",
+				},
+				{
+					name: "help", handler: commandHelp, arity: 2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns helpful text about the different subcommands.",
+					since:      "5.0.0", group: "server", complexity: "O(1)",
+				},
+				{
+					name: "info", handler: commandInfo, arity: -2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns information about one, multiple or all commands.",
+					since:      "2.8.13", group: "server",
+					complexity: "O(N) where N is the number of commands to look up",
+				},
+				{
+					name: "list", handler: commandList, arity: -2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns a list of command names.",
+					since:      "7.0.0", group: "server",
+					complexity: "O(N) where N is the total number of Redis commands",
+				},
+			},
+		},
+		{
+			// container only, always dispatched to one of its subcommands
+			name: "client", arity: -2,
+			flags:      CmdLoading | CmdStale,
+			categories: []string{"slow"},
+			summary:    "A container for client connection commands.",
+			since:      "2.4.0", group: "connection",
+			complexity: "Depends on subcommand.",
+			subcommands: []*Command{
+				{
+					name: "getname", handler: clientGetName, arity: 2,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns the name of the connection.",
+					since:      "2.6.9", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "help", handler: clientHelp, arity: 2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns helpful text about the different subcommands.",
+					since:      "5.0.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "id", handler: clientId, arity: 2,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns the unique client ID of the connection.",
+					since:      "5.0.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "info", handler: clientInfo, arity: 2,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Returns information about the connection.",
+					since:      "6.2.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "kill", handler: clientKill, arity: -3,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous", "connection"},
+					summary:    "Terminates open connections.",
+					since:      "2.4.0", group: "connection",
+					complexity: "O(N) where N is the number of client connections",
+				},
+				{
+					name: "list", handler: clientList, arity: -2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous", "connection"},
+					summary:    "Lists open connections.",
+					since:      "2.4.0", group: "connection",
+					complexity: "O(N) where N is the number of client connections",
+				},
+				{
+					name: "no-evict", handler: clientNoEvict, arity: 3,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous", "connection"},
+					summary:    "Sets the client eviction mode of the connection.",
+					since:      "7.0.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "no-touch", handler: clientNoTouch, arity: 3,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Controls whether commands sent by the client affect the LRU/LFU of accessed keys.",
+					since:      "7.2.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "pause", handler: clientPause, arity: -3,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous", "connection"},
+					summary:    "Suspends commands processing.",
+					since:      "3.0.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "reply", handler: clientReply, arity: 3,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Instructs the server whether to reply to commands.",
+					since:      "3.2.0", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "setname", handler: clientSetName, arity: 3,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow", "connection"},
+					summary:    "Sets the connection name.",
+					since:      "2.6.9", group: "connection", complexity: "O(1)",
+				},
+				{
+					name: "unpause", handler: clientUnpause, arity: 2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous", "connection"},
+					summary:    "Resumes processing commands from paused clients.",
+					since:      "6.2.0", group: "connection",
+					complexity: "O(N) Where N is the number of paused clients",
+				},
+			},
+		},
+		{
+			// container only, always dispatched to one of its subcommands
+			name: "acl", arity: -2,
+			flags:      CmdLoading | CmdStale,
+			categories: []string{"slow"},
+			summary:    "A container for Access List Control commands.",
+			since:      "6.0.0", group: "server",
+			complexity: "Depends on subcommand.",
+			subcommands: []*Command{
+				{
+					name: "authlog", handler: aclAuthLog, arity: -2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Lists recent failed authentication attempts.",
+					group:      "server", complexity: "O(N) with N being the number of entries shown.",
+					// not a redis command, so no since: COMMAND DOCS leaves it out
+				},
+				{
+					name: "cat", handler: aclCat, arity: -2,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow"},
+					summary:    "Lists the ACL categories, or the commands inside a category.",
+					since:      "6.0.0", group: "server", complexity: "O(1) since the categories and commands are a fixed set.",
+				},
+				{
+					name: "deluser", handler: aclDelUser, arity: -3,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Deletes ACL users, and terminates their connections.",
+					since:      "6.0.0", group: "server", complexity: "O(1) amortized time considering the typical user.",
+				},
+				{
+					name: "dryrun", handler: aclDryRun, arity: -4,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Simulates the execution of a command by a user, without executing the command.",
+					since:      "7.0.0", group: "server", complexity: "O(1).",
+				},
+				{
+					name: "genpass", handler: aclGenPass, arity: -2,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow"},
+					summary:    "Generates a pseudorandom, secure password that can be used to identify ACL users.",
+					since:      "6.0.0", group: "server", complexity: "O(1)",
+				},
+				{
+					name: "getuser", handler: aclGetUser, arity: 3,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Lists the ACL rules of a user.",
+					since:      "6.0.0", group: "server", complexity: "O(N). Where N is the number of password, command and pattern rules that the user has.",
+				},
+				{
+					name: "help", handler: aclHelp, arity: 2,
+					flags:      CmdLoading | CmdStale,
+					categories: []string{"slow"},
+					summary:    "Returns helpful text about the different subcommands.",
+					since:      "6.0.0", group: "server", complexity: "O(1)",
+				},
+				{
+					name: "list", handler: aclList, arity: 2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Dumps the effective rules in ACL file format.",
+					since:      "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+				},
+				{
+					name: "load", handler: aclLoad, arity: 2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Reloads the rules from the configured ACL file.",
+					since:      "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+				},
+				{
+					name: "log", handler: aclLog, arity: -2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Lists recent security events generated due to ACL rules.",
+					since:      "6.0.0", group: "server", complexity: "O(N) with N being the number of entries shown.",
+				},
+				{
+					name: "save", handler: aclSave, arity: 2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Saves the effective ACL rules in the configured ACL file.",
+					since:      "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+				},
+				{
+					name: "setuser", handler: aclSetUser, arity: -3,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Creates and modifies an ACL user and its rules.",
+					since:      "6.0.0", group: "server", complexity: "O(N). Where N is the number of rules provided.",
+				},
+				{
+					name: "users", handler: aclUsers, arity: 2,
+					flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"admin", "slow", "dangerous"},
+					summary:    "Lists all ACL users.",
+					since:      "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+				},
+				{
+					name: "whoami", handler: aclWhoAmI, arity: 2,
+					flags:      CmdNoScript | CmdLoading | CmdStale,
+					categories: []string{"slow"},
+					summary:    "Returns the authenticated username of the current connection.",
+					since:      "6.0.0", group: "server", complexity: "O(1)",
+				},
+			},
+		},
+		{
+			name: "get", handler: get, arity: 2,
+			flags:    CmdReadonly | CmdFast,
+			firstKey: 1, lastKey: 1, step: 1, keyFlags: []string{"RO", "access"},
+			categories: []string{"read", "string", "fast"},
+			summary:    "Returns the string value of a key.",
+			since:      "1.0.0", group: "string", complexity: "O(1)",
+		},
+		{
+			name: "set", handler: set, arity: 3,
+			flags:    CmdWrite | CmdDenyOOM,
+			firstKey: 1, lastKey: 1, step: 1, keyFlags: []string{"OW", "update"},
+			categories: []string{"write", "string", "slow"},
+			summary:    "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.",
+			since:      "1.0.0", group: "string", complexity: "O(1)",
+		},
+		{
+			name: "del", handler: del, arity: -2,
+			flags:    CmdWrite,
+			firstKey: 1, lastKey: -1, step: 1, keyFlags: []string{"RM", "delete"},
+			categories: []string{"keyspace", "write", "slow"},
+			summary:    "Deletes one or more keys.",
+			since:      "1.0.0", group: "generic",
+			complexity: "O(N) where N is the number of keys that will be removed.",
+		},
+		{
+			name: "exists", handler: exists, arity: -2,
+			flags:    CmdReadonly | CmdFast,
+			firstKey: 1, lastKey: -1, step: 1, keyFlags: []string{"RO"},
+			categories: []string{"keyspace", "read", "fast"},
+			summary:    "Determines whether one or more keys exist.",
+			since:      "1.0.0", group: "generic",
+			complexity: "O(N) where N is the number of keys to check.",
+		},
+		{
+			name: "keys", handler: keys, arity: 2,
+			flags:      CmdReadonly,
+			categories: []string{"keyspace", "read", "slow", "dangerous"},
+			summary:    "Returns all key names that match a pattern.",
+			since:      "1.0.0", group: "generic",
+			complexity: "O(N) with N being the number of keys in the database",
+		},
+		{
+			name: "save", handler: save, arity: 1,
+			flags:      CmdAdmin | CmdNoScript,
+			categories: []string{"admin", "slow", "dangerous"},
+			summary:    "Synchronously saves the database(s) to disk.",
+			since:      "1.0.0", group: "server",
+			complexity: "O(N) where N is the total number of keys in all databases",
+		},
+		{
+			name: "shutdown", handler: shutdown, arity: -1,
+			flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale | CmdNoMulti,
+			categories: []string{"admin", "slow", "dangerous"},
+			summary:    "Synchronously saves the database(s) to disk and shuts down the Redis server.",
+			since:      "1.0.0", group: "server",
+			complexity: "O(N) when saving, where N is the total number of keys in all databases when saving data, otherwise O(1)",
+		},
+		{
+			name: "bgsave", handler: bgsave, arity: -1,
+			flags:      CmdAdmin | CmdNoScript,
+			categories: []string{"admin", "slow", "dangerous"},
+			summary:    "Asynchronously saves the database(s) to disk.",
+			since:      "1.0.0", group: "server", complexity: "O(1)",
+		},
+		{
+			name: "lastsave", handler: lastsave, arity: 1,
+			flags:      CmdNoScript | CmdLoading | CmdStale | CmdFast,
+			categories: []string{"admin", "fast", "dangerous"},
+			summary:    "Returns the Unix timestamp of the last successful save to disk.",
+			since:      "1.0.0", group: "server", complexity: "O(1)",
+		},
+		{
+			name: "dbsize", handler: dbsize, arity: 1,
+			flags:      CmdReadonly | CmdFast,
+			categories: []string{"keyspace", "read", "fast"},
+			summary:    "Returns the number of keys in the database.",
+			since:      "1.0.0", group: "server", complexity: "O(1)",
+		},
+		{
+			name: "flushdb", handler: flushdb, arity: -1,
+			flags:      CmdWrite,
+			categories: []string{"keyspace", "write", "slow", "dangerous"},
+			summary:    "Remove all keys from the current database.",
+			since:      "1.0.0", group: "server",
+			complexity: "O(N) where N is the number of keys in the selected database",
+		},
+		{
+			name: "auth", handler: auth, arity: -2,
+			flags:      CmdNoScript | CmdLoading | CmdStale | CmdFast,
+			categories: []string{"fast", "connection"},
+			summary:    "Authenticates the connection.",
+			since:      "1.0.0", group: "connection",
+			complexity: "O(N) where N is the number of passwords defined for the user",
+		},
+		{
+			name: "expire", handler: expire, arity: 3,
+			flags:    CmdWrite | CmdFast,
+			firstKey: 1, lastKey: 1, step: 1, keyFlags: []string{"RW", "update"},
+			categories: []string{"keyspace", "write", "fast"},
+			summary:    "Sets the expiration time of a key in seconds.",
+			since:      "1.0.0", group: "generic", complexity: "O(1)",
+		},
+		{
+			name: "pexpireat", handler: pexpireat, arity: 3,
+			flags:    CmdWrite | CmdFast,
+			firstKey: 1, lastKey: 1, step: 1, keyFlags: []string{"RW", "update"},
+			categories: []string{"keyspace", "write", "fast"},
+			summary:    "Sets the expiration time of a key to a Unix milliseconds timestamp.",
+			since:      "2.6.0", group: "generic", complexity: "O(1)",
+		},
+		{
+			name: "ttl", handler: ttl, arity: 2,
+			flags:    CmdReadonly | CmdFast,
+			firstKey: 1, lastKey: 1, step: 1, keyFlags: []string{"RO", "access"},
+			categories: []string{"keyspace", "read", "fast"},
+			summary:    "Returns the expiration time in seconds of a key.",
+			since:      "1.0.0", group: "generic", complexity: "O(1)",
+		},
+		{
+			name: "bgrewriteaof", handler: bgrewriteaof, arity: 1,
+			flags:      CmdAdmin | CmdNoScript,
+			categories: []string{"admin", "slow", "dangerous"},
+			summary:    "Asynchronously rewrites the append-only file to disk.",
+			since:      "1.0.0", group: "server", complexity: "O(1)",
+		},
+		{
+			name: "multi", handler: multi, arity: 1,
+			flags:      CmdNoScript | CmdLoading | CmdStale | CmdFast,
+			categories: []string{"fast", "transaction"},
+			summary:    "Starts a transaction.",
+			since:      "1.2.0", group: "transactions", complexity: "O(1)",
+		},
+		{
+			name: "exec", handler: _exec, arity: 1,
+			flags:      CmdNoScript | CmdLoading | CmdStale,
+			categories: []string{"slow", "transaction"},
+			summary:    "Executes all commands in a transaction.",
+			since:      "1.2.0", group: "transactions",
+			complexity: "Depends on commands in the transaction",
+		},
+		{
+			name: "discard", handler: discard, arity: 1,
+			flags:      CmdNoScript | CmdLoading | CmdStale | CmdFast,
+			categories: []string{"fast", "transaction"},
+			summary:    "Discards a transaction.",
+			since:      "2.0.0", group: "transactions",
+			complexity: "O(N), when N is the number of queued commands",
+		},
+		{
+			name: "monitor", handler: monitor, arity: 1,
+			flags:      CmdAdmin | CmdNoScript | CmdLoading | CmdStale,
+			categories: []string{"admin", "slow", "dangerous"},
+			summary:    "Listens for all requests received by the server in real-time.",
+			since:      "1.0.0", group: "server",
+		},
+		{
+			name: "info", handler: info, arity: -1,
+			flags:      CmdLoading | CmdStale,
+			categories: []string{"slow", "dangerous"},
+			summary:    "Returns information and statistics about the server.",
+			since:      "1.0.0", group: "server", complexity: "O(1)",
+		},
+	}
+
+	for _, cmd := range table {
+		for _, sub := range cmd.subcommands {
+			sub.name = cmd.name + "|" + sub.name
+			sub.parent = cmd
+		}
+		Commands[cmd.name] = cmd
+	}
+}
+
+// command names are case-insensitive on the wire
+func lookupCommand(name string) (*Command, bool) {
+	cmd, ok := Commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// resolves argv to a command, descending into subcommands, and validates its arity
+func resolveCommand(argv []Value) (*Command, error) {
+	cmd, ok := lookupCommand(argv[0].bulk)
+	if !ok {
+		return nil, ErrUnknownCmd(argv[0].bulk, argv[1:])
+	}
+
+	if len(cmd.subcommands) > 0 && len(argv) > 1 {
+		sub, ok := cmd.subcommand(argv[1].bulk)
+		if !ok {
+			return nil, ErrUnknownSubcmd(cmd.name, argv[1].bulk)
+		}
+		cmd = sub
+	}
+
+	if !cmd.arityOk(len(argv)) {
+		return cmd, ErrWrongArgs(cmd.name)
+	}
+
+	return cmd, nil
+}
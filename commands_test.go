@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolveCommandArity(t *testing.T) {
+	cases := []struct {
+		args []string
+		name string
+		ok   bool
+	}{
+		{[]string{"GET", "k"}, "get", true},
+		{[]string{"get"}, "get", false},
+		{[]string{"GET", "k", "x"}, "get", false},
+		{[]string{"DEL", "a"}, "del", true},
+		{[]string{"DEL", "a", "b", "c"}, "del", true},
+		{[]string{"DEL"}, "del", false},
+		{[]string{"COMMAND"}, "command", true},
+		{[]string{"command", "INFO", "get", "set"}, "command|info", true},
+		{[]string{"CLIENT", "SETNAME"}, "client|setname", false},
+	}
+
+	for _, tc := range cases {
+		cmd, err := resolveCommand(argv(tc.args...))
+		if cmd == nil || cmd.name != tc.name {
+			t.Errorf("%q resolved to %v, want %s", tc.args, cmd, tc.name)
+			continue
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%q returned %v", tc.args, err)
+		}
+		if err != nil && err.Error() != ErrWrongArgs(tc.name).Error() {
+			t.Errorf("%q returned %q, want the wrong number of arguments error", tc.args, err)
+		}
+	}
+}
+
+func TestResolveUnknownCommand(t *testing.T) {
+	if _, err := resolveCommand(argv("NOPE", "a")); err == nil || err.Error() != ErrUnknownCmd("NOPE", argv("a")).Error() {
+		t.Errorf("unknown command returned %v", err)
+	}
+	if _, err := resolveCommand(argv("CLIENT", "NOPE")); err == nil || err.Error() != ErrUnknownSubcmd("client", "NOPE").Error() {
+		t.Errorf("unknown subcommand returned %v", err)
+	}
+}
+
+func TestKeyPositions(t *testing.T) {
+	pairs := &Command{firstKey: 1, lastKey: -1, step: 2} // MSET style key/value pairs
+
+	cases := []struct {
+		cmd  *Command
+		argc int
+		want []int
+	}{
+		{Commands["get"], 2, []int{1}},
+		{Commands["set"], 5, []int{1}},
+		{Commands["del"], 4, []int{1, 2, 3}},
+		{Commands["exists"], 2, []int{1}},
+		{Commands["keys"], 2, nil},
+		{pairs, 5, []int{1, 3}},
+	}
+
+	for _, tc := range cases {
+		if got := tc.cmd.keyPositions(tc.argc); !slices.Equal(got, tc.want) {
+			t.Errorf("%s with %d args has keys at %v, want %v", tc.cmd.name, tc.argc, got, tc.want)
+		}
+	}
+}
+
+// every table entry has to be internally consistent for COMMAND and ACL key checks to work
+func TestCommandTableConsistency(t *testing.T) {
+	check := func(cmd *Command) {
+		if cmd.arity == 0 {
+			t.Errorf("%s has no arity", cmd.name)
+		}
+		if cmd.handler == nil && len(cmd.subcommands) == 0 {
+			t.Errorf("%s has no handler", cmd.name)
+		}
+		if cmd.firstKey > 0 && (cmd.step <= 0 || len(cmd.keyFlags) == 0) {
+			t.Errorf("%s takes keys but has step %d and key flags %v", cmd.name, cmd.step, cmd.keyFlags)
+		}
+		if cmd.has(CmdWrite) && cmd.has(CmdReadonly) {
+			t.Errorf("%s is both write and readonly", cmd.name)
+		}
+	}
+
+	for name, cmd := range Commands {
+		if cmd.name != name {
+			t.Errorf("%s is registered as %s", cmd.name, name)
+		}
+		check(cmd)
+		for _, sub := range cmd.subcommands {
+			if sub.parent != cmd || sub.root() != cmd {
+				t.Errorf("%s is not linked to its parent", sub.name)
+			}
+			check(sub)
+		}
+	}
+}
+
+func TestCmdFlagNames(t *testing.T) {
+	got := (CmdWrite | CmdDenyOOM | CmdNoMulti).Names()
+	if want := []string{"write", "denyoom", "no_multi"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := CmdFlag(0).Names(); got == nil || len(got) != 0 {
+		t.Fatalf("no flags gave %#v, want an empty list", got)
+	}
+}
@@ -7,25 +7,90 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	dir           string
-	rdb           []RDBSnapshot
-	rdbFn         string
-	aofEnabled    bool
-	aofFn         string
-	aofFsync      FSyncMode
-	requirepass   bool
-	password      string
-	maxmem        int64
-	eviction      Eviction
-	maxmemSamples int
-	config_fp     string
+	dir            string
+	rdb            []RDBSnapshot
+	rdbFn          string
+	aofEnabled     bool
+	aofFn          string
+	aofDirname     string
+	aofPreamble    bool // rewrites write the base as an RDB snapshot
+	aofTruncated   bool // load an AOF whose last command was cut short, dropping that command
+	aofFsync       FSyncMode
+	requirepass    bool
+	password       string
+	aclfile        string
+	acllogMaxLen   int
+	authlogMaxLen  int
+	users          [][]string // "user" directives, applied as ACL SETUSER rules
+	maxmem         int64
+	eviction       Eviction
+	maxmemSamples  int
+	outputLimits   map[ClientClass]OutputBufferLimit
+	timeout        int // seconds a client may stay idle before it's closed, 0 disables
+	maxclients     int
+	tcpKeepalive   int      // seconds, 0 disables
+	maxBulkLen     int64    // proto-max-bulk-len, caps the length and the number of a request's arguments
+	port           int      // 0 disables the TCP listeners
+	bind           []string // addresses prefixed with "-" may fail to bind
+	unixsocket     string
+	unixsocketPerm os.FileMode
+	protectedMode  bool // refuse non-local clients when no password is set
+	tlsPort        int  // 0 disables the TLS listeners
+	tlsCertFile    string
+	tlsKeyFile     string
+	tlsCaCertFile  string
+	tlsAuthClients string // yes, no or optional
+	config_fp      string
+
+	// AUTH brute force protection, see AuthAudit
+	authFailureLimit      int
+	authFailureBackoff    time.Duration
+	authFailureMaxBackoff time.Duration
+
+	pidfile string // written at startup and removed on shutdown, none if empty
+
+	stopWritesOnBgsaveErr bool // refuse writes while RDB snapshots fail, see AppState.writesDenied
+	rdbCompression        bool // LZF compress strings in RDB files
+
+	// encryption at rest, see Keyring
+	encKeyFile     string
+	encOldKeyFiles []string
+	keys           *Keyring
 }
 
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		aofFn:          "appendonly.aof",
+		aofDirname:     "appendonlydir",
+		aofPreamble:    true,
+		aofTruncated:   true,
+		maxclients:     10000,
+		acllogMaxLen:   128,
+		authlogMaxLen:  128,
+		tcpKeepalive:   300,
+		maxBulkLen:     512 * 1024 * 1024,
+		port:           6379,
+		bind:           []string{"*", "-::*"},
+		protectedMode:  true,
+		tlsAuthClients: "yes",
+
+		authFailureLimit:      10,
+		authFailureBackoff:    time.Second,
+		authFailureMaxBackoff: time.Minute,
+		stopWritesOnBgsaveErr: true,
+		rdbCompression:        true,
+
+		// same defaults as redis
+		outputLimits: map[ClientClass]OutputBufferLimit{
+			ClassNormal:  {},
+			ClassReplica: {hard: 256 * 1024 * 1024, soft: 64 * 1024 * 1024, softSeconds: 60},
+			ClassPubSub:  {hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softSeconds: 60},
+		},
+	}
 }
 
 type RDBSnapshot struct {
@@ -84,6 +149,15 @@ func readConf(fn string) *Config {
 		os.Mkdir(conf.dir, 0755)
 	}
 
+	// without its key nothing could be loaded, or the files would silently be written in the clear
+	if conf.encKeyFile != "" || len(conf.encOldKeyFiles) > 0 {
+		keys, err := loadKeyring(conf.encKeyFile, conf.encOldKeyFiles)
+		if err != nil {
+			log.Fatal("cannot load the encryption keys: ", err)
+		}
+		conf.keys = keys
+	}
+
 	return conf
 }
 
@@ -109,10 +183,26 @@ func parseLine(l string, conf *Config) {
 			KeysChanged: keysChanged,
 		}
 		conf.rdb = append(conf.rdb, snapshot)
+	case "stop-writes-on-bgsave-error":
+		conf.stopWritesOnBgsaveErr = args[1] == "yes"
+	case "pidfile":
+		conf.pidfile = args[1]
+	case "rdbcompression":
+		conf.rdbCompression = args[1] == "yes"
+	case "encryption-key-file":
+		conf.encKeyFile = args[1]
+	case "encryption-old-key-file":
+		conf.encOldKeyFiles = append(conf.encOldKeyFiles, args[1])
 	case "dbfilename":
 		conf.rdbFn = args[1]
 	case "appendfilename":
 		conf.aofFn = args[1]
+	case "appenddirname":
+		conf.aofDirname = args[1]
+	case "aof-use-rdb-preamble":
+		conf.aofPreamble = args[1] == "yes"
+	case "aof-load-truncated":
+		conf.aofTruncated = args[1] == "yes"
 	case "appendfsync":
 		conf.aofFsync = FSyncMode(args[1])
 	case "dir":
@@ -126,6 +216,54 @@ func parseLine(l string, conf *Config) {
 	case "requirepass":
 		conf.requirepass = true
 		conf.password = args[1]
+	case "aclfile":
+		conf.aclfile = args[1]
+	case "acllog-max-len":
+		maxlen, err := strconv.Atoi(args[1])
+		if err != nil || maxlen < 0 {
+			log.Println("cannot parse acllog-max-len defaulting to 128. error: ", err)
+			conf.acllogMaxLen = 128
+			return
+		}
+		conf.acllogMaxLen = maxlen
+	case "authlog-max-len":
+		maxlen, err := strconv.Atoi(args[1])
+		if err != nil || maxlen < 0 {
+			log.Println("cannot parse authlog-max-len defaulting to 128. error: ", err)
+			conf.authlogMaxLen = 128
+			return
+		}
+		conf.authlogMaxLen = maxlen
+	case "auth-failure-limit":
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			log.Println("cannot parse auth-failure-limit defaulting to 10. error: ", err)
+			conf.authFailureLimit = 10
+			return
+		}
+		conf.authFailureLimit = limit
+	case "auth-failure-backoff":
+		ms, err := strconv.Atoi(args[1])
+		if err != nil || ms <= 0 {
+			log.Println("cannot parse auth-failure-backoff defaulting to 1000. error: ", err)
+			conf.authFailureBackoff = time.Second
+			return
+		}
+		conf.authFailureBackoff = time.Duration(ms) * time.Millisecond
+	case "auth-failure-max-backoff":
+		ms, err := strconv.Atoi(args[1])
+		if err != nil || ms <= 0 {
+			log.Println("cannot parse auth-failure-max-backoff defaulting to 60000. error: ", err)
+			conf.authFailureMaxBackoff = time.Minute
+			return
+		}
+		conf.authFailureMaxBackoff = time.Duration(ms) * time.Millisecond
+	case "user":
+		if len(args) < 2 {
+			log.Println("invalid user directive: ", l)
+			return
+		}
+		conf.users = append(conf.users, args[1:])
 	case "maxmemory":
 		maxmem, err := parseMem(args[1])
 		if err != nil {
@@ -144,9 +282,122 @@ func parseLine(l string, conf *Config) {
 			return
 		}
 		conf.maxmemSamples = memSamples
+	case "timeout":
+		timeout, err := strconv.Atoi(args[1])
+		if err != nil || timeout < 0 {
+			log.Println("cannot parse timeout defaulting to 0. error: ", err)
+			conf.timeout = 0
+			return
+		}
+		conf.timeout = timeout
+	case "maxclients":
+		maxclients, err := strconv.Atoi(args[1])
+		if err != nil || maxclients < 1 {
+			log.Println("cannot parse maxclients defaulting to 10000. error: ", err)
+			conf.maxclients = 10000
+			return
+		}
+		conf.maxclients = maxclients
+	case "proto-max-bulk-len":
+		// like redis at least 1mb, a smaller limit would refuse ordinary commands
+		maxBulk, err := parseMem(args[1])
+		if err != nil || maxBulk < 1024*1024 {
+			log.Println("cannot parse proto-max-bulk-len defaulting to 512mb. error: ", err)
+			conf.maxBulkLen = 512 * 1024 * 1024
+			return
+		}
+		conf.maxBulkLen = maxBulk
+	case "tcp-keepalive":
+		keepalive, err := strconv.Atoi(args[1])
+		if err != nil || keepalive < 0 {
+			log.Println("cannot parse tcp-keepalive defaulting to 300. error: ", err)
+			conf.tcpKeepalive = 300
+			return
+		}
+		conf.tcpKeepalive = keepalive
+	case "port":
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port < 0 || port > 65535 {
+			log.Println("cannot parse port defaulting to 6379. error: ", err)
+			conf.port = 6379
+			return
+		}
+		conf.port = port
+	case "bind":
+		conf.bind = args[1:]
+	case "unixsocket":
+		conf.unixsocket = args[1]
+	case "unixsocketperm":
+		perm, err := strconv.ParseUint(args[1], 8, 32)
+		if err != nil {
+			log.Println("cannot parse unixsocketperm. error: ", err)
+			return
+		}
+		conf.unixsocketPerm = os.FileMode(perm)
+	case "protected-mode":
+		conf.protectedMode = args[1] == "yes"
+	case "tls-port":
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port < 0 || port > 65535 {
+			log.Println("cannot parse tls-port, TLS stays disabled. error: ", err)
+			conf.tlsPort = 0
+			return
+		}
+		conf.tlsPort = port
+	case "tls-cert-file":
+		conf.tlsCertFile = args[1]
+	case "tls-key-file":
+		conf.tlsKeyFile = args[1]
+	case "tls-ca-cert-file":
+		conf.tlsCaCertFile = args[1]
+	case "tls-auth-clients":
+		conf.tlsAuthClients = args[1]
+	case "client-output-buffer-limit":
+		// several classes can share a line: <class> <hard> <soft> <soft-seconds> ...
+		lims := args[1:]
+		if len(lims)%4 != 0 {
+			log.Println("invalid client-output-buffer-limit: ", l)
+			return
+		}
+
+		for i := 0; i < len(lims); i += 4 {
+			class, limit, err := parseOutputLimit(lims[i : i+4])
+			if err != nil {
+				log.Println("cannot parse client-output-buffer-limit. error: ", err)
+				return
+			}
+			conf.outputLimits[class] = limit
+		}
 	}
 }
 
+func parseOutputLimit(args []string) (ClientClass, OutputBufferLimit, error) {
+	class := ClientClass(strings.ToLower(args[0]))
+	if class == "slave" {
+		class = ClassReplica
+	}
+	if class != ClassNormal && class != ClassReplica && class != ClassPubSub {
+		return "", OutputBufferLimit{}, fmt.Errorf("invalid client class %s", args[0])
+	}
+
+	hard, err := parseMem(args[1])
+	if err != nil {
+		return "", OutputBufferLimit{}, err
+	}
+
+	soft, err := parseMem(args[2])
+	if err != nil {
+		return "", OutputBufferLimit{}, err
+	}
+
+	softSeconds, err := strconv.Atoi(args[3])
+	if err != nil {
+		return "", OutputBufferLimit{}, err
+	}
+
+	return class, OutputBufferLimit{hard: hard, soft: soft, softSeconds: softSeconds}, nil
+}
+
 func parseMem(s string) (int64, error) {
 	s = strings.TrimSpace(strings.ToLower(s))
 
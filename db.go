@@ -3,15 +3,22 @@ package main
 import (
 	"errors"
 	"log"
+	"maps"
 	"sort"
 	"sync"
-	"time"
 )
 
+var errLoadNotEmpty = errors.New("cannot load a snapshot into a non-empty keyspace")
+
 type Database struct {
 	store map[string]*Item
 	mu    sync.RWMutex
 	mem   int64
+
+	// copy-on-write for snapshots: while snapshots > 0, items created before the last
+	// snapshot (epoch below db.epoch) may be read by it and are copied before they change
+	epoch     uint64
+	snapshots int
 }
 
 func NewDatabase() *Database {
@@ -23,7 +30,7 @@ func NewDatabase() *Database {
 
 func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 	if state.conf.eviction == NoEviction {
-		return errors.New("memory limit reached")
+		return ErrOOM
 	}
 
 	samples := sampleKeys(state)
@@ -41,6 +48,7 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 		for _, s := range samples {
 			log.Println("evicting: ", s.k)
 			db.Delete(s.k)
+			state.propagateDel(s.k)
 			n++
 			if enoughMemFreed() {
 				break
@@ -52,36 +60,37 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 	switch state.conf.eviction {
 	case AllKeysRandom:
 		evictionKeys := evictUntilMemFreed(samples)
-		state.generalStats.evicted_keys += evictionKeys
+		state.generalStats.evicted_keys.Add(int64(evictionKeys))
 	case AllKeysLRU:
 		sort.Slice(samples, func(i int, j int) bool {
-			return samples[i].v.LastAccess.After(samples[j].v.LastAccess)
+			return samples[i].v.LastAccess().After(samples[j].v.LastAccess())
 		})
 		evictionKeys := evictUntilMemFreed(samples)
-		state.generalStats.evicted_keys += evictionKeys
+		state.generalStats.evicted_keys.Add(int64(evictionKeys))
 	case AllKeysLFU:
 		sort.Slice(samples, func(i int, j int) bool {
-			return samples[i].v.Accesses < samples[j].v.Accesses
+			return samples[i].v.Accesses() < samples[j].v.Accesses()
 		})
 		evictionKeys := evictUntilMemFreed(samples)
-		state.generalStats.evicted_keys += evictionKeys
+		state.generalStats.evicted_keys.Add(int64(evictionKeys))
 	}
 	return nil
 }
 
-func (db *Database) tryExpire(k string, i *Item, state *AppState) bool {
-	if i.shouldExpire() {
-		DB.mu.Lock()
-		DB.Delete(k)
-		DB.mu.Unlock()
-		state.generalStats.expired_keys++
-		return true
-	}
+// deletes k if it's expired, checked again since the caller found it so without db.mu locked
+func (db *Database) expire(k string, state *AppState) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	return false
+	if i, ok := db.store[k]; ok && i.shouldExpire() {
+		db.Delete(k)
+		state.propagateDel(k)
+		state.generalStats.expired_keys.Add(1)
+	}
 }
 
-func (db *Database) Get(k string, state *AppState) (i *Item, ok bool) {
+// touch updates the key's LRU/LFU metadata, clients in CLIENT NO-TOUCH mode skip it
+func (db *Database) Get(k string, state *AppState, touch bool) (i *Item, ok bool) {
 	db.mu.RLock()
 	item, ok := db.store[k]
 	if !ok {
@@ -89,27 +98,84 @@ func (db *Database) Get(k string, state *AppState) (i *Item, ok bool) {
 		return item, ok
 	}
 
-	expired := db.tryExpire(k, item, state)
-	if expired {
+	if item.shouldExpire() {
 		db.mu.RUnlock()
+		db.expire(k, state)
 		return &Item{}, false
 	}
-	item.Accesses++
-	item.LastAccess = time.Now()
-	db.mu.RUnlock()
 
-	log.Printf("item %s accessed %d times at: %v", k, item.Accesses, item.LastAccess)
+	if !touch || !db.shared(item) {
+		if touch {
+			item.touch()
+		}
+		db.mu.RUnlock()
+	} else {
+		db.mu.RUnlock()
+
+		// a snapshot reads this item, touching it needs a copy
+		db.mu.Lock()
+		item, ok = db.mutable(k)
+		if ok {
+			item.touch()
+		}
+		db.mu.Unlock()
+		if !ok {
+			return &Item{}, false
+		}
+	}
+
+	log.Printf("item %s accessed %d times at: %v", k, item.Accesses(), item.LastAccess())
 
 	return item, ok
 }
 
+// freezes the dataset for a background save. neither the map nor its items change
+// afterwards, writers copy an item before modifying it while a snapshot is open.
+// release must be called once the snapshot isn't read anymore
+func (db *Database) snapshot() (store map[string]*Item, release func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	store = maps.Clone(db.store)
+	db.epoch++
+	db.snapshots++
+
+	var once sync.Once
+	return store, func() {
+		once.Do(func() {
+			db.mu.Lock()
+			db.snapshots--
+			db.mu.Unlock()
+		})
+	}
+}
+
+// must be called with db.mu held
+func (db *Database) shared(i *Item) bool {
+	return db.snapshots > 0 && i.epoch < db.epoch
+}
+
+// returns k's item to be modified, copying it first if a snapshot may read it
+// must be called with db.mu locked
+func (db *Database) mutable(k string) (*Item, bool) {
+	i, ok := db.store[k]
+	if !ok || !db.shared(i) {
+		return i, ok
+	}
+
+	cp := i.clone()
+	cp.epoch = db.epoch
+	db.store[k] = cp
+	return cp, true
+}
+
 func (db *Database) Set(k string, v string, state *AppState) error {
 	if old, ok := db.store[k]; ok {
 		oldmem := old.approxMemUsage(k)
 		db.mem -= oldmem
 	}
 
-	key := &Item{V: v}
+	key := &Item{V: v, epoch: db.epoch}
 	kmem := key.approxMemUsage(k)
 
 	outOfMem := state.conf.maxmem > 0 && db.mem+kmem > state.conf.maxmem
@@ -142,4 +208,37 @@ func (db *Database) Delete(k string) {
 	log.Println("memory: ", db.mem)
 }
 
+// fills the empty keyspace with a loaded snapshot. like redis a snapshot is never merged into
+// existing keys, they'd be newer (e.g. from the AOF) and a stale dump must not overwrite them
+func (db *Database) load(store map[string]*Item) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(db.store) > 0 {
+		return errLoadNotEmpty
+	}
+
+	for k, item := range store {
+		item.epoch = db.epoch
+		db.store[k] = item
+		db.mem += item.approxMemUsage(k)
+	}
+	return nil
+}
+
+// deletes keys whose expiry passed, e.g. while the server was down, returns how many
+func (db *Database) deleteExpired() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for k, item := range db.store {
+		if item.shouldExpire() {
+			db.Delete(k)
+			n++
+		}
+	}
+	return n
+}
+
 var DB = NewDatabase()
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a dump loaded over keys from the AOF would bring back stale values and deleted keys
+func TestLoadRefusesNonEmptyKeyspace(t *testing.T) {
+	db := NewDatabase()
+	if err := db.load(map[string]*Item{"z": {V: "old"}, "gone": {V: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.store["z"] = &Item{V: "new"}
+	delete(db.store, "gone")
+
+	if err := db.load(map[string]*Item{"z": {V: "old"}, "gone": {V: "x"}}); !errors.Is(err, errLoadNotEmpty) {
+		t.Fatalf("load into a non-empty keyspace returned %v", err)
+	}
+	if db.store["z"].V != "new" {
+		t.Fatalf("z was overwritten with %q", db.store["z"].V)
+	}
+	if _, ok := db.store["gone"]; ok {
+		t.Fatal("the deleted key came back")
+	}
+}
+
+type cowItem struct {
+	v        string
+	expMs    int64
+	accesses int
+}
+
+// captures the cow: keys the way the RDB file stores them
+func cowState(t *testing.T, store map[string]*Item) map[string]cowItem {
+	t.Helper()
+
+	m := map[string]cowItem{}
+	for k, item := range store {
+		if !strings.HasPrefix(k, "cow:") {
+			continue
+		}
+		var expMs int64
+		if !item.exp.IsZero() {
+			expMs = item.exp.UnixMilli()
+		}
+		m[k] = cowItem{v: item.V, expMs: expMs, accesses: item.Accesses()}
+	}
+	return m
+}
+
+// a background save encodes its snapshot while writers keep changing the same keys.
+// run with -race: the encoder and the writers must never share an item that changes,
+// and the file must hold the dataset as it was when the snapshot was taken
+func TestSnapshotIsPointInTime(t *testing.T) {
+	conf := NewConfig()
+	conf.eviction = AllKeysLFU // access counts are saved too
+	state := NewAppState(conf)
+
+	const keys = 5000
+	exp := time.Now().Add(time.Hour)
+	DB.mu.Lock()
+	for i := range keys {
+		k := fmt.Sprintf("cow:%d", i)
+		if err := DB.Set(k, fmt.Sprintf("v%d", i), state); err != nil {
+			t.Fatal(err)
+		}
+		item := DB.store[k]
+		if i%3 == 0 {
+			item.exp = exp.Add(time.Duration(i) * time.Millisecond)
+		}
+		item.accesses.Store(int64(i % 7))
+	}
+	DB.mu.Unlock()
+	t.Cleanup(func() {
+		DB.mu.Lock()
+		for i := range keys {
+			DB.Delete(fmt.Sprintf("cow:%d", i))
+		}
+		DB.mu.Unlock()
+	})
+
+	for round := range 3 {
+		DB.mu.RLock()
+		want := cowState(t, DB.store)
+		DB.mu.RUnlock()
+
+		store, release := DB.snapshot()
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c := &Client{multi: -1}
+				rng := rand.New(rand.NewPCG(uint64(round), uint64(w)))
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					k := fmt.Sprintf("cow:%d", rng.IntN(keys))
+					var args []Value
+					switch rng.IntN(4) {
+					case 0:
+						args = argv("SET", k, fmt.Sprintf("r%d", round))
+						set(c, &Value{typ: ARRAY, array: args}, state)
+					case 1:
+						at := time.Now().Add(2 * time.Hour).UnixMilli()
+						args = argv("PEXPIREAT", k, fmt.Sprint(at))
+						pexpireat(c, &Value{typ: ARRAY, array: args}, state)
+					case 2:
+						args = argv("GET", k)
+						get(c, &Value{typ: ARRAY, array: args}, state)
+					case 3:
+						args = argv("DEL", k)
+						del(c, &Value{typ: ARRAY, array: args}, state)
+					}
+				}
+			}()
+		}
+
+		var buf bytes.Buffer
+		err := writeRDB(&buf, store, conf, false)
+		release()
+		close(stop)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := readRDB(bufio.NewReader(&buf), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := cowState(t, loaded)
+		if len(got) != len(want) {
+			t.Fatalf("round %d: the snapshot has %d keys, want %d", round, len(got), len(want))
+		}
+		for k, w := range want {
+			if got[k] != w {
+				t.Fatalf("round %d: %s is %+v in the snapshot, want %+v", round, k, got[k], w)
+			}
+		}
+	}
+}
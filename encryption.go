@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// encryption at rest. an encrypted RDB or AOF file is a header naming the key it was written
+// with, followed by frames sealed with AES-256-GCM: a 4 byte length, the nonce and the ciphertext.
+// a frame is authenticated together with the header and its offset in the file, so frames can't be
+// altered, reordered or moved to another file without loading failing.
+// AOF frames are sealed at flushes, which always fall between commands, so a frame torn by a crash
+// is an incomplete command at the end of the file like in a plain AOF
+
+const (
+	encMagic     = "GOREDENC"
+	encVersion   = 1
+	encKeyIDLen  = 8
+	encHeaderLen = len(encMagic) + 1 + encKeyIDLen
+	encFrameSize = 64 * 1024 // plaintext buffered before a frame is sealed, unless the file is flushed first
+)
+
+type encKey struct {
+	id   [encKeyIDLen]byte // the start of the SHA-256 of the key
+	aead cipher.AEAD
+}
+
+// a key file holds the 32 bytes of an AES-256 key, raw or hex encoded
+func readKeyFile(fp string) (*encKey, error) {
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	key := data
+	if hexKey := bytes.TrimSpace(data); len(hexKey) == 64 {
+		if key, err = hex.DecodeString(string(hexKey)); err != nil {
+			return nil, fmt.Errorf("%s: %w", fp, err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s: a key is 32 bytes, or 64 hex characters", fp)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &encKey{aead: aead}
+	sum := sha256.Sum256(key)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+func (k *encKey) header() []byte {
+	hdr := append([]byte(encMagic), encVersion)
+	return append(hdr, k.id[:]...)
+}
+
+func (k *encKey) aad(off int64) []byte {
+	return binary.BigEndian.AppendUint64(k.header(), uint64(off))
+}
+
+// cur writes new files, it's nil when files are only decrypted. the other keys are the ones
+// being rotated out, files they wrote can be loaded until a rewrite replaces them
+type Keyring struct {
+	cur  *encKey
+	keys map[[encKeyIDLen]byte]*encKey
+}
+
+func loadKeyring(cur string, old []string) (*Keyring, error) {
+	kr := &Keyring{keys: map[[encKeyIDLen]byte]*encKey{}}
+
+	for _, fp := range old {
+		k, err := readKeyFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[k.id] = k
+	}
+
+	if cur != "" {
+		k, err := readKeyFile(cur)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[k.id] = k
+		kr.cur = k
+	}
+	return kr, nil
+}
+
+// whether new files are written encrypted, kr may be nil
+func (kr *Keyring) enabled() bool {
+	return kr != nil && kr.cur != nil
+}
+
+// the id in an encryption header, ok is false if hdr doesn't start with one
+func parseEncHeader(hdr []byte) (id [encKeyIDLen]byte, ok bool) {
+	if len(hdr) < encHeaderLen || string(hdr[:len(encMagic)]) != encMagic {
+		return id, false
+	}
+	copy(id[:], hdr[len(encMagic)+1:encHeaderLen])
+	return id, true
+}
+
+// returns a reader of the plaintext of f, decrypting it if it starts with an encryption header.
+// dec is nil for a plain file. kr may be nil, then only plain files can be read
+func (kr *Keyring) open(f io.Reader) (r *bufio.Reader, dec *decReader, err error) {
+	br := bufio.NewReader(f)
+	hdr, _ := br.Peek(encHeaderLen)
+	id, ok := parseEncHeader(hdr)
+	if !ok {
+		return br, nil, nil
+	}
+
+	if v := hdr[len(encMagic)]; v != encVersion {
+		return nil, nil, fmt.Errorf("can't handle encryption format version %d", v)
+	}
+	var key *encKey
+	if kr != nil {
+		key = kr.keys[id]
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("the file is encrypted with key %x, which is not configured", id)
+	}
+
+	br.Discard(encHeaderLen)
+	dec = &decReader{r: br, key: key, off: int64(encHeaderLen)}
+	return bufio.NewReader(dec), dec, nil
+}
+
+// buffers plaintext and writes it out as sealed frames
+type encWriter struct {
+	w     io.Writer
+	key   *encKey
+	off   int64 // where the next frame goes in the file, the header comes first at 0
+	split bool  // seal every encFrameSize bytes on its own, for files nothing is appended to
+	buf   []byte
+	err   error // like a bufio.Writer, once a write fails every later one does
+}
+
+func newEncWriter(w io.Writer, key *encKey, off int64, split bool) *encWriter {
+	return &encWriter{w: w, key: key, off: off, split: split}
+}
+
+func (e *encWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.buf = append(e.buf, p...)
+	if e.split && len(e.buf) >= encFrameSize {
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (e *encWriter) buffered() int {
+	return len(e.buf)
+}
+
+// writes what's buffered as one frame
+func (e *encWriter) seal() error {
+	if e.err != nil || len(e.buf) == 0 {
+		return e.err
+	}
+
+	aead := e.key.aead
+	out := make([]byte, 0, encHeaderLen+4+aead.NonceSize()+len(e.buf)+aead.Overhead())
+	if e.off == 0 {
+		out = append(out, e.key.header()...)
+	}
+	frameOff := e.off + int64(len(out))
+
+	out = binary.BigEndian.AppendUint32(out, uint32(aead.NonceSize()+len(e.buf)+aead.Overhead()))
+	nonce := out[len(out) : len(out)+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		e.err = err
+		return err
+	}
+	out = out[:len(out)+len(nonce)]
+	out = aead.Seal(out, nonce, e.buf, e.key.aad(frameOff))
+
+	if _, err := e.w.Write(out); err != nil {
+		e.err = err
+		return err
+	}
+	e.off += int64(len(out))
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// reads the plaintext of the frames after a header.
+// a frame cut short is errAofTruncated, the end of the file is only io.EOF between frames
+type decReader struct {
+	r       io.Reader
+	key     *encKey
+	off     int64 // file offset of the next frame
+	plain   int64 // plaintext in the frames read so far
+	buf     bytes.Buffer
+	pending []byte // plaintext of the last frame not read yet
+	err     error  // kept, a bufio.Reader hands an error out once and the next read would see a clean end
+}
+
+func (d *decReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *decReader) next() error {
+	var lb [4]byte
+	if _, err := io.ReadFull(d.r, lb[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errAofTruncated
+		}
+		return err
+	}
+
+	aead := d.key.aead
+	size := int64(binary.BigEndian.Uint32(lb[:]))
+	if size < int64(aead.NonceSize()+aead.Overhead()) {
+		return fmt.Errorf("bad frame length %d at offset %d", size, d.off)
+	}
+
+	// grows with what's actually read, a garbage length can't make it allocate gigabytes
+	d.buf.Reset()
+	if n, err := d.buf.ReadFrom(io.LimitReader(d.r, size)); err != nil {
+		return err
+	} else if n < size {
+		return errAofTruncated
+	}
+
+	frame := d.buf.Bytes()
+	nonce, ct := frame[:aead.NonceSize()], frame[aead.NonceSize():]
+	plain, err := aead.Open(ct[:0], nonce, ct, d.key.aad(d.off))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt the frame at offset %d: %w", d.off, err)
+	}
+
+	d.off += 4 + size
+	d.plain += int64(len(plain))
+	d.pending = plain
+	return nil
+}
+
+// where plaintext offset off is in the file. only the end of the last frame read can be asked
+// for, it's where a file with a torn frame is truncated
+func (d *decReader) fileOffset(off int64) (int64, error) {
+	if off != d.plain {
+		return 0, fmt.Errorf("offset %d of the plaintext is inside an encrypted frame", off)
+	}
+	return d.off, nil
+}
+
+// whether data can be appended to the file fp, it must be empty or written like new files are:
+// plain without a current key, encrypted with it otherwise
+func (kr *Keyring) canAppend(fp string) (bool, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, encHeaderLen)
+	n, err := io.ReadFull(f, hdr)
+	if n == 0 {
+		return true, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	id, encrypted := parseEncHeader(hdr[:n])
+	if !kr.enabled() {
+		return !encrypted, nil
+	}
+	return encrypted && id == kr.cur.id, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// plaintext of a few frames, random so a frame can't be found by its content
+func encTestData(n int) []byte {
+	rng := rand.New(rand.NewPCG(3, 4))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+// seals data like an RDB file is, in encFrameSize frames
+func encryptFrames(t *testing.T, key *encKey, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := newEncWriter(&buf, key, 0, true)
+	for p := data; len(p) > 0; {
+		n := min(len(p), 8192)
+		if _, err := enc.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := enc.seal(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptAll(kr *Keyring, file []byte) ([]byte, error) {
+	r, _, err := kr.open(bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// the file offset of each frame after the header
+func frameOffsets(file []byte) []int {
+	var offs []int
+	for off := encHeaderLen; off+4 <= len(file); off += 4 + int(binary.BigEndian.Uint32(file[off:])) {
+		offs = append(offs, off)
+	}
+	return offs
+}
+
+func TestEncryptionRoundtrip(t *testing.T) {
+	kr := newTestKeyring(t, newTestKeyFile(t))
+	data := encTestData(2*encFrameSize + 1234)
+
+	file := encryptFrames(t, kr.cur, data)
+	if !bytes.HasPrefix(file, kr.cur.header()) {
+		t.Fatalf("the file starts with %q", file[:encHeaderLen])
+	}
+	if bytes.Contains(file, data[:64]) {
+		t.Fatal("the plaintext is in the file")
+	}
+	if n := len(frameOffsets(file)); n != 3 {
+		t.Fatalf("%d bytes were sealed in %d frames, want 3", len(data), n)
+	}
+
+	got, err := decryptAll(kr, file)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("decrypted %d of %d bytes: %v", len(got), len(data), err)
+	}
+
+	// like an AOF: a frame per flush, appended to later by a writer that starts where the file ends
+	var buf bytes.Buffer
+	enc := newEncWriter(&buf, kr.cur, 0, false)
+	enc.Write([]byte("first "))
+	enc.Write([]byte("flush "))
+	enc.seal()
+	enc = newEncWriter(&buf, kr.cur, int64(buf.Len()), false)
+	enc.Write([]byte("second flush"))
+	enc.seal()
+	if got, err := decryptAll(kr, buf.Bytes()); err != nil || string(got) != "first flush second flush" {
+		t.Fatalf("the appended file decrypted to %q: %v", got, err)
+	}
+
+	// files written before the key was set are read as they are
+	if got, err := decryptAll(kr, []byte("*1\r\n$4\r\nPING\r\n")); err != nil || string(got) != "*1\r\n$4\r\nPING\r\n" {
+		t.Fatalf("a plain file read as %q: %v", got, err)
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	written := newTestKeyFile(t)
+	file := encryptFrames(t, newTestKeyring(t, written).cur, encTestData(100))
+
+	for name, kr := range map[string]*Keyring{
+		"another key": newTestKeyring(t, newTestKeyFile(t)),
+		"no key":      nil,
+	} {
+		if _, err := decryptAll(kr, file); err == nil || !strings.Contains(err.Error(), "not configured") {
+			t.Errorf("decrypting with %s: %v", name, err)
+		}
+	}
+
+	// a key being rotated out still decrypts what it wrote
+	if _, err := decryptAll(newTestKeyring(t, newTestKeyFile(t), written), file); err != nil {
+		t.Fatalf("decrypting with the old key: %v", err)
+	}
+
+	// the header names the key, a different one under the same id fails to authenticate
+	other := newTestKeyring(t, newTestKeyFile(t))
+	other.cur.id = newTestKeyring(t, written).cur.id
+	other.keys = map[[encKeyIDLen]byte]*encKey{other.cur.id: other.cur}
+	if _, err := decryptAll(other, file); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Fatalf("decrypting with a different key under the same id: %v", err)
+	}
+}
+
+// a frame cut short is what a crash leaves, the end of a whole frame is a clean end of file
+func TestEncryptionTruncatedFrame(t *testing.T) {
+	kr := newTestKeyring(t, newTestKeyFile(t))
+	data := encTestData(encFrameSize + 100)
+	file := encryptFrames(t, kr.cur, data)
+	last := frameOffsets(file)[1]
+
+	if got, err := decryptAll(kr, file[:last]); err != nil || !bytes.Equal(got, data[:encFrameSize]) {
+		t.Fatalf("the file cut after a frame decrypted %d bytes: %v", len(got), err)
+	}
+
+	for name, n := range map[string]int{
+		"in the length": last + 2,
+		"in the nonce":  last + 4 + 5,
+		"in the data":   len(file) - 1,
+	} {
+		if _, err := decryptAll(kr, file[:n]); !errors.Is(err, errAofTruncated) {
+			t.Errorf("the file cut %s: %v", name, err)
+		}
+	}
+}
+
+// frames are authenticated with their offset, changing or moving one fails
+func TestEncryptionTamperedFrame(t *testing.T) {
+	kr := newTestKeyring(t, newTestKeyFile(t))
+	file := encryptFrames(t, kr.cur, encTestData(2*encFrameSize))
+	offs := frameOffsets(file)
+
+	flipped := bytes.Clone(file)
+	flipped[offs[1]+100] ^= 1
+	if _, err := decryptAll(kr, flipped); err == nil || !strings.Contains(err.Error(), "cannot decrypt the frame at offset") {
+		t.Errorf("a changed frame: %v", err)
+	}
+
+	// swapped, each frame is at the offset of the other
+	swapped := append(bytes.Clone(file[:offs[0]]), file[offs[1]:]...)
+	swapped = append(swapped, file[offs[0]:offs[1]]...)
+	if _, err := decryptAll(kr, swapped); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("reordered frames: %v", err)
+	}
+
+	dropped := append(bytes.Clone(file[:offs[0]]), file[offs[1]:]...)
+	if _, err := decryptAll(kr, dropped); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("a dropped frame: %v", err)
+	}
+
+	short := bytes.Clone(file)
+	binary.BigEndian.PutUint32(short[offs[0]:], 3)
+	if _, err := decryptAll(kr, short); err == nil || !strings.Contains(err.Error(), "bad frame length") {
+		t.Errorf("a frame length shorter than a nonce: %v", err)
+	}
+
+	version := bytes.Clone(file)
+	version[len(encMagic)] = encVersion + 1
+	if _, err := decryptAll(kr, version); err == nil || !strings.Contains(err.Error(), "encryption format version") {
+		t.Errorf("an unknown format version: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// catalog of error replies shared by all handlers
+// the text must match redis byte for byte since client libraries parse the prefix (ERR, WRONGTYPE, ...)
+var (
+	ErrSyntax           = errors.New("ERR syntax error")
+	ErrNotInteger       = errors.New("ERR value is not an integer or out of range")
+	ErrWrongType        = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrOOM              = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+	ErrNoAuth           = errors.New("NOAUTH Authentication required.")
+	ErrAuthNotSet       = errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	ErrExecAbort        = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	ErrNestedMulti      = errors.New("ERR MULTI calls can not be nested")
+	ErrExecWithoutMulti = errors.New("ERR EXEC without MULTI")
+	ErrDiscardNoMulti   = errors.New("ERR DISCARD without MULTI")
+	ErrBgsaveRunning    = errors.New("ERR Background save already in progress")
+	ErrAofRewriteActive = errors.New("ERR Background append only file rewriting already in progress")
+	ErrBgsaveRewriting  = errors.New("ERR Another child process is active (AOF?): can't BGSAVE right now. Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+	ErrSaveFailed       = errors.New("ERR") // redis replies to a failed SAVE with a bare ERR, the cause is in the log
+	ErrShutdownFailed   = errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+	ErrNoShutdown       = errors.New("ERR No shutdown in progress.")
+	ErrNoMulti          = errors.New("ERR Command not allowed inside a transaction")
+	ErrLoading          = errors.New("LOADING Redis is loading the dataset in memory")
+	ErrMisconf          = errors.New("MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. Commands that may modify the data set are disabled, because this instance is configured to report errors during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.")
+
+	ErrMaxClients      = errors.New("ERR max number of clients reached")
+	ErrProtoBulkLen    = errors.New("ERR Protocol error: invalid bulk length")
+	ErrProtoMultiLen   = errors.New("ERR Protocol error: invalid multibulk length")
+	ErrProtectedMode   = errors.New("DENIED Redis is running in protected mode because protected mode is enabled and no password is set for the default user. In this mode connections are only accepted from the loopback interface. If you want to connect from external computers to Redis you may adopt one of the following solutions: 1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback interface by connecting to Redis from the same host the server is running, however MAKE SURE Redis is not publicly accessible from internet if you do so. Use CONFIG REWRITE to make this change permanent. 2) Alternatively you can just disable the protected mode by editing the Redis configuration file, and setting the protected mode option to 'no', and then restarting the server. 3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. 4) Set up an authentication password for the default user. NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.")
+	ErrNoSuchClient    = errors.New("ERR No such client")
+	ErrInvalidClientId = errors.New("ERR Invalid client ID")
+	ErrClientIdRange   = errors.New("ERR client-id should be greater than 0")
+	ErrClientName      = errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+	ErrPauseTimeout    = errors.New("ERR timeout is not an integer or out of range")
+	ErrPauseNegative   = errors.New("ERR timeout is negative")
+
+	ErrWrongPass        = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	ErrNoPermKey        = errors.New("NOPERM No permissions to access a key")
+	ErrNoPermChannel    = errors.New("NOPERM No permissions to access a channel")
+	ErrDeleteDefaultACL = errors.New("ERR The 'default' user cannot be removed")
+	ErrACLSave          = errors.New("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+	ErrNoACLFile        = errors.New("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+	ErrGenPassBits      = errors.New("ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+
+	ErrGetKeysInvalidCmd  = errors.New("ERR Invalid command specified")
+	ErrGetKeysInvalidArgs = errors.New("ERR Invalid number of arguments specified for command")
+	ErrGetKeysNoKeys      = errors.New("ERR The command has no key arguments")
+)
+
+func ErrWrongArgs(cmd string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+}
+
+func ErrUnknownClientType(typ string) error {
+	return fmt.Errorf("ERR Unknown client type '%s'", typ)
+}
+
+func ErrNoSuchUser(user string) error {
+	return fmt.Errorf("ERR No such user '%s'", user)
+}
+
+func ErrNoPermCmd(user string, cmd string) error {
+	return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", user, cmd)
+}
+
+func ErrAuthRateLimited(wait time.Duration) error {
+	return fmt.Errorf("ERR Too many failed authentication attempts from this address, try again in %d ms", wait.Milliseconds())
+}
+
+func ErrUnknownACLCategory(cat string) error {
+	return fmt.Errorf("ERR Unknown category '%.128s'", cat)
+}
+
+func ErrUnknownSubcmd(cmd string, sub string) error {
+	return fmt.Errorf("ERR unknown subcommand '%.128s'. Try %s HELP.", sub, strings.ToUpper(cmd))
+}
+
+// redis quotes the first few args of an unknown command, capped at 128 bytes
+func ErrUnknownCmd(cmd string, args []Value) error {
+	var sb strings.Builder
+	for _, arg := range args {
+		if sb.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&sb, "'%.*s' ", 128-sb.Len(), arg.bulk)
+	}
+	return fmt.Errorf("ERR unknown command '%.128s', with args beginning with: %s", cmd, sb.String())
+}
+
+// converts an error from the catalog into a RESP error reply
+func errReply(err error) *Value {
+	return &Value{typ: ERROR, err: err.Error()}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client libraries match on these replies, so the bytes on the wire must not drift from redis
+func TestErrorReplies(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{ErrSyntax, "-ERR syntax error\r\n"},
+		{ErrNotInteger, "-ERR value is not an integer or out of range\r\n"},
+		{ErrWrongType, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{ErrOOM, "-OOM command not allowed when used memory > 'maxmemory'.\r\n"},
+		{ErrNoAuth, "-NOAUTH Authentication required.\r\n"},
+		{ErrExecAbort, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{ErrSaveFailed, "-ERR\r\n"},
+		{ErrLoading, "-LOADING Redis is loading the dataset in memory\r\n"},
+		{ErrMaxClients, "-ERR max number of clients reached\r\n"},
+		{ErrProtoBulkLen, "-ERR Protocol error: invalid bulk length\r\n"},
+		{ErrProtoMultiLen, "-ERR Protocol error: invalid multibulk length\r\n"},
+		{ErrWrongPass, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{ErrNoPermKey, "-NOPERM No permissions to access a key\r\n"},
+		{ErrWrongArgs("GET"), "-ERR wrong number of arguments for 'get' command\r\n"},
+		{ErrNoSuchUser("bob"), "-ERR No such user 'bob'\r\n"},
+		{ErrNoPermCmd("bob", "flushall"), "-NOPERM User bob has no permissions to run the 'flushall' command\r\n"},
+		{ErrAuthRateLimited(1500 * time.Millisecond), "-ERR Too many failed authentication attempts from this address, try again in 1500 ms\r\n"},
+		{ErrUnknownSubcmd("client", "nope"), "-ERR unknown subcommand 'nope'. Try CLIENT HELP.\r\n"},
+		{ErrUnknownCmd("foo", argv("a", "b")), "-ERR unknown command 'foo', with args beginning with: 'a' 'b' \r\n"},
+	}
+
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Write(errReply(tc.err))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("got %q, want %q", buf.String(), tc.want)
+		}
+	}
+}
+
+func TestUnknownCmdQuotesAtMost128Bytes(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	msg := ErrUnknownCmd(long, argv(long, "b")).Error()
+
+	want := "ERR unknown command '" + long[:128] + "', with args beginning with: '" + long[:128] + "' "
+	if msg != want {
+		t.Fatalf("got %q, want %q", msg, want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+// glob-style matching like redis stringmatchlen, used for KEYS and ACL key patterns.
+// unlike filepath.Match, * and ? match any byte including '/', and \ escapes the next byte
+func stringMatch(pattern, str string, nocase bool) bool {
+	skipLonger := false
+	return stringMatchImpl(pattern, str, nocase, &skipLonger, 0)
+}
+
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// skipLonger is set once a * has tried every remaining suffix, an enclosing * trying a
+// later start can't do better so it gives up too. this keeps patterns like a*a*a*b linear
+func stringMatchImpl(pattern, str string, nocase bool, skipLonger *bool, nesting int) bool {
+	// a pattern with lots of stars recurses that deep, like redis give up on it
+	if nesting > 1000 {
+		return false
+	}
+
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for s < len(str) {
+				if stringMatchImpl(pattern[p+1:], str[s:], nocase, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				s++
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+
+			match := false
+			for {
+				if p == len(pattern) {
+					// unterminated class, the outer p++ must not skip past the end
+					p--
+					break
+				}
+				if pattern[p] == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = lowerByte(start), lowerByte(end), lowerByte(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if pattern[p] == str[s] || nocase && lowerByte(pattern[p]) == lowerByte(str[s]) {
+					match = true
+				}
+				p++
+			}
+
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		default:
+			if pattern[p] == '\\' && len(pattern)-p >= 2 {
+				p++
+			}
+			if pattern[p] != str[s] && !(nocase && lowerByte(pattern[p]) == lowerByte(str[s])) {
+				return false
+			}
+			s++
+		}
+		p++
+
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+
+	return p == len(pattern) && s == len(str)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	cases := []struct {
+		pattern, str string
+		nocase       bool
+		want         bool
+	}{
+		{"*", "a/b", false, true},
+		{"a/*", "a/b/c", false, true},
+		{"user:*", "user:1", false, true},
+		{"user:*", "session:1", false, false},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hbllo", false, true},
+		{"h[a-b]llo", "hcllo", false, false},
+		{`h\*llo`, "h*llo", false, true},
+		{`h\*llo`, "hello", false, false},
+		{`h[\]]llo`, "h]llo", false, true},
+		{"h[ae", "ha", false, true}, // an unterminated class ends at the pattern
+		{"a**b", "axyzb", false, true},
+		{"a*", "a", false, true},
+		{"*a", "", false, false},
+		{"GET", "get", true, true},
+		{"GET", "get", false, false},
+		{"[A-C]", "b", true, true},
+		{"client|*", "client|kill", false, true},
+		{strings.Repeat("a*", 20) + "b", strings.Repeat("a", 60), false, false},
+	}
+
+	for _, tc := range cases {
+		if got := stringMatch(tc.pattern, tc.str, tc.nocase); got != tc.want {
+			t.Errorf("stringMatch(%q, %q, %v) = %v, want %v", tc.pattern, tc.str, tc.nocase, got, tc.want)
+		}
+	}
+}
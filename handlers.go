@@ -2,96 +2,182 @@ package main
 
 import (
 	"log"
-	"maps"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
-type Handler func(*Client, *Value, *AppState) *Value // type defn for the map
-
-var Handlers = map[string]Handler{
-	"COMMAND":      command,
-	"GET":          get,
-	"SET":          set,
-	"DEL":          del,
-	"EXISTS":       exists,
-	"KEYS":         keys,
-	"SAVE":         save,
-	"BGSAVE":       bgsave,
-	"DBSIZE":       dbsize,
-	"FLUSHDB":      flushdb,
-	"AUTH":         auth,
-	"EXPIRE":       expire,
-	"TTL":          ttl,
-	"BGREWRITEAOF": bgrewriteaof,
-	"MULTI":        multi,
-	"EXEC":         _exec,
-	"DISCARD":      discard,
-	"MONITOR":      monitor,
-	"INFO":         info,
-} // map to store the commands and their implementations
+type Handler func(*Client, *Value, *AppState) *Value // type defn for the command table
 
 var SafeCmds = []string{
-	"COMMAND",
-	"AUTH",
+	"command",
+	"auth",
 }
 
 func handle(c *Client, v *Value, state *AppState) {
-	cmd := v.array[0].bulk       // it's a command like GET, SET, etc
-	handler, ok := Handlers[cmd] // handler is the functional implementation of cmd in a map, stores cmd and its functional implementation
-	w := NewWriter(c.conn)       // creating a new writer with conn object
+	cmd, err := resolveCommand(v.array) // cmd holds the handler plus arity, flags and key positions
 
-	if !ok {
-		w.Write(&Value{typ: ERROR, err: "ERR invalid command"})
-		w.Flush()
+	// CLIENT REPLY SKIP silences only the command that follows it
+	c.skipReply = c.skipNext
+	c.skipNext = false
+
+	if err != nil {
+		// a command that fails to queue poisons the open transaction, EXEC will abort it
+		if c.tx != nil {
+			c.tx.aborted = true
+		}
+		c.reply(errReply(err))
+		return
+	}
+
+	if !contains(SafeCmds, cmd.root().name) {
+		if !c.authenticated {
+			c.reply(errReply(ErrNoAuth))
+			return
+		}
+
+		if err := state.checkACL(c, cmd, v.array, ACLContextToplevel); err != nil {
+			if c.tx != nil {
+				c.tx.aborted = true
+			}
+			c.reply(errReply(err))
+			return
+		}
+	}
+
+	// the dataset is still being read from disk, only commands that don't need it run
+	if state.loading.loading.Load() && !cmd.has(CmdLoading) {
+		if c.tx != nil {
+			c.tx.aborted = true
+		}
+		c.reply(errReply(ErrLoading))
+		return
+	}
+
+	if cmd.has(CmdWrite) && state.writesDenied() {
+		if c.tx != nil {
+			c.tx.aborted = true
+		}
+		c.reply(errReply(ErrMisconf))
 		return
 	}
 
-	if state.conf.requirepass && !c.authenticated && !contains(SafeCmds, cmd) {
-		w.Write(&Value{typ: ERROR, err: "NOAUTH authentication required"})
-		w.Flush()
+	c.recordCommand(cmd)
+
+	if c.tx != nil && cmd.has(CmdNoMulti) {
+		c.tx.aborted = true
+		c.reply(errReply(ErrNoMulti))
 		return
 	}
 
 	//queue the command if in a transaction
-	if state.tx != nil && cmd != "EXEC" && cmd != "DISCARD" {
-		txcmd := TxCommand{v: v, handler: handler}
-		state.tx.cmds = append(state.tx.cmds, &txcmd)
-		w.Write(&Value{typ: STRING, str: "QUEUED"})
-		w.Flush()
+	if c.tx != nil && cmd.name != "exec" && cmd.name != "discard" && cmd.name != "multi" {
+		txcmd := TxCommand{v: v, cmd: cmd}
+		c.tx.cmds = append(c.tx.cmds, &txcmd)
+		c.reply(&Value{typ: STRING, str: "QUEUED"})
 		return
 	}
 
-	reply := handler(c, v, state) // calling the function of cmd with v as argument
-	w.Write(reply)                // converting reply to resp protocol
-	w.Flush()                     // flushing to the CLI
+	if state.pause.blocks(c, cmd) {
+		c.flush() // replies to earlier pipelined commands shouldn't wait for the pause
+		c.setBlocked(true)
+		state.pause.wait(c, cmd)
+		c.setBlocked(false)
+	}
 
-	state.generalStats.total_commands_processed++
+	// SHUTDOWN takes the gate to wait for running writes and hold new ones back, reads go on
+	if isWriteCmd(c, cmd) {
+		state.gate.RLock()
+		defer state.gate.RUnlock()
 
-	go func() {
-		for _, mon := range state.monitors {
-			if mon != c {
-				mon.writeMonitorLog(c, v)
-			}
+		// the server is going away, the write is dropped like redis would never get to it
+		if state.exiting.Load() {
+			return
 		}
-	}()
+	}
+
+	reply := call(c, cmd, v, state)
+	c.reply(reply) // converting reply to resp protocol, replies are flushed once per read batch
+
+	state.generalStats.total_commands_processed.Add(1)
 
+	// monitors only get their output buffer appended to, a slow one can't hold this client up
+	for _, mon := range state.monitorList() {
+		if mon != c {
+			mon.writeMonitorLog(c, v)
+		}
+	}
 }
 
-func command(c *Client, v *Value, state *AppState) *Value {
-	return &Value{typ: STRING, str: "OK"}
+// runs the command's handler and appends successful writes to the AOF
+// writes hold the AOF lock while they run so the log keeps the order they were applied in
+func call(c *Client, cmd *Command, v *Value, state *AppState) *Value {
+	if !state.conf.aofEnabled {
+		return cmd.handler(c, v, state)
+	}
+
+	// EXEC already holds the lock for the whole transaction
+	inExec := c.tx != nil && c.tx.running
+
+	if !cmd.has(CmdWrite) {
+		reply := cmd.handler(c, v, state)
+
+		// a read may have found expired keys, their DELs don't wait for the next write
+		if state.aof.hasPending.Load() {
+			if !inExec {
+				state.aof.mu.Lock()
+				defer state.aof.mu.Unlock()
+			}
+			if state.aof.appendPending() && !inExec {
+				state.aof.appended()
+			}
+		}
+		return reply
+	}
+
+	if !inExec {
+		state.aof.mu.Lock()
+		defer state.aof.mu.Unlock()
+	}
+
+	c.propagateArgv, c.noPropagate = nil, false
+	reply := cmd.handler(c, v, state)
+
+	// keys evicted to make room for the write are deleted before it in the log, even if it failed
+	// or changed nothing and isn't logged itself
+	dels := state.aof.appendPending()
+	if reply != nil && reply.typ == ERROR || c.noPropagate {
+		c.propagateArgv, c.noPropagate = nil, false
+		if dels && !inExec {
+			state.aof.appended()
+		}
+		return reply
+	}
+
+	// handlers rewrite commands that wouldn't replay the same, e.g. relative expiries
+	argv := v.array
+	if c.propagateArgv != nil {
+		argv = c.propagateArgv
+		c.propagateArgv = nil
+	}
+
+	if inExec && !c.tx.logged {
+		state.aof.append([]Value{{typ: BULK, bulk: "MULTI"}})
+		c.tx.logged = true
+	}
+	state.aof.append(argv)
+
+	if !inExec {
+		state.aof.appended()
+	}
+	return reply
 }
 
 func get(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'GET' function"}
-	}
-
 	name := args[0].bulk
 
-	item, ok := DB.Get(name, state)
+	item, ok := DB.Get(name, state, !c.noTouch)
 	if !ok {
 		return &Value{typ: NULL}
 	}
@@ -101,9 +187,6 @@ func get(c *Client, v *Value, state *AppState) *Value {
 
 func set(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 2 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'SET' function"}
-	}
 	key := args[0].bulk
 	val := args[1].bulk
 
@@ -111,21 +194,10 @@ func set(c *Client, v *Value, state *AppState) *Value {
 	err := DB.Set(key, val, state)
 	if err != nil {
 		DB.mu.Unlock()
-		return &Value{typ: ERROR, err: "Error " + err.Error()}
-	}
-
-	if state.conf.aofEnabled {
-		state.aof.w.Write(v)
-
-		if state.conf.aofFsync == Always {
-			state.aof.w.Flush()
-		}
-	}
-
-	if len(state.conf.rdb) > 0 {
-		IncrRDBTrackers()
+		return errReply(err)
 	}
 
+	state.keysChanged(1)
 	DB.mu.Unlock()
 
 	return &Value{typ: STRING, str: "OK"}
@@ -143,6 +215,7 @@ func del(c *Client, v *Value, state *AppState) *Value {
 			n++
 		}
 	}
+	state.keysChanged(n)
 	DB.mu.Unlock()
 
 	return &Value{typ: INTEGER, num: n}
@@ -166,22 +239,13 @@ func exists(c *Client, v *Value, state *AppState) *Value {
 
 func keys(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'KEYS' command"}
-	}
 	pattern := args[0].bulk
 
 	DB.mu.RLock()
 	var matches []string
 
 	for key := range DB.store {
-		matched, err := filepath.Match(pattern, key)
-		if err != nil {
-			log.Printf("error matching keys: (pattern: %s), (key: %s) - %v", pattern, key, err)
-			continue
-		}
-
-		if matched {
+		if stringMatch(pattern, key, false) {
 			matches = append(matches, key)
 		}
 	}
@@ -196,35 +260,69 @@ func keys(c *Client, v *Value, state *AppState) *Value {
 }
 
 func save(c *Client, v *Value, state *AppState) *Value {
-	SaveRDB(state)
+	if state.bgsaveRunning.Load() {
+		return errReply(ErrBgsaveRunning)
+	}
+
+	if err := SaveRDB(state, nil, 0); err != nil {
+		return errReply(ErrSaveFailed)
+	}
 	return &Value{typ: STRING, str: "OK"}
 }
 
+// BGSAVE [SCHEDULE]
+// like redis a snapshot isn't written alongside an AOF rewrite, with SCHEDULE it's started once the rewrite is done
 func bgsave(c *Client, v *Value, state *AppState) *Value {
-	// uses copy-on-write algorithm can't implement in go cuz of garbage collector
-	if state.bgsaveRunning {
-		return &Value{typ: ERROR, err: "ERR background saving already in progress"}
+	schedule := false
+	if len(v.array) > 2 {
+		return errReply(ErrSyntax)
+	}
+	if len(v.array) == 2 {
+		if !strings.EqualFold(v.array[1].bulk, "schedule") {
+			return errReply(ErrSyntax)
+		}
+		schedule = true
 	}
 
-	cp := make(map[string]*Item, len(DB.store))
-
-	DB.mu.RLock()
-	maps.Copy(cp, DB.store)
-	DB.mu.RUnlock()
+	if state.bgsaveRunning.Load() {
+		return errReply(ErrBgsaveRunning)
+	}
+	if state.aofRewriteRunning.Load() {
+		if !schedule {
+			return errReply(ErrBgsaveRewriting)
+		}
+		state.bgsaveScheduled.Store(true)
+		// the rewrite may have finished in between without seeing the flag
+		if !state.aofRewriteRunning.Load() {
+			state.runScheduledBgsave()
+		}
+		return &Value{typ: STRING, str: "Background saving scheduled"}
+	}
 
-	state.bgsaveRunning = true
-	state.dbCopy = cp
+	save, ok := startBgsave(state)
+	if !ok {
+		return errReply(ErrBgsaveRunning)
+	}
+	go save()
 
-	go func() {
-		defer func() {
-			state.bgsaveRunning = false
-			state.dbCopy = nil
-		}()
+	return &Value{typ: STRING, str: "Background saving started"}
+}
 
-		SaveRDB(state)
-	}()
+// starts the BGSAVE SCHEDULE asked for during an AOF rewrite, if there's one
+func (state *AppState) runScheduledBgsave() {
+	if !state.bgsaveScheduled.CompareAndSwap(true, false) {
+		return
+	}
+	save, ok := startBgsave(state)
+	if !ok {
+		return // one started meanwhile, it's as recent as the scheduled one would be
+	}
+	log.Println("background saving started by a BGSAVE scheduled during the AOF rewrite")
+	go save()
+}
 
-	return &Value{typ: STRING, str: "OK"}
+func lastsave(c *Client, v *Value, state *AppState) *Value {
+	return &Value{typ: INTEGER, num: int(state.rdbStats.rdb_last_save_ts.Load())}
 }
 
 func dbsize(c *Client, v *Value, state *AppState) *Value {
@@ -237,74 +335,130 @@ func dbsize(c *Client, v *Value, state *AppState) *Value {
 
 func flushdb(c *Client, v *Value, state *AppState) *Value {
 	DB.mu.Lock()
+	state.keysChanged(len(DB.store))
 	DB.store = map[string]*Item{}
 	DB.mu.Unlock()
 
 	return &Value{typ: STRING, str: "OK"}
 }
 
+// AUTH <password> authenticates as the default user, AUTH <username> <password> as any user
 func auth(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR invalid number of keywords for 'AUTH'"}
+	if len(args) > 2 {
+		return errReply(ErrSyntax)
+	}
+
+	username, password := "default", args[0].bulk
+	if len(args) == 2 {
+		username, password = args[0].bulk, args[1].bulk
+	} else if state.acl.defaultNoPass() {
+		return errReply(ErrAuthNotSet)
 	}
 
-	p := args[0].bulk
-	if state.conf.password == p {
-		c.authenticated = true
-		return &Value{typ: STRING, str: "OK"}
-	} else {
-		c.authenticated = false
-		return &Value{}
+	// a blocked address isn't told whether the password was right
+	if wait := state.authAudit.Blocked(c); wait > 0 {
+		state.authAudit.Fail(c, username, AuthFailRateLimited)
+		state.generalStats.auth_rate_limited.Add(1)
+		return errReply(ErrAuthRateLimited(wait))
 	}
+
+	u, nopass, ok := state.acl.Authenticate(username, password)
+	if !ok {
+		// a failed AUTH keeps whatever user the client was already authenticated as
+		state.acl.Log(c, ACLDeniedAuth, ACLContextToplevel, "AUTH", username)
+		state.authAudit.Fail(c, username, AuthFailWrongPass)
+		state.generalStats.acl_access_denied_auth.Add(1)
+		return errReply(ErrWrongPass)
+	}
+
+	if !nopass {
+		state.authAudit.Succeed(c)
+	}
+	c.setUser(u)
+	c.authenticated = true
+	return &Value{typ: STRING, str: "OK"}
 }
 
 func expire(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 2 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'EXPIRE' function"}
-	}
-
 	k := args[0].bulk
-	exp := args[1].bulk
 
-	expSecs, err := strconv.Atoi(exp)
+	expSecs, err := strconv.Atoi(args[1].bulk)
 	if err != nil {
-		return &Value{typ: ERROR, err: "ERR invalid expiration time in 'EXPIRE' function"}
+		return errReply(ErrNotInteger)
 	}
-	DB.mu.RLock()
-	key, ok := DB.store[k]
-	if !ok {
+	at := time.Now().Add(time.Duration(expSecs) * time.Second)
+
+	n := expireAt(k, at, state)
+	if n == 0 {
+		c.noPropagate = true // no such key, nothing to replay
 		return &Value{typ: INTEGER, num: 0}
 	}
-	key.exp = time.Now().Add(time.Duration(expSecs) * time.Second)
-	DB.mu.RUnlock()
 
-	return &Value{typ: INTEGER, num: 1}
+	// relative expiries would restart from the time of the replay, log the absolute one
+	c.propagateArgv = []Value{
+		{typ: BULK, bulk: "PEXPIREAT"},
+		{typ: BULK, bulk: k},
+		{typ: BULK, bulk: strconv.FormatInt(at.UnixMilli(), 10)},
+	}
+	return &Value{typ: INTEGER, num: n}
 }
 
-func ttl(c *Client, v *Value, state *AppState) *Value {
+func pexpireat(c *Client, v *Value, state *AppState) *Value {
 	args := v.array[1:]
-	if len(args) != 1 {
-		return &Value{typ: ERROR, err: "ERR invalid number of arguments for 'TTL' function"}
+
+	ms, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return errReply(ErrNotInteger)
 	}
 
+	n := expireAt(args[0].bulk, time.UnixMilli(ms), state)
+	c.noPropagate = n == 0
+	return &Value{typ: INTEGER, num: n}
+}
+
+// sets the key's expiry, a time in the past deletes it right away like redis
+// returns 1 if the key exists, 0 otherwise
+func expireAt(k string, at time.Time, state *AppState) int {
+	DB.mu.Lock()
+	defer DB.mu.Unlock()
+
+	item, ok := DB.mutable(k)
+	if !ok {
+		return 0
+	}
+	state.keysChanged(1)
+
+	if !at.After(time.Now()) {
+		DB.Delete(k)
+		return 1
+	}
+
+	item.exp = at
+	return 1
+}
+
+func ttl(c *Client, v *Value, state *AppState) *Value {
+	args := v.array[1:]
 	k := args[0].bulk
 
 	DB.mu.RLock()
 	item, ok := DB.store[k]
 	if !ok {
+		DB.mu.RUnlock()
 		return &Value{typ: INTEGER, num: -2}
 	}
 	exp := item.exp
+	expired := item.shouldExpire()
 	DB.mu.RUnlock()
 
 	if exp.Unix() == UNIX_TS_EPOCH {
 		return &Value{typ: INTEGER, num: -1}
 	}
 
-	expired := DB.tryExpire(k, item, state)
 	if expired {
+		DB.expire(k, state)
 		return &Value{typ: INTEGER, num: -2}
 	}
 
@@ -313,65 +467,97 @@ func ttl(c *Client, v *Value, state *AppState) *Value {
 }
 
 func bgrewriteaof(c *Client, v *Value, state *AppState) *Value {
+	if !state.aofRewriteRunning.CompareAndSwap(false, true) {
+		return errReply(ErrAofRewriteActive)
+	}
+
 	go func() {
-		state.aofRewriteRunning = true
-		defer func() {
-			state.aofRewriteRunning = false
-		}()
-
-		DB.mu.RLock()
-		cp := make(map[string]*Item, len(DB.store))
-		maps.Copy(cp, DB.store)
-		DB.mu.RUnlock()
+		defer state.runScheduledBgsave()
+		defer state.aofRewriteRunning.Store(false)
 
-		state.aof.Rewrite(cp)
-		state.aofStats.aof_rewrites++
+		if err := state.aof.Rewrite(); err != nil {
+			log.Println("AOF rewrite failed, keeping the current file. error: ", err)
+			state.aofStats.aof_last_bgrewrite_err.Store(true)
+			return
+		}
+		state.aofStats.aof_rewrites.Add(1)
+		state.aofStats.aof_last_bgrewrite_err.Store(false)
 	}()
 
 	return &Value{typ: STRING, str: "Background AOF rewriting started"}
 }
 
 func multi(c *Client, v *Value, state *AppState) *Value {
-	if state.tx != nil {
-		return &Value{typ: ERROR, err: "ERR nested multi-bulk transactions are not allowed"}
+	if c.tx != nil {
+		return errReply(ErrNestedMulti)
 	}
 
-	state.tx = NewTransaction()
+	c.tx = NewTransaction()
 	return &Value{typ: STRING, str: "OK"}
 }
 
 func _exec(c *Client, v *Value, state *AppState) *Value {
-	if state.tx == nil {
-		return &Value{typ: ERROR, err: "ERR EXEC without MULTI"}
+	if c.tx == nil {
+		return errReply(ErrExecWithoutMulti)
+	}
+
+	if c.tx.aborted {
+		c.tx = nil
+		return errReply(ErrExecAbort)
+	}
+
+	// the whole transaction goes to the AOF as one MULTI/EXEC block
+	if state.conf.aofEnabled && c.tx.hasWrites() {
+		state.aof.mu.Lock()
+		defer state.aof.mu.Unlock()
+		c.tx.running = true
 	}
 
-	replies := make([]Value, len(state.tx.cmds))
+	replies := make([]Value, len(c.tx.cmds))
+
+	for i, cmd := range c.tx.cmds {
+		// permissions may have changed since the command was queued
+		if err := state.checkACL(c, cmd.cmd, cmd.v.array, ACLContextMulti); err != nil {
+			replies[i] = *errReply(err)
+			continue
+		}
 
-	for i, cmd := range state.tx.cmds {
-		reply := cmd.handler(c, cmd.v, state)
+		reply := call(c, cmd.cmd, cmd.v, state)
+		if reply == nil {
+			reply = &Value{typ: NULL}
+		}
 		replies[i] = *reply
 	}
 
+	if c.tx.logged {
+		state.aof.append([]Value{{typ: BULK, bulk: "EXEC"}})
+		state.aof.appended()
+	}
+
 	reply := Value{typ: ARRAY, array: replies}
-	state.tx = nil
+	c.tx = nil
 	return &reply
 }
 
 func discard(c *Client, v *Value, state *AppState) *Value {
-	if state.tx == nil {
-		return &Value{typ: ERROR, err: "ERR DISCARD without MULTI"}
+	if c.tx == nil {
+		return errReply(ErrDiscardNoMulti)
 	}
 
-	state.tx = nil
+	c.tx = nil
 	return &Value{typ: STRING, str: "OK"}
 }
 
 func monitor(c *Client, v *Value, state *AppState) *Value {
-	state.monitors = append(state.monitors, c)
+	c.mu.Lock()
+	c.monitor = true
+	c.mu.Unlock()
+
+	state.addMonitor(c)
 	return &Value{typ: STRING, str: "OK"}
 }
 
 func info(c *Client, v *Value, state *AppState) *Value {
-	msg := state.info.print(state)
+	msg := buildInfo(state).String()
 	return &Value{typ: BULK, bulk: msg}
 }
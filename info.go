@@ -8,6 +8,7 @@ import (
 	"github.com/shirou/gopsutil/v4/mem"
 )
 
+// the INFO sections, built from scratch for every INFO so concurrent calls share nothing
 type Info struct {
 	server      map[string]string
 	client      map[string]string
@@ -16,11 +17,8 @@ type Info struct {
 	general     map[string]string
 }
 
-func NewInfo() *Info {
-	return &Info{}
-}
-
-func (info *Info) build(state *AppState) {
+func buildInfo(state *AppState) *Info {
+	info := &Info{}
 
 	excPath, err := os.Executable()
 	if err != nil {
@@ -38,7 +36,7 @@ func (info *Info) build(state *AppState) {
 	info.server = map[string]string{
 		"redis_version":     "1.0.0",
 		"process_id":        fmt.Sprint(os.Getpid()),
-		"tcp_port":          "6379",
+		"tcp_port":          fmt.Sprint(state.conf.port),
 		"server_time_usec":  fmt.Sprint(time.Now().UnixMicro()),
 		"uptime_in_seconds": fmt.Sprint(int(time.Since(state.serverStart).Seconds())),
 		"executable":        excPath,
@@ -46,37 +44,67 @@ func (info *Info) build(state *AppState) {
 	}
 
 	info.client = map[string]string{
-		"connected_clients": fmt.Sprint(state.clientCount),
+		"connected_clients": fmt.Sprint(state.clientCount()),
 	}
 
+	// both change under DB.mu
+	DB.mu.RLock()
+	usedMem, peakMem := DB.mem, state.peakMem
+	DB.mu.RUnlock()
+
 	info.memory = map[string]string{
-		"used_memory":         fmt.Sprint(DB.mem),
-		"used_memory_peak":    fmt.Sprint(state.peakMem),
+		"used_memory":         fmt.Sprint(usedMem),
+		"used_memory_peak":    fmt.Sprint(peakMem),
 		"total_system_memory": fmt.Sprint(memTotal),
 		"maxmemory":           fmt.Sprint(state.conf.maxmem),
 		"maxmemory_policy":    string(state.conf.eviction),
 	}
 
+	bgsaveTime := int64(-1)
+	if state.bgsaveRunning.Load() {
+		bgsaveTime = int64(time.Since(time.Unix(0, state.rdbStats.rdb_bgsave_start.Load())).Seconds())
+	}
+
 	info.persistence = map[string]string{
-		"rdb_bgsave_in_process":   fmt.Sprint(state.bgsaveRunning),
-		"rdb_last_save_time":      fmt.Sprint(state.rdbStats.rdb_last_save_ts),
-		"rdb_saves":               fmt.Sprint(state.rdbStats.rdb_saves),
-		"aof_enabled":             fmt.Sprint(state.conf.aofEnabled),
-		"aof_rewrite_in_progress": fmt.Sprint(state.aofRewriteRunning),
-		"aof_rewrites":            fmt.Sprint(state.aofStats.aof_rewrites),
+		"rdb_changes_since_last_save": fmt.Sprint(state.rdbStats.rdb_changes_since_last_save.Load()),
+		"rdb_bgsave_in_progress":      boolInt(state.bgsaveRunning.Load()),
+		"rdb_last_save_time":          fmt.Sprint(state.rdbStats.rdb_last_save_ts.Load()),
+		"rdb_saves":                   fmt.Sprint(state.rdbStats.rdb_saves.Load()),
+		"rdb_last_bgsave_status":      okOrErr(state.rdbStats.rdb_last_bgsave_err.Load()),
+		"rdb_last_bgsave_time_sec":    fmt.Sprint(state.rdbStats.rdb_last_bgsave_time_sec.Load()),
+		"rdb_current_bgsave_time_sec": fmt.Sprint(bgsaveTime),
+		"aof_enabled":                 boolInt(state.conf.aofEnabled),
+		"aof_rewrite_in_progress":     boolInt(state.aofRewriteRunning.Load()),
+		"aof_rewrites":                fmt.Sprint(state.aofStats.aof_rewrites.Load()),
+		"aof_last_bgrewrite_status":   okOrErr(state.aofStats.aof_last_bgrewrite_err.Load()),
+		"aof_last_write_status":       okOrErr(state.aofStats.aof_last_write_err.Load()),
+	}
+	if state.conf.aofEnabled {
+		info.persistence["aof_current_size"] = fmt.Sprint(state.aofStats.aof_current_size.Load())
+		info.persistence["aof_base_size"] = fmt.Sprint(state.aofStats.aof_base_size.Load())
 	}
+	state.loading.info(info.persistence)
 
+	stats := &state.generalStats
 	info.general = map[string]string{
-		"total_connections_received": fmt.Sprint(state.generalStats.total_connections_received),
-		"total_commands_processed":   fmt.Sprint(state.generalStats.total_commands_processed),
-		"evicted_keys":               fmt.Sprint(state.generalStats.evicted_keys),
-		"expired_keys":               fmt.Sprint(state.generalStats.expired_keys),
+		"total_connections_received": fmt.Sprint(stats.total_connections_received.Load()),
+		"rejected_connections":       fmt.Sprint(stats.rejected_connections.Load()),
+		"total_commands_processed":   fmt.Sprint(stats.total_commands_processed.Load()),
+		"evicted_keys":               fmt.Sprint(stats.evicted_keys.Load()),
+		"expired_keys":               fmt.Sprint(stats.expired_keys.Load()),
+
+		"client_output_buffer_limit_disconnections": fmt.Sprint(stats.client_output_buffer_limit_disconnections.Load()),
+
+		"acl_access_denied_auth": fmt.Sprint(stats.acl_access_denied_auth.Load()),
+		"acl_access_denied_cmd":  fmt.Sprint(stats.acl_access_denied_cmd.Load()),
+		"acl_access_denied_key":  fmt.Sprint(stats.acl_access_denied_key.Load()),
+		"auth_rate_limited":      fmt.Sprint(stats.auth_rate_limited.Load()),
+		"auth_blocked_sources":   fmt.Sprint(state.authAudit.blockedSources()),
 	}
+	return info
 }
 
-func (info *Info) print(state *AppState) string {
-	info.build(state)
-
+func (info *Info) String() string {
 	var msg string = ""
 
 	printCategory := func(header string, m map[string]string) string {
@@ -95,3 +123,18 @@ func (info *Info) print(state *AppState) string {
 
 	return msg
 }
+
+// redis prints flags as 0 or 1
+func boolInt(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func okOrErr(failed bool) string {
+	if failed {
+		return "err"
+	}
+	return "ok"
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// concurrent INFOs used to share the section maps on AppState, run with -race
+func TestConcurrentInfo(t *testing.T) {
+	addr := startTestServer(t, NewAppState(NewConfig()))
+
+	t.Run("clients", func(t *testing.T) {
+		for i := range 4 {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+
+				tc := dialTest(t, addr)
+				for j := range 50 {
+					tc.do(t, "SET", fmt.Sprintf("info:%d", i), fmt.Sprint(j))
+					reply := tc.do(t, "INFO")
+					if !strings.Contains(reply, "\nloading:0\n") || !strings.Contains(reply, "\naof_enabled:0\n") {
+						t.Fatalf("INFO doesn't report flags as 0/1:\n%s", reply)
+					}
+				}
+			})
+		}
+	})
+}
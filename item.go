@@ -1,18 +1,49 @@
 package main
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
+// V and exp only change while DB.mu is locked, through DB.mutable once a snapshot may read the item
 type Item struct {
-	V          string
-	exp        time.Time
-	LastAccess time.Time
-	Accesses   int
+	V     string
+	exp   time.Time
+	epoch uint64 // DB.epoch when the item was created, see DB.shared
+
+	// LRU/LFU metadata, readers holding DB.mu.RLock update it concurrently
+	lastAccess atomic.Int64 // unix nanoseconds, 0 if never accessed
+	accesses   atomic.Int64
 }
 
 func (i *Item) shouldExpire() bool {
 	return (i.exp.Unix() != UNIX_TS_EPOCH && time.Until(i.exp).Seconds() <= 0)
 }
 
+func (i *Item) LastAccess() time.Time {
+	ns := i.lastAccess.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (i *Item) Accesses() int {
+	return int(i.accesses.Load())
+}
+
+func (i *Item) touch() {
+	i.accesses.Add(1)
+	i.lastAccess.Store(time.Now().UnixNano())
+}
+
+func (i *Item) clone() *Item {
+	cp := &Item{V: i.V, exp: i.exp, epoch: i.epoch}
+	cp.lastAccess.Store(i.lastAccess.Load())
+	cp.accesses.Store(i.accesses.Load())
+	return cp
+}
+
 func (k *Item) approxMemUsage(name string) int64 {
 	stringHeader := 16
 	expHeader := 24
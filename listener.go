@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// opens a TCP listener per bind address for port and tls-port, plus the unix socket when configured
+// addresses prefixed with "-" are optional, failing to bind them is only logged
+func openListeners(conf *Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	if conf.port > 0 {
+		ls, err := listenBind(conf.bind, conf.port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ls...)
+	}
+
+	if conf.tlsPort > 0 {
+		certs, err := NewTLSCerts(conf)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+
+		ls, err := listenBind(conf.bind, conf.tlsPort)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+
+		for _, l := range ls {
+			log.Println("serving TLS on", l.Addr().String())
+			listeners = append(listeners, tls.NewListener(l, certs.ServerConfig()))
+		}
+	}
+
+	if conf.unixsocket != "" {
+		l, err := listenUnix(conf.unixsocket, conf.unixsocketPerm)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+
+		log.Println("listening on unix socket", conf.unixsocket)
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listening sockets configured")
+	}
+
+	return listeners, nil
+}
+
+func listenBind(bind []string, port int) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	for _, addr := range bind {
+		optional := strings.HasPrefix(addr, "-")
+		addr = strings.TrimPrefix(addr, "-")
+
+		l, err := listenTCP(addr, port)
+		if err != nil {
+			if optional {
+				log.Printf("skipping optional bind address %s: %v", addr, err)
+				continue
+			}
+			closeListeners(listeners)
+			return nil, err
+		}
+
+		log.Println("listening on", l.Addr().String())
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// "*" binds every IPv4 interface and "::*" every IPv6 one, like redis
+func listenTCP(addr string, port int) (net.Listener, error) {
+	network := "tcp4"
+	switch {
+	case addr == "*":
+		addr = "0.0.0.0"
+	case addr == "::*":
+		addr = "::"
+		network = "tcp6"
+	case strings.Contains(addr, ":"):
+		network = "tcp6"
+	}
+
+	l, err := net.Listen(network, net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s port %d: %w", addr, port, err)
+	}
+	return l, nil
+}
+
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	os.Remove(path) // stale socket left behind by a previous run
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on unix socket %s: %w", path, err)
+	}
+
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("cannot set unix socket permissions: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// the socket under a TLS session, used for socket options like keepalive
+func rawConn(conn net.Conn) net.Conn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.NetConn()
+	}
+	return conn
+}
+
+// unix socket and loopback connections are local, anything else is not
+func isLocalConn(conn net.Conn) bool {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
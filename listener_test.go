@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// serves every listener openListeners returned until the test ends
+func serveListeners(t *testing.T, conf *Config) []net.Listener {
+	t.Helper()
+
+	listeners, err := openListeners(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeListeners(listeners) })
+
+	state := NewAppState(conf)
+	for _, l := range listeners {
+		go acceptConns(l, state)
+	}
+	return listeners
+}
+
+func TestListenMultipleAddresses(t *testing.T) {
+	conf := NewConfig()
+	conf.port = freePort(t)
+	// 192.0.2.1 is TEST-NET-1, not assigned to any interface, so the optional bind is skipped
+	conf.bind = []string{"127.0.0.1", "127.0.0.2", "-192.0.2.1"}
+
+	listeners := serveListeners(t, conf)
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		tc := dialTest(t, net.JoinHostPort(host, strconv.Itoa(conf.port)))
+		if got := tc.do(t, "CLIENT", "INFO"); got == "" || got[0] == '-' {
+			t.Fatalf("CLIENT INFO through %s replied %q", host, got)
+		}
+	}
+
+	// a required address that can't be bound fails the whole set, closing what was opened
+	conf.bind = []string{"127.0.0.1", "192.0.2.1"}
+	conf.port = freePort(t)
+	if _, err := openListeners(conf); err == nil {
+		t.Fatal("binding an address that doesn't exist succeeded")
+	}
+	l, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(conf.port)))
+	if err != nil {
+		t.Fatalf("the listener opened before the failure was left open: %v", err)
+	}
+	l.Close()
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	conf := NewConfig()
+	conf.port = 0 // unix socket only
+	conf.unixsocket = filepath.Join(t.TempDir(), "redis.sock")
+	conf.unixsocketPerm = 0o700
+
+	// a socket file left behind by a previous run must not stop the server from starting
+	stale, err := net.Listen("unix", conf.unixsocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	if listeners := serveListeners(t, conf); len(listeners) != 1 {
+		t.Fatalf("got %d listeners, want the unix socket only", len(listeners))
+	}
+
+	fi, err := os.Stat(conf.unixsocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o700 {
+		t.Fatalf("the socket has mode %v, want a socket with 0700", fi.Mode())
+	}
+
+	conn, err := net.Dial("unix", conf.unixsocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// unix socket clients are local, protected mode lets them in without a password
+	tc := &testConn{Conn: conn, r: bufio.NewReader(conn)}
+	if got := tc.do(t, "DBSIZE"); got == "" || got[0] != ':' {
+		t.Fatalf("DBSIZE over the unix socket replied %q", got)
+	}
+}
+
+func TestNoListeners(t *testing.T) {
+	conf := NewConfig()
+	conf.port = 0
+	if _, err := openListeners(conf); err == nil {
+		t.Fatal("opening no listeners succeeded")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// progress of loading the AOF and the RDB file at startup, reported by INFO
+type Loading struct {
+	loading    atomic.Bool // commands not flagged loading get -LOADING while it's set
+	start      time.Time
+	totalBytes int64
+	loaded     atomic.Int64 // bytes read from the files so far
+	pending    atomic.Int64 // keys read from an RDB that the dataset doesn't have yet
+}
+
+// the server listens while it loads, so health checks see it up. the dataset is only saved
+// once it's complete: save points start at the end, and BGSAVE and the like get -LOADING
+//
+// like redis with appendonly the AOF alone is the dataset, its base holds what a snapshot would.
+// the RDB file may be older than the AOF, loading it too would bring back stale values and deleted keys
+func (state *AppState) load() {
+	if state.conf.aofEnabled {
+		log.Println("syncing AOF records")
+		state.aof.Sync(state)
+	} else if len(state.conf.rdb) > 0 {
+		SyncRDB(state)
+	}
+
+	// only after everything is loaded: a command later in the AOF may extend a key its base has as expired
+	if n := DB.deleteExpired(); n > 0 {
+		log.Printf("deleted %d keys that expired while the server was down", n)
+	}
+
+	// replaying the AOF ran its writes, the loaded dataset is what's on disk
+	state.rdbStats.rdb_changes_since_last_save.Store(0)
+
+	// before clients can write: every write counts its keys in the trackers
+	if len(state.conf.rdb) > 0 {
+		InitRDBTrackers(state)
+	}
+
+	state.loading.end()
+	log.Printf("DB loaded from disk: %.3f seconds", time.Since(state.loading.start).Seconds())
+}
+
+// the AOF is sized when it's opened, the snapshot is stat'ed when it's what gets loaded
+func (l *Loading) begin(state *AppState) {
+	var total int64
+	if state.conf.aofEnabled {
+		total = state.aofStats.aof_current_size.Load()
+	} else if len(state.conf.rdb) > 0 {
+		if fi, err := os.Stat(path.Join(state.conf.dir, state.conf.rdbFn)); err == nil {
+			total = fi.Size()
+		}
+	}
+
+	l.start = time.Now()
+	l.totalBytes = total
+	l.loaded.Store(0)
+	l.loading.Store(true)
+}
+
+func (l *Loading) end() {
+	l.loading.Store(false)
+}
+
+// counts a key read from an RDB, it's loaded into an empty keyspace so every key is new
+func (l *Loading) read(k string) {
+	l.pending.Add(1)
+}
+
+// adds keys read from an RDB to the dataset, which must still be empty
+func (l *Loading) merge(store map[string]*Item) error {
+	err := DB.load(store)
+	l.pending.Store(0)
+	return err
+}
+
+// keys in the dataset so far, counting those of an RDB still being read
+func (l *Loading) keys() int64 {
+	DB.mu.RLock()
+	n := len(DB.store)
+	DB.mu.RUnlock()
+	return int64(n) + l.pending.Load()
+}
+
+// adds the loading fields to INFO persistence, the progress ones only while loading like redis
+func (l *Loading) info(m map[string]string) {
+	m["loading"] = boolInt(l.loading.Load())
+	if !l.loading.Load() {
+		return
+	}
+
+	loaded := l.loaded.Load()
+	elapsed := time.Since(l.start).Seconds()
+	perc, eta := 0.0, 1.0 // redis reports an ETA of 1s until something is read
+	if l.totalBytes > 0 {
+		perc = float64(loaded) / float64(l.totalBytes) * 100
+	}
+	if loaded > 0 {
+		eta = max(0, float64(l.totalBytes-loaded)/(float64(loaded)/elapsed))
+	}
+
+	m["loading_start_time"] = fmt.Sprint(l.start.Unix())
+	m["loading_total_bytes"] = fmt.Sprint(l.totalBytes)
+	m["loading_loaded_bytes"] = fmt.Sprint(loaded)
+	m["loading_loaded_perc"] = fmt.Sprintf("%.2f", perc)
+	m["loading_loaded_keys"] = fmt.Sprint(l.keys())
+	m["loading_eta_seconds"] = fmt.Sprint(int64(eta))
+}
+
+// counts the bytes read from a file being loaded
+type progressReader struct {
+	r      io.Reader
+	loaded *atomic.Int64
+}
+
+func (pr progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.loaded.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadingReplies(t *testing.T) {
+	conf := NewConfig()
+	conf.dir = t.TempDir()
+	conf.rdbFn = "dump.rdb"
+	conf.rdb = []RDBSnapshot{{Secs: 900, KeysChanged: 1}}
+	state := NewAppState(conf)
+	state.loading.begin(state)
+
+	tc := dialTest(t, startTestServer(t, state))
+	if got := tc.do(t, "SET", "loading:k", "v"); got != "-"+ErrLoading.Error() {
+		t.Fatalf("SET while loading replied %q", got)
+	}
+	if got := tc.do(t, "INFO"); !strings.Contains(got, "\nloading:1\n") {
+		t.Fatalf("INFO while loading doesn't report it:\n%s", got)
+	}
+
+	// writes right as loading ends count their keys in the save point trackers, run with -race
+	done := make(chan struct{})
+	go func() {
+		state.load()
+		close(done)
+	}()
+	for {
+		got := tc.do(t, "SET", "loading:k", "v")
+		if got == "+OK" {
+			break
+		}
+		if got != "-"+ErrLoading.Error() {
+			t.Fatalf("SET replied %q", got)
+		}
+	}
+	<-done
+
+	if got := tc.do(t, "INFO"); !strings.Contains(got, "\nloading:0\n") {
+		t.Fatalf("INFO after loading still reports it:\n%s", got)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "errors"
+
+// LZF, the compression redis uses for RDB strings. the format is a sequence of
+// literal runs (ctrl < 32: ctrl+1 bytes follow) and back references
+// (ctrl >> 5 is the length - 2, 7 meaning another length byte follows,
+// the low 5 bits and the next byte are the distance - 1)
+
+const (
+	lzfHashLog = 14
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+var errLzfCorrupt = errors.New("invalid LZF compressed string")
+
+// returns nil when the input doesn't get smaller
+func lzfCompress(in []byte) []byte {
+	if len(in) < 4 {
+		return nil
+	}
+
+	var htab [1 << lzfHashLog]int32 // last position + 1 of each 3 byte sequence
+
+	out := make([]byte, 1, len(in)) // starts with the control byte of the first literal run
+	lit := 0
+
+	literal := func(b byte) {
+		out = append(out, b)
+		lit++
+		if lit == lzfMaxLit {
+			out[len(out)-lit-1] = byte(lit - 1)
+			out = append(out, 0)
+			lit = 0
+		}
+	}
+
+	ip := 0
+	for ip+2 < len(in) {
+		if len(out) >= len(in) {
+			return nil
+		}
+
+		h := uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])
+		h = (h * 2654435761) >> (32 - lzfHashLog)
+		ref := int(htab[h]) - 1
+		htab[h] = int32(ip + 1)
+
+		off := ip - ref - 1
+		if ref < 0 || off >= lzfMaxOff || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			literal(in[ip])
+			ip++
+			continue
+		}
+
+		n := 3
+		for limit := min(len(in)-ip, lzfMaxRef); n < limit && in[ref+n] == in[ip+n]; n++ {
+		}
+
+		// close the literal run, or drop its control byte if it's empty
+		if lit > 0 {
+			out[len(out)-lit-1] = byte(lit - 1)
+		} else {
+			out = out[:len(out)-1]
+		}
+
+		if l := n - 2; l < 7 {
+			out = append(out, byte(off>>8)|byte(l<<5))
+		} else {
+			out = append(out, byte(off>>8)|7<<5, byte(l-7))
+		}
+		out = append(out, byte(off), 0)
+		lit = 0
+		ip += n
+	}
+
+	for ; ip < len(in); ip++ {
+		literal(in[ip])
+	}
+
+	if lit > 0 {
+		out[len(out)-lit-1] = byte(lit - 1)
+	} else {
+		out = out[:len(out)-1]
+	}
+
+	if len(out) >= len(in) {
+		return nil
+	}
+	return out
+}
+
+// n is the uncompressed length, stored next to the data in the RDB
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < lzfMaxLit {
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > n {
+				return nil, errLzfCorrupt
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		l := ctrl >> 5
+		if l == 7 {
+			if ip >= len(in) {
+				return nil, errLzfCorrupt
+			}
+			l += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLzfCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		l += 2
+
+		if ref < 0 || len(out)+l > n {
+			return nil, errLzfCorrupt
+		}
+		// byte by byte, the reference may overlap what it produces
+		for i := range l {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != n {
+		return nil, errLzfCorrupt
+	}
+	return out, nil
+}
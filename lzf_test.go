@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestLzfRoundtrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 4096)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+
+	inputs := map[string][]byte{
+		"repeated":        []byte(strings.Repeat("a", 1000)),
+		"pattern":         []byte(strings.Repeat("0123456789", 500)),
+		"long references": []byte(strings.Repeat("x", lzfMaxRef*3+5)),
+		"far references":  bytes.Repeat(random[:1024], 3),
+		"text":            []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 40)),
+	}
+	for name, in := range inputs {
+		c := lzfCompress(in)
+		if c == nil {
+			t.Errorf("%s: didn't compress", name)
+			continue
+		}
+		if len(c) >= len(in) {
+			t.Errorf("%s: compressed %d bytes to %d", name, len(in), len(c))
+		}
+		out, err := lzfDecompress(c, len(in))
+		if err != nil || !bytes.Equal(out, in) {
+			t.Errorf("%s: decompressed to %d bytes, %v", name, len(out), err)
+		}
+	}
+
+	// nothing to gain, the caller stores these as they are
+	for _, in := range [][]byte{random, []byte("abc"), nil} {
+		if c := lzfCompress(in); c != nil {
+			t.Errorf("%d incompressible bytes compressed to %d", len(in), len(c))
+		}
+	}
+}
+
+func TestLzfRejectsCorruptInput(t *testing.T) {
+	in := []byte(strings.Repeat("abcdefgh", 100))
+	c := lzfCompress(in)
+
+	cases := map[string]struct {
+		in []byte
+		n  int
+	}{
+		"wrong length":           {c, len(in) - 1},
+		"longer than stated":     {c, len(in) + 1},
+		"truncated":              {c[:len(c)-1], len(in)},
+		"literal past the end":   {[]byte{5, 'a', 'b'}, 6},
+		"reference before start": {[]byte{0, 'a', 1 << 5, 4}, 4},
+		"cut in a reference":     {[]byte{0, 'a', 1 << 5}, 4},
+	}
+	for name, tc := range cases {
+		if _, err := lzfDecompress(tc.in, tc.n); !errors.Is(err, errLzfCorrupt) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
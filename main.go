@@ -1,90 +1,144 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"errors"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 const UNIX_TS_EPOCH int64 = -62135596800 // this is the unix timestamp of 1970-01-01 00:00:00 UTC, used to check if a key has expired
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(checkAof(os.Args[2:]))
+	}
+
 	log.Println("reading conf file")
 	conf := readConf("./redis.conf")
+	writePidfile(conf)
 
 	state := NewAppState(conf)
+	state.loading.begin(state)
 
-	if conf.aofEnabled {
-		log.Println("syncing AOF records")
-		state.aof.Sync(conf.maxmem, conf.eviction, conf.maxmemSamples)
+	if conf.timeout > 0 {
+		go state.closeIdleClients()
 	}
 
-	if len(conf.rdb) > 0 {
-		SyncRDB(conf)
-		InitRDBTrackers(state)
-	}
-
-	l, err := net.Listen("tcp", ":6379")
+	listeners, err := openListeners(conf)
 	if err != nil {
-		log.Fatal("cannot connect on port :6379")
+		removePidfile(conf)
+		log.Fatal(err)
 	}
-	defer l.Close()
-	log.Println("listening on :6379")
+	state.listeners = listeners
+	go handleSignals(state)
 
 	var wg sync.WaitGroup // wait group to prevent pre-mature closing of main loop
 
+	for _, l := range listeners {
+		wg.Add(1) // incrementing the start of a routine
+		go func() {
+			acceptConns(l, state)
+			wg.Done()
+		}()
+	}
+
+	go state.load()
+	wg.Wait()
+
+	// the listeners only close on shutdown, which lets main return once clients are drained
+	<-state.exited
+}
+
+func acceptConns(l net.Listener, state *AppState) {
+	conf := state.conf
+
 	for { // infinite loop to accept connections
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			if errors.Is(err, net.ErrClosed) {
+				return // closed by shutdown
+			}
+			// e.g. out of file descriptors, retrying right away would just spin
+			log.Println("cannot accept connection: ", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
 		}
 		log.Println("connection accepted")
 
-		wg.Add(1) // incrementing the start of a routine
-		go func() {
-			handleConn(conn, state)
-			wg.Done()
-		}()
+		if !state.reserveClient() {
+			log.Println("rejecting connection, max number of clients reached: ", conn.RemoteAddr().String())
+			state.generalStats.rejected_connections.Add(1)
+			rejectConn(conn, ErrMaxClients)
+			continue
+		}
+
+		// without a password only loopback and unix socket clients are let in
+		if conf.protectedMode && state.acl.defaultNoPass() && !isLocalConn(conn) {
+			log.Println("rejecting non-local connection in protected mode: ", conn.RemoteAddr().String())
+			state.generalStats.rejected_connections.Add(1)
+			rejectConn(conn, ErrProtectedMode)
+			state.releaseClient()
+			continue
+		}
+
+		if tcp, ok := rawConn(conn).(*net.TCPConn); ok && conf.tcpKeepalive > 0 {
+			tcp.SetKeepAlive(true)
+			tcp.SetKeepAlivePeriod(time.Duration(conf.tcpKeepalive) * time.Second)
+		}
+
+		go handleConn(conn, state)
 	}
-	wg.Wait() // won't matter since infinite loop
+}
+
+// how long a rejected client gets to take its error reply
+const rejectTimeout = time.Second
+
+// replies with err and closes conn. On TLS the write runs the handshake, a client that never
+// sends its hello would block it, so it's done off the accept loop and under a deadline
+func rejectConn(conn net.Conn, err error) {
+	go func() {
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		conn.Write([]byte("-" + err.Error() + "\r\n"))
+		conn.Close()
+	}()
 }
 
 func handleConn(conn net.Conn, state *AppState) {
 	log.Println("accepted new connections: ", conn.LocalAddr().String())
 
-	c := NewClient(conn)
-	r := bufio.NewReader(conn)
+	c := NewClient(conn, state)
+	go c.out.writeLoop(conn)
 
-	// removing client from monitor array
-	defer func() {
-		new := state.monitors[:0]
-		for _, mon := range state.monitors {
-			if mon != c {
-				new = append(new, mon)
-			}
-		}
-		state.monitors = new
-	}()
+	state.addClient(c)
+	defer state.removeClient(c)
 
-	state.clientCount++
+	defer state.removeMonitor(c)
 
-	defer func() {
-		state.clientCount--
-	}()
-
-	state.generalStats.total_connections_received++
+	state.generalStats.total_connections_received.Add(1)
 
 	for {
 		v := Value{typ: ARRAY}
-		if err := v.readArray(r); err != nil {
+		if err := v.readArray(c.r, state.conf.maxBulkLen); err != nil {
 			log.Println(err)
+			// like redis a malformed length gets a protocol error, then the connection is closed
+			if errors.Is(err, ErrProtoBulkLen) || errors.Is(err, ErrProtoMultiLen) {
+				c.reply(errReply(err))
+			}
 			break
 		}
+		if len(v.array) == 0 {
+			continue // redis ignores empty arrays
+		}
 		handle(c, &v, state)
+
+		if c.closeAfterReply || state.exiting.Load() {
+			break
+		}
 	}
+	c.flush()
+	c.out.Close() // writeLoop drains the remaining replies and closes conn
 	log.Println("connection closed: ", conn.LocalAddr().String())
 }
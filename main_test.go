@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) // every connection logs a few lines
+	os.Exit(m.Run())
+}
+
+// serves state on a loopback port until the test ends
+func startTestServer(tb testing.TB, state *AppState) string {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+
+	go acceptConns(l, state)
+	return l.Addr().String()
+}
+
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialTest(tb testing.TB, addr string) *testConn {
+	tb.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// sends a command without waiting for its reply
+func (tc *testConn) send(tb testing.TB, args ...string) {
+	tb.Helper()
+
+	w := NewWriter(tc.Conn)
+	v := Value{typ: ARRAY}
+	for _, a := range args {
+		v.array = append(v.array, Value{typ: BULK, bulk: a})
+	}
+	w.Write(&v)
+	if err := w.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// sends a command and returns its reply line, the contents for a bulk string
+func (tc *testConn) do(tb testing.TB, args ...string) string {
+	tb.Helper()
+
+	tc.send(tb, args...)
+	return tc.reply(tb)
+}
+
+// reads the next reply line, the contents for a bulk string
+func (tc *testConn) reply(tb testing.TB) string {
+	tb.Helper()
+
+	line, err := readLine(tc.r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(line) == 0 || line[0] != '$' || line == "$-1" {
+		return line
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(tc.r, buf); err != nil {
+		tb.Fatal(err)
+	}
+	return string(buf[:n])
+}
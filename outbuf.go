@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type ClientClass string
+
+const (
+	ClassNormal  ClientClass = "normal"
+	ClassReplica ClientClass = "replica"
+	ClassPubSub  ClientClass = "pubsub"
+)
+
+// client-output-buffer-limit <class> <hard> <soft> <soft-seconds>
+// a client is dropped as soon as it reaches the hard limit, or once it
+// stays over the soft limit for soft-seconds. zero disables a limit
+type OutputBufferLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int
+}
+
+// pending replies of a client, filled by any goroutine (its own handler,
+// monitor fan-out) and drained to the socket by the client's writeLoop
+// so a slow consumer never blocks the goroutine producing its output
+type OutputBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	inflight  int       // bytes taken by writeLoop but not yet written to the socket
+	softSince time.Time // when the buffer first went over the soft limit
+	closed    bool
+	wake      chan struct{}
+	wmu       sync.Mutex // held while writing to the socket
+	spare     []byte     // last written buffer, reused to avoid reallocating
+
+	limit   func() OutputBufferLimit // limits of the client's current class
+	onLimit func(size int)           // called once when the client is dropped for going over
+}
+
+func NewOutputBuffer() *OutputBuffer {
+	return &OutputBuffer{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// appends p and wakes the writer, disconnecting the client if it went over its limits
+func (ob *OutputBuffer) Write(p []byte) (int, error) {
+	ob.mu.Lock()
+	if ob.closed {
+		ob.mu.Unlock()
+		return len(p), nil // client is going away, its output is dropped
+	}
+
+	ob.buf = append(ob.buf, p...)
+	size := int64(len(ob.buf) + ob.inflight)
+
+	if ob.overLimit(size) {
+		ob.closed = true
+		ob.buf = nil
+		ob.mu.Unlock()
+
+		if ob.onLimit != nil {
+			ob.onLimit(int(size))
+		}
+		return len(p), nil
+	}
+
+	ob.signal()
+	ob.mu.Unlock()
+	return len(p), nil
+}
+
+// must be called with ob.mu held
+func (ob *OutputBuffer) overLimit(size int64) bool {
+	if ob.limit == nil {
+		return false
+	}
+	limit := ob.limit()
+
+	if limit.hard > 0 && size >= limit.hard {
+		return true
+	}
+
+	if limit.soft > 0 && size >= limit.soft {
+		if ob.softSince.IsZero() {
+			ob.softSince = time.Now()
+			return false
+		}
+		return time.Since(ob.softSince) > time.Duration(limit.softSeconds)*time.Second
+	}
+
+	ob.softSince = time.Time{}
+	return false
+}
+
+// must be called with ob.mu held
+func (ob *OutputBuffer) signal() {
+	select {
+	case ob.wake <- struct{}{}:
+	default: // writer already has a pending wake up
+	}
+}
+
+// bytes waiting to reach the socket
+func (ob *OutputBuffer) Len() int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return len(ob.buf) + ob.inflight
+}
+
+// stops accepting output, writeLoop still drains what is already queued
+func (ob *OutputBuffer) Close() {
+	ob.mu.Lock()
+	ob.closed = true
+	ob.signal()
+	ob.mu.Unlock()
+}
+
+// writes everything queued so far to conn, serialized by wmu so concurrent
+// drains can't reorder output
+func (ob *OutputBuffer) drain(conn net.Conn) error {
+	ob.wmu.Lock()
+	defer ob.wmu.Unlock()
+
+	ob.mu.Lock()
+	if len(ob.buf) == 0 {
+		ob.mu.Unlock()
+		return nil
+	}
+	data := ob.buf
+	ob.buf = ob.spare[:0]
+	ob.spare = nil
+	ob.inflight = len(data)
+	ob.mu.Unlock()
+
+	_, err := conn.Write(data)
+
+	ob.mu.Lock()
+	ob.inflight = 0
+	ob.mu.Unlock()
+	ob.spare = data
+
+	return err
+}
+
+// drains the buffer to conn until the buffer is closed and empty, then closes conn
+func (ob *OutputBuffer) writeLoop(conn net.Conn) {
+	defer conn.Close()
+
+	for range ob.wake {
+		if err := ob.drain(conn); err != nil {
+			log.Println("cannot write to client: ", err)
+			ob.Close()
+			return
+		}
+
+		ob.mu.Lock()
+		done := ob.closed && len(ob.buf) == 0
+		ob.mu.Unlock()
+
+		if done {
+			return
+		}
+	}
+}
@@ -3,30 +3,33 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type SnapshotTracker struct {
-	keys   int
+	keys   atomic.Int64 // changed keys, counted by writers under DB.mu and reset by the tracker
 	ticker time.Ticker
 	rdb    *RDBSnapshot
 }
 
 func NewSnapshotTracker(rdb *RDBSnapshot) *SnapshotTracker {
 	return &SnapshotTracker{
-		keys:   0,
 		ticker: *time.NewTicker(time.Second * time.Duration(rdb.Secs)),
 		rdb:    rdb,
 	}
 }
 
+// filled once at the end of loading, before clients may write, and only read afterwards
 var trackers = []*SnapshotTracker{}
 
 func InitRDBTrackers(state *AppState) {
@@ -38,101 +41,233 @@ func InitRDBTrackers(state *AppState) {
 			defer tracker.ticker.Stop()
 
 			for range tracker.ticker.C {
-				if tracker.keys >= tracker.rdb.KeysChanged {
-					log.Printf("keys changed: %d - keys required to change: %d", tracker.keys, tracker.rdb.KeysChanged)
-					SaveRDB(state)
+				if keys := tracker.keys.Load(); keys >= int64(tracker.rdb.KeysChanged) {
+					log.Printf("keys changed: %d - keys required to change: %d", keys, tracker.rdb.KeysChanged)
+					save, ok := startBgsave(state)
+					if !ok {
+						continue // a BGSAVE is running, retry on the next tick
+					}
+					if err := save(); err != nil {
+						continue // keeping the count retries on the next tick
+					}
 				}
-				tracker.keys = 0
+				tracker.keys.Store(0)
 			}
 		}()
 	}
 }
 
-func IncrRDBTrackers() {
+func IncrRDBTrackers(n int) {
 	for _, t := range trackers {
-		t.keys++
+		t.keys.Add(int64(n))
 	}
 }
 
-func SaveRDB(state *AppState) {
-	fp := path.Join(state.conf.dir, state.conf.rdbFn)
-	f, err := os.Open(fp)
+// one snapshot is written at a time, they share the temp file
+var rdbSaveMu sync.Mutex
+
+// freezes the dataset for a background save, false if one is already running.
+// the returned func writes the snapshot and must be called exactly once
+func startBgsave(state *AppState) (save func() error, ok bool) {
+	if !state.bgsaveRunning.CompareAndSwap(false, true) {
+		return nil, false
+	}
+
+	// taken now so the snapshot is the dataset at the time of the BGSAVE, writers go on
+	// while it's encoded without changing what it sees. the changes are read first, one made
+	// in between is saved but still counted, never the other way around
+	changes := state.rdbStats.rdb_changes_since_last_save.Load()
+	store, release := DB.snapshot()
+	state.rdbStats.rdb_bgsave_start.Store(time.Now().UnixNano())
+	return func() error {
+		defer state.bgsaveRunning.Store(false)
+		defer release()
+
+		err := SaveRDB(state, store, changes)
+		state.rdbStats.rdb_last_bgsave_time_sec.Store(int64(time.Since(time.Unix(0, state.rdbStats.rdb_bgsave_start.Load())).Seconds()))
+		return err
+	}, true
+}
+
+// writes store, or the live dataset if it's nil, to temp-<pid>.rdb and renames it over
+// dbfilename once it's on disk and verified, so a failed save leaves the previous snapshot intact.
+// changes is rdb_changes_since_last_save read before store was taken, a successful save takes them
+// off it. for the live dataset they're read here
+func SaveRDB(state *AppState, store map[string]*Item, changes int64) error {
+	rdbSaveMu.Lock()
+	defer rdbSaveMu.Unlock()
+
+	if store == nil {
+		changes = state.rdbStats.rdb_changes_since_last_save.Load()
+	}
+	err := saveRDB(state, store)
 	if err != nil {
-		fmt.Println("error opening rdb file: ", err)
-		f.Close()
-		return
+		log.Println("rdb - save failed: ", err)
+		state.rdbStats.rdb_last_bgsave_err.Store(true)
+		return err
 	}
 
-	defer f.Close()
+	log.Println("saved RDB file")
+
+	state.rdbStats.rdb_changes_since_last_save.Add(-changes)
+	state.rdbStats.rdb_last_bgsave_err.Store(false)
+	state.rdbStats.rdb_last_save_ts.Store(time.Now().Unix())
+	state.rdbStats.rdb_saves.Add(1)
+	return nil
+}
 
+func saveRDB(state *AppState, store map[string]*Item) error {
 	var buf bytes.Buffer
-	if state.bgsaveRunning {
-		err = gob.NewEncoder(&buf).Encode(&state.dbCopy)
+	var w io.Writer = &buf
+
+	// an encrypted snapshot is also decrypted back after it's written, its plaintext has to match
+	keys := state.conf.keys
+	var enc *encWriter
+	psum := sha256.New()
+	if keys.enabled() {
+		enc = newEncWriter(&buf, keys.cur, 0, true)
+		w = io.MultiWriter(enc, psum)
+	}
+
+	var err error
+	if store != nil {
+		err = writeRDB(w, store, state.conf, false)
 	} else {
 		DB.mu.RLock()
-		err = gob.NewEncoder(&buf).Encode(&DB.store) // since we lock the file here for writers, other clients can't put data into it, better to use 'BGSAVE'
+		err = writeRDB(w, DB.store, state.conf, false) // since we lock the file here for writers, other clients can't put data into it, better to use 'BGSAVE'
 		DB.mu.RUnlock()
 	}
+	if err == nil && enc != nil {
+		err = enc.seal()
+	}
 
 	if err != nil {
-		fmt.Println("error encoding rdb file: ", err)
-		return
+		return fmt.Errorf("cannot encode rdb file: %w", err)
 	}
 
 	data := buf.Bytes()
 	bsum, err := Hash(&buf)
 	if err != nil {
-		log.Println("rdb - cannot compute buf checksum: ", err)
-		return
+		return fmt.Errorf("cannot compute buf checksum: %w", err)
 	}
 
-	_, err = f.Write(data)
+	tmp := path.Join(state.conf.dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 	if err != nil {
-		log.Println("rdb - cannot write to file: ", err)
-		return
+		return fmt.Errorf("cannot open temp rdb file: %w", err)
+	}
+
+	if err := writeVerified(f, data, bsum); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if enc != nil {
+		if err := verifyDecrypted(f, keys, hex.EncodeToString(psum.Sum(nil))); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot close temp rdb file: %w", err)
+	}
+
+	if err := os.Rename(tmp, path.Join(state.conf.dir, state.conf.rdbFn)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot rename temp rdb file: %w", err)
+	}
+	return fsyncDir(state.conf.dir)
+}
+
+// writes data, fsyncs it and reads it back to compare checksums
+func writeVerified(f *os.File, data []byte, bsum string) error {
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("cannot write to file: %w", err)
 	}
 
 	if err := f.Sync(); err != nil { // to prevent the os from keeping it in buffer temporarily
-		log.Println("rdb - cannot flush file to disk: ", err)
-		return
+		return fmt.Errorf("cannot flush file to disk: %w", err)
 	}
 
 	if _, err := f.Seek(0, io.SeekStart); err != nil { // moving file ptr to beginning to calculate checksum
-		log.Println("rdb - cannot seek file: ", err)
-		return
+		return fmt.Errorf("cannot seek file: %w", err)
 	}
 
 	fsum, err := Hash(f)
 	if err != nil {
-		log.Println("rdb - cannot compute file checksum: ", err)
-		return
+		return fmt.Errorf("cannot compute file checksum: %w", err)
 	}
 
 	if bsum != fsum {
-		log.Printf("rdb - buf and file checksums do not match:\nf=%s\nb=%s\n", fsum, bsum)
-		return
+		return fmt.Errorf("buf and file checksums do not match:\nf=%s\nb=%s", fsum, bsum)
 	}
+	return nil
+}
 
-	log.Println("saved RDB file")
+// reads an encrypted file back from the start and compares the checksum of its plaintext
+func verifyDecrypted(f *os.File, keys *Keyring, psum string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cannot seek file: %w", err)
+	}
 
-	state.rdbStats.rdb_last_save_ts = time.Now().Unix()
-	state.rdbStats.rdb_saves++
+	r, _, err := keys.open(f)
+	if err != nil {
+		return err
+	}
+	fsum, err := Hash(r)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt file: %w", err)
+	}
+
+	if psum != fsum {
+		return fmt.Errorf("plaintext and decrypted file checksums do not match:\nf=%s\nb=%s", fsum, psum)
+	}
+	return nil
 }
 
-func SyncRDB(conf *Config) {
+// like redis a snapshot that can't be read stops the server, starting empty would let the next
+// save overwrite it. that includes a file encrypted with a key that isn't configured
+func SyncRDB(state *AppState) {
+	if err := loadRDB(state); err != nil {
+		log.Fatalf("Fatal error loading the DB file %s: %v. Exiting.", state.conf.rdbFn, err)
+	}
+}
+
+// a missing file is an empty dataset, so is an empty one: older versions created it at startup
+func loadRDB(state *AppState) error {
+	conf := state.conf
 	fp := path.Join(conf.dir, conf.rdbFn)
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_RDONLY, 0644)
+	f, err := os.Open(fp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		fmt.Println("error opening rdb file: ", err)
-		return
+		return err
 	}
 	defer f.Close()
 
-	err = gob.NewDecoder(f).Decode(&DB.store)
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+
+	r, _, err := conf.keys.open(progressReader{r: f, loaded: &state.loading.loaded})
+	if err != nil {
+		return err
+	}
+
+	store, err := readRDB(r, state.loading.read)
 	if err != nil {
-		fmt.Println("error reading rdb file: ", err)
-		return
+		return err
 	}
+	return state.loading.merge(store)
 }
 
 func Hash(r io.Reader) (string, error) {
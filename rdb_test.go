@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a file holding a new random key, hex encoded
+func newTestKeyFile(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	fp := path.Join(t.TempDir(), "rdb.key")
+	if err := os.WriteFile(fp, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fp
+}
+
+func newTestKeyring(t *testing.T, cur string, old ...string) *Keyring {
+	t.Helper()
+
+	keys, err := loadKeyring(cur, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func newRDBState(t *testing.T) *AppState {
+	t.Helper()
+
+	conf := NewConfig()
+	conf.dir = t.TempDir()
+	conf.rdbFn = "dump.rdb"
+	return NewAppState(conf)
+}
+
+func writeDump(t *testing.T, state *AppState, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path.Join(state.conf.dir, state.conf.rdbFn), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a dump whose checksum doesn't match its data
+func corruptDump(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, map[string]*Item{"rdbload:k": {V: "v"}}, NewConfig(), false); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	return data
+}
+
+func TestLoadRDBWithoutFile(t *testing.T) {
+	state := newRDBState(t)
+	if err := loadRDB(state); err != nil {
+		t.Fatalf("loading without a dump: %v", err)
+	}
+	if _, err := os.Stat(path.Join(state.conf.dir, state.conf.rdbFn)); err == nil {
+		t.Fatal("loading created the dump")
+	}
+
+	writeDump(t, state, nil)
+	if err := loadRDB(state); err != nil {
+		t.Fatalf("loading an empty dump: %v", err)
+	}
+}
+
+func TestLoadRDBRejectsCorruptFile(t *testing.T) {
+	state := newRDBState(t)
+	writeDump(t, state, corruptDump(t))
+
+	if err := loadRDB(state); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("loading a dump with a wrong checksum: %v", err)
+	}
+	if keys := keysWithPrefix("rdbload:"); len(keys) != 0 {
+		t.Fatalf("the corrupt dump loaded %v", keys)
+	}
+}
+
+func TestLoadRDBRejectsWrongKey(t *testing.T) {
+	state := newRDBState(t)
+	written := newTestKeyFile(t)
+	state.conf.keys = newTestKeyring(t, written)
+	if err := SaveRDB(state, map[string]*Item{"rdbload:k": {V: "v"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, keys := range map[string]*Keyring{
+		"another key": newTestKeyring(t, newTestKeyFile(t)),
+		"no key":      nil,
+	} {
+		state.conf.keys = keys
+		if err := loadRDB(state); err == nil || !strings.Contains(err.Error(), "not configured") {
+			t.Fatalf("loading with %s: %v", name, err)
+		}
+	}
+
+	// the key it was written with, only kept to decrypt, still reads it
+	state.conf.keys = newTestKeyring(t, "", written)
+	r, err := os.Open(path.Join(state.conf.dir, state.conf.rdbFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	br, _, err := state.conf.keys.open(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store, err := readRDB(br, nil); err != nil || store["rdbload:k"] == nil {
+		t.Fatalf("reading with the old key: %v", err)
+	}
+}
+
+// the server doesn't start empty when its dump can't be read, a save would overwrite it
+func TestSyncRDBExitsOnCorruptFile(t *testing.T) {
+	if dir := os.Getenv("SYNC_RDB_DIR"); dir != "" {
+		conf := NewConfig()
+		conf.dir = dir
+		conf.rdbFn = "dump.rdb"
+		log.SetOutput(os.Stderr)
+		SyncRDB(NewAppState(conf))
+		return
+	}
+
+	state := newRDBState(t)
+	writeDump(t, state, corruptDump(t))
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSyncRDBExitsOnCorruptFile$")
+	cmd.Env = append(os.Environ(), "SYNC_RDB_DIR="+state.conf.dir)
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok || !strings.Contains(string(out), "Fatal error loading the DB") {
+		t.Fatalf("the server went on after failing to load: %v\n%s", err, out)
+	}
+}
+
+// a save that can't write its temp file fails without touching the last dump, and writes are
+// refused until one succeeds again
+func TestFailedSaveKeepsDumpAndDeniesWrites(t *testing.T) {
+	state := newRDBState(t)
+	state.conf.rdb = []RDBSnapshot{{Secs: 3600, KeysChanged: 1}}
+	t.Cleanup(func() { dropKeys("rdbsave:") })
+	tc := dialTest(t, startTestServer(t, state))
+
+	if got := tc.do(t, "SET", "rdbsave:k", "saved"); got != "+OK" {
+		t.Fatalf("SET replied %q", got)
+	}
+	if got := tc.do(t, "SAVE"); got != "+OK" {
+		t.Fatalf("SAVE replied %q", got)
+	}
+	dump := path.Join(state.conf.dir, state.conf.rdbFn)
+	saved, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory where the temp file goes, unlike permissions it also stops root
+	tmp := path.Join(state.conf.dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := os.Mkdir(tmp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.do(t, "SET", "rdbsave:k", "unsaved"); got != "+OK" {
+		t.Fatalf("SET replied %q", got)
+	}
+	if got := tc.do(t, "SAVE"); got != "-"+ErrSaveFailed.Error() {
+		t.Fatalf("SAVE without a writable temp file replied %q", got)
+	}
+
+	if got := tc.do(t, "SET", "rdbsave:k", "denied"); got != "-"+ErrMisconf.Error() {
+		t.Fatalf("SET after the failed save replied %q", got)
+	}
+	if got := tc.do(t, "GET", "rdbsave:k"); got != "unsaved" {
+		t.Fatalf("GET after the failed save replied %q", got)
+	}
+	if got := tc.do(t, "INFO", "persistence"); !strings.Contains(got, "rdb_last_bgsave_status:err") {
+		t.Fatalf("INFO doesn't report the failed save:\n%s", got)
+	}
+	if data, err := os.ReadFile(dump); err != nil || !bytes.Equal(data, saved) {
+		t.Fatalf("the failed save changed the last dump: %v", err)
+	}
+
+	if err := os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.do(t, "SAVE"); got != "+OK" {
+		t.Fatalf("SAVE once the temp file can be written replied %q", got)
+	}
+	if got := tc.do(t, "SET", "rdbsave:k", "v"); got != "+OK" {
+		t.Fatalf("SET after a successful save replied %q", got)
+	}
+
+	state.conf.stopWritesOnBgsaveErr = false
+	if err := os.Mkdir(tmp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.do(t, "SAVE"); got != "-"+ErrSaveFailed.Error() {
+		t.Fatalf("SAVE replied %q", got)
+	}
+	if got := tc.do(t, "SET", "rdbsave:k", "v"); got != "+OK" {
+		t.Fatalf("SET with stop-writes-on-bgsave-error no replied %q", got)
+	}
+}
+
+// expiries are saved as absolute times, keys that expired while the server was down are
+// dropped once the dump is loaded
+func TestLoadRDBDropsExpiredKeys(t *testing.T) {
+	state := newRDBState(t)
+	state.conf.rdb = []RDBSnapshot{{Secs: 3600, KeysChanged: 1}}
+	t.Cleanup(func() { dropKeys("rdbexp:") })
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	store := map[string]*Item{
+		"rdbexp:live":    {V: "1", exp: exp},
+		"rdbexp:expired": {V: "2", exp: time.Now().Add(-time.Second)},
+		"rdbexp:none":    {V: "3"},
+	}
+	if err := SaveRDB(state, store, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path.Join(state.conf.dir, state.conf.rdbFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readRDBBytes(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 3 || !saved["rdbexp:live"].exp.Equal(exp) || !saved["rdbexp:none"].exp.IsZero() {
+		t.Fatalf("the dump holds %d keys, the expiry %v", len(saved), saved["rdbexp:live"])
+	}
+
+	emptyDB()
+	state.load()
+
+	if got := keysWithPrefix("rdbexp:"); !mapsEqual(got, map[string]string{"rdbexp:live": "1", "rdbexp:none": "3"}) {
+		t.Fatalf("loaded %v", got)
+	}
+	DB.mu.RLock()
+	got := DB.store["rdbexp:live"].exp
+	DB.mu.RUnlock()
+	if !got.Equal(exp) {
+		t.Fatalf("rdbexp:live expires at %v, want %v", got, exp)
+	}
+}
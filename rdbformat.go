@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// the redis RDB file format, version 11 (redis 7.2) is written and versions up to it are read.
+// only strings are stored here, keys of other types in a dump are skipped when it's loaded
+
+const (
+	rdbMagic   = "REDIS" // every snapshot starts with this, it's how an AOF base with an RDB preamble is told apart from RESP
+	rdbVersion = 11
+)
+
+// opcodes
+const (
+	rdbOpFunction2  = 245
+	rdbOpModuleAux  = 247
+	rdbOpIdle       = 248
+	rdbOpFreq       = 249
+	rdbOpAux        = 250
+	rdbOpResizeDB   = 251
+	rdbOpExpireMs   = 252
+	rdbOpExpire     = 253
+	rdbOpSelectDB   = 254
+	rdbOpEOF        = 255
+	rdbLenSpecial   = 3 // top bits of a length byte saying a string is stored in a special encoding
+	rdbEncInt8      = 0
+	rdbEncInt16     = 1
+	rdbEncInt32     = 2
+	rdbEncLZF       = 3
+	rdbLen32        = 0x80
+	rdbLen64        = 0x81
+	rdbCompressFrom = 20 // shorter strings aren't worth compressing
+)
+
+// value types
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZset            = 3
+	rdbTypeHash            = 4
+	rdbTypeZset2           = 5
+	rdbTypeModule          = 6
+	rdbTypeModule2         = 7
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZsetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeStreamListpacks = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZsetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeStream2         = 19
+	rdbTypeSetListpack     = 20
+	rdbTypeStream3         = 21
+)
+
+// CRC-64/Jones, the checksum at the end of the file. the table takes the reflected
+// polynomial, and redis neither inverts the crc before nor after
+var rdbCrcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func rdbCrc(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, rdbCrcTable, p)
+}
+
+type rdbWriter struct {
+	w        io.Writer
+	crc      uint64
+	err      error // the first write error, later writes are skipped
+	buf      []byte
+	compress bool
+}
+
+func (rw *rdbWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = rdbCrc(rw.crc, p)
+	_, rw.err = rw.w.Write(p)
+}
+
+func (rw *rdbWriter) byte(b byte) {
+	rw.write([]byte{b})
+}
+
+func (rw *rdbWriter) length(n uint64) {
+	b := rw.buf[:0]
+	switch {
+	case n < 1<<6:
+		b = append(b, byte(n))
+	case n < 1<<14:
+		b = append(b, byte(n>>8)|1<<6, byte(n))
+	case n <= math.MaxUint32:
+		b = append(b, rdbLen32)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+	default:
+		b = append(b, rdbLen64)
+		b = binary.BigEndian.AppendUint64(b, n)
+	}
+	rw.buf = b
+	rw.write(b)
+}
+
+// strings that are small integers are stored as such, longer ones LZF compressed when it helps
+// and rdbcompression is on
+func (rw *rdbWriter) string(s string) {
+	if len(s) <= 11 {
+		if i, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(i, 10) == s {
+			rw.int(i)
+			return
+		}
+	}
+
+	if rw.compress && len(s) > rdbCompressFrom {
+		if c := lzfCompress([]byte(s)); c != nil {
+			rw.byte(rdbLenSpecial<<6 | rdbEncLZF)
+			rw.length(uint64(len(c)))
+			rw.length(uint64(len(s)))
+			rw.write(c)
+			return
+		}
+	}
+
+	rw.length(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *rdbWriter) int(i int64) {
+	b := rw.buf[:0]
+	switch {
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		b = append(b, rdbLenSpecial<<6|rdbEncInt8, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		b = append(b, rdbLenSpecial<<6|rdbEncInt16)
+		b = binary.LittleEndian.AppendUint16(b, uint16(int16(i)))
+	default:
+		b = append(b, rdbLenSpecial<<6|rdbEncInt32)
+		b = binary.LittleEndian.AppendUint32(b, uint32(int32(i)))
+	}
+	rw.buf = b
+	rw.write(b)
+}
+
+func (rw *rdbWriter) aux(k string, v string) {
+	rw.byte(rdbOpAux)
+	rw.string(k)
+	rw.string(v)
+}
+
+// writes store as an RDB file. aofBase marks a snapshot written as the preamble of an AOF base
+func writeRDB(w io.Writer, store map[string]*Item, conf *Config, aofBase bool) error {
+	rw := &rdbWriter{w: w, buf: make([]byte, 0, 16), compress: conf.rdbCompression}
+	now := time.Now()
+
+	rw.write(fmt.Appendf(nil, "%s%04d", rdbMagic, rdbVersion))
+	rw.aux("redis-ver", "7.2.0")
+	rw.aux("redis-bits", "64")
+	rw.aux("ctime", strconv.FormatInt(now.Unix(), 10))
+
+	var mem int64
+	expires := 0
+	for k, item := range store {
+		mem += item.approxMemUsage(k)
+		if !item.exp.IsZero() {
+			expires++
+		}
+	}
+	rw.aux("used-mem", strconv.FormatInt(mem, 10))
+	if aofBase {
+		rw.aux("aof-base", "1")
+	} else {
+		rw.aux("aof-base", "0")
+	}
+
+	rw.byte(rdbOpSelectDB)
+	rw.length(0)
+	rw.byte(rdbOpResizeDB)
+	rw.length(uint64(len(store)))
+	rw.length(uint64(expires))
+
+	lru := conf.eviction == AllKeysLRU || conf.eviction == VolatileKeysLRU
+	lfu := conf.eviction == AllKeysLFU || conf.eviction == VolatileKeysLFU
+
+	for k, item := range store {
+		if !item.exp.IsZero() {
+			rw.byte(rdbOpExpireMs)
+			rw.write(binary.LittleEndian.AppendUint64(nil, uint64(item.exp.UnixMilli())))
+		}
+
+		switch {
+		case lru && !item.LastAccess().IsZero():
+			rw.byte(rdbOpIdle)
+			rw.length(uint64(max(0, now.Sub(item.LastAccess())/time.Second)))
+		case lfu:
+			rw.byte(rdbOpFreq)
+			rw.byte(byte(min(item.Accesses(), math.MaxUint8)))
+		}
+
+		rw.byte(rdbTypeString)
+		rw.string(k)
+		rw.string(item.V)
+
+		if rw.err != nil {
+			return rw.err
+		}
+	}
+
+	rw.byte(rdbOpEOF)
+	rw.write(binary.LittleEndian.AppendUint64(nil, rw.crc))
+	return rw.err
+}
+
+type rdbReader struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+}
+
+func (rr *rdbReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rr.crc = rdbCrc(rr.crc, b)
+	return b, nil
+}
+
+func (rr *rdbReader) byte() (byte, error) {
+	b, err := rr.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// returns the length, or the special encoding of a string when special is set
+func (rr *rdbReader) length() (n uint64, special bool, err error) {
+	b, err := rr.byte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := rr.byte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case rdbLenSpecial:
+		return uint64(b & 0x3f), true, nil
+	}
+
+	switch b {
+	case rdbLen32:
+		p, err := rr.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case rdbLen64:
+		p, err := rr.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d", b)
+}
+
+func (rr *rdbReader) len() (int, error) {
+	n, special, err := rr.length()
+	if err != nil {
+		return 0, err
+	}
+	if special || n > math.MaxInt32 {
+		return 0, errors.New("invalid length")
+	}
+	return int(n), nil
+}
+
+func (rr *rdbReader) string() (string, error) {
+	n, special, err := rr.length()
+	if err != nil {
+		return "", err
+	}
+
+	if !special {
+		if n > math.MaxInt32 {
+			return "", errors.New("invalid string length")
+		}
+		b, err := rr.read(int(n))
+		return string(b), err
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := rr.read(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case rdbEncInt16:
+		b, err := rr.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case rdbEncInt32:
+		b, err := rr.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case rdbEncLZF:
+		clen, err := rr.len()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := rr.len()
+		if err != nil {
+			return "", err
+		}
+		c, err := rr.read(clen)
+		if err != nil {
+			return "", err
+		}
+		b, err := lzfDecompress(c, ulen)
+		return string(b), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+func (rr *rdbReader) strings(n int) error {
+	for range n {
+		if _, err := rr.string(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream IDs in metadata are two lengths, ms and seq
+func (rr *rdbReader) lengths(n int) error {
+	for range n {
+		if _, _, err := rr.length(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads past a value this store can't hold
+func (rr *rdbReader) skip(typ byte) error {
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		n, err := rr.len()
+		if err != nil {
+			return err
+		}
+		return rr.strings(n)
+	case rdbTypeHash:
+		n, err := rr.len()
+		if err != nil {
+			return err
+		}
+		return rr.strings(2 * n)
+	case rdbTypeZset:
+		n, err := rr.len()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			// scores are a length byte, 253-255 standing for nan and infinities
+			l, err := rr.byte()
+			if err != nil {
+				return err
+			}
+			if l < 253 {
+				if _, err := rr.read(int(l)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeZset2:
+		n, err := rr.len()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			if _, err := rr.read(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZsetZiplist, rdbTypeHashZiplist,
+		rdbTypeHashListpack, rdbTypeZsetListpack, rdbTypeSetListpack:
+		_, err := rr.string()
+		return err
+	case rdbTypeListQuicklist2:
+		n, err := rr.len()
+		if err != nil {
+			return err
+		}
+		for range n {
+			if _, _, err := rr.length(); err != nil { // container type
+				return err
+			}
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeStreamListpacks, rdbTypeStream2, rdbTypeStream3:
+		return rr.skipStream(typ)
+	}
+	return fmt.Errorf("unsupported value type %d", typ)
+}
+
+func (rr *rdbReader) skipStream(typ byte) error {
+	n, err := rr.len()
+	if err != nil {
+		return err
+	}
+	if err := rr.strings(2 * n); err != nil { // node keys and listpacks
+		return err
+	}
+
+	// length and last id, then first id, max deleted id and entries added since v2
+	meta := 3
+	if typ >= rdbTypeStream2 {
+		meta += 5
+	}
+	if err := rr.lengths(meta); err != nil {
+		return err
+	}
+
+	groups, err := rr.len()
+	if err != nil {
+		return err
+	}
+	for range groups {
+		if _, err := rr.string(); err != nil {
+			return err
+		}
+		meta := 2 // last id
+		if typ >= rdbTypeStream2 {
+			meta++ // entries read
+		}
+		if err := rr.lengths(meta); err != nil {
+			return err
+		}
+
+		pel, err := rr.len()
+		if err != nil {
+			return err
+		}
+		for range pel {
+			if _, err := rr.read(16 + 8); err != nil { // raw id and delivery time
+				return err
+			}
+			if _, _, err := rr.length(); err != nil { // delivery count
+				return err
+			}
+		}
+
+		consumers, err := rr.len()
+		if err != nil {
+			return err
+		}
+		for range consumers {
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			times := 8 // seen time, and active time since v3
+			if typ >= rdbTypeStream3 {
+				times += 8
+			}
+			if _, err := rr.read(times); err != nil {
+				return err
+			}
+			pel, err := rr.len()
+			if err != nil {
+				return err
+			}
+			if _, err := rr.read(16 * pel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reads an RDB file, r is left right after it so an AOF tail can follow.
+// onKey is called with every key read for the loading progress, it may be nil
+func readRDB(r *bufio.Reader, onKey func(k string)) (map[string]*Item, error) {
+	rr := &rdbReader{r: r}
+
+	header, err := rr.read(len(rdbMagic) + 4)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, errors.New("wrong signature trying to load DB from file")
+	}
+	rr.version, err = strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil || rr.version < 1 || rr.version > rdbVersion {
+		return nil, fmt.Errorf("can't handle RDB format version %s", header[len(rdbMagic):])
+	}
+
+	store := map[string]*Item{}
+	skipped := map[byte]int{}
+	now := time.Now()
+	item := &Item{} // collects the expiry and access metadata that come before a key
+
+	for {
+		typ, err := rr.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case rdbOpEOF:
+			crc := rr.crc
+			if rr.version >= 5 {
+				b, err := rr.read(8)
+				if err != nil {
+					return nil, err
+				}
+				// a zero checksum means it was written with checksums off
+				if sum := binary.LittleEndian.Uint64(b); sum != 0 && sum != crc {
+					return nil, errors.New("wrong RDB checksum")
+				}
+			}
+			for typ, n := range skipped {
+				log.Printf("skipped %d keys of RDB type %d, only strings are supported", n, typ)
+			}
+			return store, nil
+		case rdbOpAux:
+			if err := rr.strings(2); err != nil {
+				return nil, err
+			}
+		case rdbOpSelectDB:
+			db, err := rr.len()
+			if err != nil {
+				return nil, err
+			}
+			if db != 0 {
+				log.Printf("loading keys of DB %d into DB 0", db)
+			}
+		case rdbOpResizeDB:
+			if err := rr.lengths(2); err != nil {
+				return nil, err
+			}
+		case rdbOpExpireMs:
+			b, err := rr.read(8)
+			if err != nil {
+				return nil, err
+			}
+			item.exp = time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+		case rdbOpExpire:
+			b, err := rr.read(4)
+			if err != nil {
+				return nil, err
+			}
+			item.exp = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+		case rdbOpIdle:
+			idle, err := rr.len()
+			if err != nil {
+				return nil, err
+			}
+			item.lastAccess.Store(now.Add(-time.Duration(idle) * time.Second).UnixNano())
+		case rdbOpFreq:
+			freq, err := rr.byte()
+			if err != nil {
+				return nil, err
+			}
+			item.accesses.Store(int64(freq))
+		case rdbOpFunction2:
+			if _, err := rr.string(); err != nil {
+				return nil, err
+			}
+		case rdbOpModuleAux:
+			return nil, errors.New("module data in RDB files is not supported")
+		default:
+			k, err := rr.string()
+			if err != nil {
+				return nil, err
+			}
+
+			if typ != rdbTypeString {
+				if err := rr.skip(typ); err != nil {
+					return nil, fmt.Errorf("key %s: %w", k, err)
+				}
+				skipped[typ]++
+			} else {
+				if item.V, err = rr.string(); err != nil {
+					return nil, err
+				}
+				store[k] = item
+				if onKey != nil {
+					onKey(k)
+				}
+			}
+			item = &Item{}
+		}
+	}
+}
+
+func isRDB(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(rdbMagic))
+	return err == nil && string(magic) == rdbMagic
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readRDBBytes(t *testing.T, data []byte) (map[string]*Item, error) {
+	t.Helper()
+	return readRDB(bufio.NewReader(bytes.NewReader(data)), nil)
+}
+
+func TestRDBRoundtrip(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	values := map[string]string{
+		"raw":            "hello",
+		"empty":          "",
+		"int8":           "-12",
+		"int16":          "30000",
+		"int32":          "-2000000000",
+		"not canonical":  "007",
+		"int64":          "9000000000", // doesn't fit the 32 bit encoding, stored as a string
+		"compressible":   strings.Repeat("abcabcabc", 100),
+		"incompressible": "q8Zr1mX0vB7pL2wK9sT4yN6", // over rdbCompressFrom, LZF can't shrink it
+	}
+
+	for _, compress := range []bool{true, false} {
+		for _, eviction := range []Eviction{AllKeysRandom, AllKeysLRU, AllKeysLFU} {
+			conf := NewConfig()
+			conf.rdbCompression = compress
+			conf.eviction = eviction
+
+			store := map[string]*Item{}
+			for k, v := range values {
+				store[k] = &Item{V: v}
+			}
+			store["int8"].exp = exp
+			store["compressible"].exp = exp
+			store["raw"].lastAccess.Store(time.Now().Add(-time.Minute).UnixNano())
+			store["raw"].accesses.Store(42)
+
+			var buf bytes.Buffer
+			if err := writeRDB(&buf, store, conf, false); err != nil {
+				t.Fatal(err)
+			}
+			if compress == bytes.Contains(buf.Bytes(), []byte(values["compressible"])) {
+				t.Errorf("rdbcompression %v, eviction %s: LZF strings don't match the setting", compress, eviction)
+			}
+
+			got, err := readRDBBytes(t, buf.Bytes())
+			if err != nil {
+				t.Fatalf("rdbcompression %v, eviction %s: %v", compress, eviction, err)
+			}
+			if len(got) != len(values) {
+				t.Fatalf("rdbcompression %v, eviction %s: read %d keys, want %d", compress, eviction, len(got), len(values))
+			}
+			for k, v := range values {
+				if got[k] == nil || got[k].V != v || !got[k].exp.Equal(store[k].exp) {
+					t.Errorf("rdbcompression %v, eviction %s: %s read back as %+v", compress, eviction, k, got[k])
+				}
+			}
+
+			// the idle time is stored in seconds, the access count only with an LFU policy
+			switch eviction {
+			case AllKeysLRU:
+				if idle := time.Since(time.Unix(0, got["raw"].lastAccess.Load())); idle < time.Minute || idle > time.Minute+5*time.Second {
+					t.Errorf("the idle time read back as %v", idle)
+				}
+			case AllKeysLFU:
+				if n := got["raw"].accesses.Load(); n != 42 {
+					t.Errorf("the access count read back as %d", n)
+				}
+			}
+		}
+	}
+}
+
+// a file as redis writes it: second expiries, types this store skips, aux fields and no checksum
+func TestRDBReadsRedisOpcodes(t *testing.T) {
+	var buf bytes.Buffer
+	rw := &rdbWriter{w: &buf, buf: make([]byte, 0, 16)}
+	rw.write([]byte("REDIS0009"))
+	rw.aux("redis-ver", "7.2.0")
+	rw.byte(rdbOpSelectDB)
+	rw.length(0)
+	rw.byte(rdbOpResizeDB)
+	rw.length(3)
+	rw.length(2)
+
+	secs := time.Now().Add(time.Hour).Unix()
+	rw.byte(rdbOpExpire)
+	rw.write(binary.LittleEndian.AppendUint32(nil, uint32(secs)))
+	rw.byte(rdbTypeString)
+	rw.string("secs")
+	rw.string("a")
+
+	ms := time.Now().Add(2 * time.Hour).UnixMilli()
+	rw.byte(rdbOpExpireMs)
+	rw.write(binary.LittleEndian.AppendUint64(nil, uint64(ms)))
+	rw.byte(rdbTypeString)
+	rw.string("millis")
+	rw.string("b")
+
+	rw.byte(rdbTypeSet)
+	rw.string("set")
+	rw.length(2)
+	rw.string("m1")
+	rw.string("m2")
+
+	rw.byte(rdbOpEOF)
+	rw.write(make([]byte, 8)) // written with rdbchecksum no
+
+	store, err := readRDBBytes(t, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store) != 2 || store["set"] != nil {
+		t.Fatalf("read %d keys, want the two strings", len(store))
+	}
+	if got := store["secs"]; got == nil || got.V != "a" || got.exp.Unix() != secs {
+		t.Fatalf("the key with a seconds expiry read back as %+v", got)
+	}
+	if got := store["millis"]; got == nil || got.V != "b" || got.exp.UnixMilli() != ms {
+		t.Fatalf("the key with a milliseconds expiry read back as %+v", got)
+	}
+}
+
+func TestRDBRejectsBadChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, map[string]*Item{"k": {V: "the value"}}, NewConfig(), false); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	bad := bytes.Clone(data)
+	bad[len(bad)-1] ^= 1
+	if _, err := readRDBBytes(t, bad); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("a wrong checksum read as %v", err)
+	}
+
+	// the checksum covers the data, a changed value is caught too
+	bad = bytes.Clone(data)
+	bad[bytes.Index(bad, []byte("the value"))] = 'T'
+	if _, err := readRDBBytes(t, bad); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("a changed value read as %v", err)
+	}
+
+	if _, err := readRDBBytes(t, data[:len(data)-3]); err == nil {
+		t.Fatal("a truncated file was read")
+	}
+}
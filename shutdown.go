@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how long clients get to read their last replies before the server exits anyway
+const shutdownDrainTimeout = 5 * time.Second
+
+var errShutdownAborted = errors.New("shutdown aborted by SHUTDOWN ABORT")
+
+type shutdownFlags struct {
+	save   bool // save a snapshot even without save points
+	nosave bool
+	force  bool // exit even if the AOF or the snapshot can't be written
+}
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+// there are no replicas to wait for, so NOW changes nothing. ABORT cancels a shutdown
+// that is still waiting for running commands or saving
+func shutdown(c *Client, v *Value, state *AppState) *Value {
+	var f shutdownFlags
+	abort := false
+
+	for _, arg := range v.array[1:] {
+		switch strings.ToLower(arg.bulk) {
+		case "nosave":
+			f.nosave = true
+		case "save":
+			f.save = true
+		case "now":
+		case "force":
+			f.force = true
+		case "abort":
+			abort = true
+		default:
+			return errReply(ErrSyntax)
+		}
+	}
+	if f.save && f.nosave || abort && len(v.array) > 2 {
+		return errReply(ErrSyntax)
+	}
+
+	if abort {
+		if !state.abortShutdown() {
+			return errReply(ErrNoShutdown)
+		}
+		return &Value{typ: STRING, str: "OK"}
+	}
+
+	if err := state.Shutdown(c, f); err != nil {
+		return errReply(ErrShutdownFailed)
+	}
+	return nil // like redis the connection just goes away
+}
+
+// stops the server. writes already running finish and no new ones start, then the AOF is
+// flushed and fsynced and a snapshot saved when there are save points. if that fails (without
+// FORCE) or ABORT comes in meanwhile, the server goes on as before. otherwise the listeners are
+// closed, clients are disconnected once their pending replies are written, the pid file is
+// removed and main returns. c is the client that sent SHUTDOWN, nil for a signal
+func (state *AppState) Shutdown(c *Client, f shutdownFlags) error {
+	state.shutdownMu.Lock()
+	defer state.shutdownMu.Unlock()
+
+	log.Println("user requested shutdown...")
+	state.shutdownAbort.Store(false)
+	state.shuttingDown.Store(true)
+
+	state.gate.Lock()
+	err := state.prepareForShutdown(f)
+	if err == nil && state.shutdownAbort.Load() {
+		err = errShutdownAborted
+	}
+	if err != nil {
+		log.Println("errors trying to shut down the server: ", err)
+		state.shuttingDown.Store(false)
+		state.gate.Unlock()
+		return err
+	}
+
+	// from here on it can't be aborted, clients blocked on the gate drop their writes
+	state.exiting.Store(true)
+	state.gate.Unlock()
+
+	closeListeners(state.listeners)
+	state.drainClients(c)
+
+	removePidfile(state.conf)
+	log.Println("goredis is now ready to exit, bye bye...")
+	close(state.exited)
+	return nil
+}
+
+func (state *AppState) prepareForShutdown(f shutdownFlags) error {
+	if state.conf.aofEnabled {
+		log.Println("calling fsync() on the AOF file.")
+		if err := state.aof.Fsync(); err != nil {
+			if !f.force {
+				log.Println("error trying to fsync the AOF, can't exit.")
+				return err
+			}
+			log.Println("error trying to fsync the AOF. exit anyway: ", err)
+		}
+	}
+
+	// like redis a dataset that's only partly loaded isn't saved over the snapshot
+	if state.loading.loading.Load() && !f.nosave {
+		log.Println("the dataset is still loading, exiting without saving.")
+		f.save, f.nosave = false, true
+	}
+
+	if !f.nosave && (f.save || len(state.conf.rdb) > 0) {
+		log.Println("saving the final RDB snapshot before exiting.")
+		if err := SaveRDB(state, nil, 0); err != nil {
+			if !f.force {
+				log.Println("error trying to save the DB, can't exit.")
+				return err
+			}
+			log.Println("error trying to save the DB. exit anyway.")
+		}
+	}
+	return nil
+}
+
+// false if there's no shutdown to abort, or it's too late to
+func (state *AppState) abortShutdown() bool {
+	if !state.shuttingDown.Load() || state.exiting.Load() {
+		return false
+	}
+	state.shutdownAbort.Store(true)
+	log.Println("shutdown abort requested")
+	return true
+}
+
+// makes every client stop after the command it's reading, pending replies are still written.
+// gives up after shutdownDrainTimeout, a client that doesn't read its replies can't hold up the exit
+func (state *AppState) drainClients(self *Client) {
+	deadline := time.Now().Add(shutdownDrainTimeout)
+	state.pause.Unpause() // paused clients go back to their loop and stop there
+
+	remaining := 0
+	for _, c := range state.sortedClients() {
+		c.conn.SetWriteDeadline(deadline)
+		if c == self {
+			remaining = 1
+			continue
+		}
+		c.conn.SetReadDeadline(time.Now()) // wakes clients waiting for their next command
+	}
+
+	for state.clientCount() > remaining && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := state.clientCount() - remaining; n > 0 {
+		log.Printf("exiting with %d clients still connected", n)
+	}
+
+	// SHUTDOWN runs on its client's goroutine, so its earlier pipelined replies can be written here
+	if self != nil {
+		self.flush()
+		self.conn.Close()
+	}
+}
+
+// SIGTERM and SIGINT shut down like SHUTDOWN, saving when there are save points.
+// a second SIGINT while that's in progress exits right away
+func handleSignals(state *AppState) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range ch {
+		name := "SIGTERM"
+		if sig == syscall.SIGINT {
+			name = "SIGINT"
+		}
+
+		if state.shuttingDown.Load() {
+			if sig == syscall.SIGINT {
+				log.Println("you insist... exiting now.")
+				removePidfile(state.conf)
+				os.Exit(1)
+			}
+			continue
+		}
+
+		log.Printf("received %s scheduling shutdown...", name)
+		go func() {
+			if err := state.Shutdown(nil, shutdownFlags{}); err != nil {
+				log.Printf("%s received but errors trying to shut down the server, check the logs for more information", name)
+			}
+		}()
+	}
+}
+
+func writePidfile(conf *Config) {
+	if conf.pidfile == "" {
+		return
+	}
+	if err := os.WriteFile(conf.pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		log.Println("failed to write PID file: ", err)
+	}
+}
+
+func removePidfile(conf *Config) {
+	if conf.pidfile == "" {
+		return
+	}
+	if err := os.Remove(conf.pidfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("cannot remove PID file: ", err)
+	}
+}
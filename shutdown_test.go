@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a server whose listener SHUTDOWN closes, with a pid file like main writes
+func newShutdownServer(t *testing.T, state *AppState) string {
+	t.Helper()
+
+	state.conf.pidfile = path.Join(t.TempDir(), "goredis.pid")
+	writePidfile(state.conf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.listeners = []net.Listener{l}
+	t.Cleanup(func() { l.Close() })
+
+	go acceptConns(l, state)
+	return l.Addr().String()
+}
+
+// sends SHUTDOWN and waits for the server to exit: the connection is closed without a reply,
+// the listener is closed and the pid file removed
+func shutdownServer(t *testing.T, state *AppState, tc *testConn, addr string, args ...string) {
+	t.Helper()
+
+	tc.send(t, append([]string{"SHUTDOWN"}, args...)...)
+	if line, err := tc.r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("SHUTDOWN %s replied %q, %v", strings.Join(args, " "), line, err)
+	}
+
+	select {
+	case <-state.exited:
+	case <-time.After(time.Second):
+		t.Fatal("the server didn't exit")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("the listener is still open")
+	}
+	if _, err := os.Stat(state.conf.pidfile); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("the pid file is still there: %v", err)
+	}
+}
+
+// a final snapshot is saved with save points or SAVE, never with NOSAVE
+func TestShutdownSave(t *testing.T) {
+	t.Cleanup(func() { dropKeys("shutdown:") })
+
+	cases := []struct {
+		args       []string
+		savePoints bool
+		saved      bool
+	}{
+		{nil, false, false},
+		{nil, true, true},
+		{[]string{"SAVE"}, false, true},
+		{[]string{"NOSAVE"}, true, false},
+		{[]string{"NOW", "NOSAVE"}, true, false},
+	}
+	for _, tc := range cases {
+		state := newRDBState(t)
+		if tc.savePoints {
+			state.conf.rdb = []RDBSnapshot{{Secs: 3600, KeysChanged: 1}}
+		}
+		addr := newShutdownServer(t, state)
+		conn := dialTest(t, addr)
+
+		if got := conn.do(t, "SET", "shutdown:k", "v"); got != "+OK" {
+			t.Fatalf("SET replied %q", got)
+		}
+		shutdownServer(t, state, conn, addr, tc.args...)
+
+		_, err := os.Stat(path.Join(state.conf.dir, state.conf.rdbFn))
+		if saved := err == nil; saved != tc.saved {
+			t.Errorf("SHUTDOWN %s, save points %v: saved %v", strings.Join(tc.args, " "), tc.savePoints, saved)
+		}
+	}
+}
+
+// records still buffered with appendfsync no are written out before the server exits
+func TestShutdownFsyncsAof(t *testing.T) {
+	conf := NewConfig()
+	conf.aofFsync = No
+	state := newTestAof(t, conf)
+	t.Cleanup(func() { dropKeys("shutdown:") })
+	addr := newShutdownServer(t, state)
+	tc := dialTest(t, addr)
+
+	if got := tc.do(t, "SET", "shutdown:aof", "v"); got != "+OK" {
+		t.Fatalf("SET replied %q", got)
+	}
+	if records := aofRecords(t, state); len(records) != 0 {
+		t.Fatalf("the AOF was written before the shutdown: %q", records)
+	}
+
+	shutdownServer(t, state, tc, addr, "NOSAVE")
+	if records := aofRecords(t, state); len(records) != 1 || records[0][0] != "SET" {
+		t.Fatalf("the AOF holds %q after the shutdown", records)
+	}
+}
+
+// a shutdown that can't save goes back to serving, unless it's forced
+func TestShutdownSaveFails(t *testing.T) {
+	state := newRDBState(t)
+	state.conf.rdb = []RDBSnapshot{{Secs: 3600, KeysChanged: 1}}
+	addr := newShutdownServer(t, state)
+	tc := dialTest(t, addr)
+
+	tmp := path.Join(state.conf.dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := os.Mkdir(tmp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tc.do(t, "SHUTDOWN"); got != "-"+ErrShutdownFailed.Error() {
+		t.Fatalf("SHUTDOWN without a writable temp file replied %q", got)
+	}
+	if got := tc.do(t, "DBSIZE"); !strings.HasPrefix(got, ":") {
+		t.Fatalf("DBSIZE after the failed shutdown replied %q", got)
+	}
+	if _, err := os.Stat(state.conf.pidfile); err != nil {
+		t.Fatalf("the failed shutdown removed the pid file: %v", err)
+	}
+
+	shutdownServer(t, state, tc, addr, "FORCE")
+}
+
+// ABORT cancels a shutdown still waiting for running writes
+func TestShutdownAbort(t *testing.T) {
+	state := newRDBState(t)
+	addr := newShutdownServer(t, state)
+	tc := dialTest(t, addr)
+	other := dialTest(t, addr)
+
+	if got := tc.do(t, "SHUTDOWN", "ABORT"); got != "-"+ErrNoShutdown.Error() {
+		t.Fatalf("SHUTDOWN ABORT without a shutdown replied %q", got)
+	}
+	for _, args := range [][]string{{"SAVE", "NOSAVE"}, {"ABORT", "NOSAVE"}, {"LATER"}} {
+		if got := tc.do(t, append([]string{"SHUTDOWN"}, args...)...); got != "-"+ErrSyntax.Error() {
+			t.Fatalf("SHUTDOWN %s replied %q", strings.Join(args, " "), got)
+		}
+	}
+
+	// a write that's running holds the gate, the shutdown waits for it
+	state.gate.RLock()
+	tc.send(t, "SHUTDOWN", "NOSAVE")
+	for !state.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if got := other.do(t, "SHUTDOWN", "ABORT"); got != "+OK" {
+		state.gate.RUnlock()
+		t.Fatalf("SHUTDOWN ABORT replied %q", got)
+	}
+	state.gate.RUnlock()
+
+	if got := tc.reply(t); got != "-"+ErrShutdownFailed.Error() {
+		t.Fatalf("the aborted SHUTDOWN replied %q", got)
+	}
+	if got := tc.do(t, "DBSIZE"); !strings.HasPrefix(got, ":") {
+		t.Fatalf("DBSIZE after the aborted shutdown replied %q", got)
+	}
+	if _, err := os.Stat(state.conf.pidfile); err != nil {
+		t.Fatalf("the aborted shutdown removed the pid file: %v", err)
+	}
+
+	shutdownServer(t, state, tc, addr, "NOSAVE")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// keeps the certificate and CA pool used by the TLS listeners, reloading them
+// when the files on disk change so certificates can be rotated without a restart
+type TLSCerts struct {
+	mu        sync.Mutex
+	conf      *Config
+	cfg       *tls.Config // config handed to new connections
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+// files are checked for changes at most this often
+const tlsReloadInterval = time.Second
+
+func NewTLSCerts(conf *Config) (*TLSCerts, error) {
+	tc := &TLSCerts{conf: conf}
+	if err := tc.load(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (tc *TLSCerts) files() []string {
+	files := []string{tc.conf.tlsCertFile, tc.conf.tlsKeyFile}
+	if tc.conf.tlsCaCertFile != "" {
+		files = append(files, tc.conf.tlsCaCertFile)
+	}
+	return files
+}
+
+// must be called with tc.mu held unless tc isn't shared yet
+func (tc *TLSCerts) load() error {
+	if tc.conf.tlsCertFile == "" || tc.conf.tlsKeyFile == "" {
+		return errors.New("tls-cert-file and tls-key-file are required for TLS")
+	}
+
+	modTimes := map[string]time.Time{}
+	for _, fn := range tc.files() {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		modTimes[fn] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(tc.conf.tlsCertFile, tc.conf.tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS key pair: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if tc.conf.tlsCaCertFile != "" {
+		pem, err := os.ReadFile(tc.conf.tlsCaCertFile)
+		if err != nil {
+			return fmt.Errorf("cannot read tls-ca-cert-file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in tls-ca-cert-file")
+		}
+		cfg.ClientCAs = pool
+	}
+
+	switch tc.conf.tlsAuthClients {
+	case "yes":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if cfg.ClientAuth != tls.NoClientCert && cfg.ClientCAs == nil {
+		return errors.New("tls-auth-clients requires tls-ca-cert-file")
+	}
+
+	tc.cfg = cfg
+	tc.modTimes = modTimes
+	tc.checkedAt = time.Now()
+	return nil
+}
+
+// reloads the files if any of them changed, a broken update keeps the old certificates
+func (tc *TLSCerts) current() *tls.Config {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if time.Since(tc.checkedAt) < tlsReloadInterval {
+		return tc.cfg
+	}
+	tc.checkedAt = time.Now()
+
+	changed := false
+	for _, fn := range tc.files() {
+		fi, err := os.Stat(fn)
+		if err != nil || !fi.ModTime().Equal(tc.modTimes[fn]) {
+			changed = true
+			break
+		}
+	}
+
+	if changed {
+		if err := tc.load(); err != nil {
+			log.Println("cannot reload TLS certificates, keeping the current ones. error: ", err)
+		} else {
+			log.Println("reloaded TLS certificates")
+		}
+	}
+
+	return tc.cfg
+}
+
+// config for tls.NewListener, every handshake picks up the latest certificates
+func (tc *TLSCerts) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tc.current(), nil
+		},
+	}
+}
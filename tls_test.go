@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes a self-signed certificate for localhost and its key to certFile and keyFile
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// connects over TLS trusting only cert, returns the certificate the server presented
+func dialTLS(t *testing.T, addr string, cert *x509.Certificate) (*testConn, *x509.Certificate) {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, r: bufio.NewReader(conn)}, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSListenerReload(t *testing.T) {
+	dir := t.TempDir()
+	conf := NewConfig()
+	conf.port = 0
+	conf.bind = []string{"127.0.0.1"}
+	conf.tlsPort = freePort(t)
+	conf.tlsCertFile = filepath.Join(dir, "server.crt")
+	conf.tlsKeyFile = filepath.Join(dir, "server.key")
+	conf.tlsAuthClients = "no"
+
+	oldCert := writeTestCert(t, conf.tlsCertFile, conf.tlsKeyFile, 1)
+
+	listeners, err := openListeners(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeListeners(listeners) })
+	if len(listeners) != 1 {
+		t.Fatalf("got %d listeners, want only the TLS one", len(listeners))
+	}
+	go acceptConns(listeners[0], NewAppState(conf))
+	addr := listeners[0].Addr().String()
+
+	tc, served := dialTLS(t, addr, oldCert)
+	if served.SerialNumber.Int64() != 1 {
+		t.Fatalf("served certificate serial %v, want 1", served.SerialNumber)
+	}
+	if got := tc.do(t, "SET", "tls:key", "v"); got != "+OK" {
+		t.Fatalf("SET over TLS replied %q", got)
+	}
+	if got := tc.do(t, "GET", "tls:key"); got != "v" {
+		t.Fatalf("GET over TLS replied %q", got)
+	}
+
+	// rotate the files, they are checked for changes at most once per tlsReloadInterval
+	newCert := writeTestCert(t, conf.tlsCertFile, conf.tlsKeyFile, 2)
+	future := time.Now().Add(time.Minute)
+	for _, fn := range []string{conf.tlsCertFile, conf.tlsKeyFile} {
+		if err := os.Chtimes(fn, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(tlsReloadInterval + 100*time.Millisecond)
+
+	tc2, served := dialTLS(t, addr, newCert)
+	if served.SerialNumber.Int64() != 2 {
+		t.Fatalf("served certificate serial %v after the reload, want 2", served.SerialNumber)
+	}
+	if got := tc2.do(t, "GET", "tls:key"); got != "v" {
+		t.Fatalf("GET after the reload replied %q", got)
+	}
+
+	// the connection made before the reload keeps working
+	if got := tc.do(t, "GET", "tls:key"); got != "v" {
+		t.Fatalf("GET on the old connection replied %q", got)
+	}
+}
+
+// a rejected TLS client that never sends its hello used to hold the accept loop in the handshake
+func TestSilentTLSClientDoesNotBlockAccept(t *testing.T) {
+	dir := t.TempDir()
+	conf := NewConfig()
+	conf.port = 0
+	conf.bind = []string{"127.0.0.1"}
+	conf.tlsPort = freePort(t)
+	conf.tlsCertFile = filepath.Join(dir, "server.crt")
+	conf.tlsKeyFile = filepath.Join(dir, "server.key")
+	conf.tlsAuthClients = "no"
+	conf.maxclients = 1
+	cert := writeTestCert(t, conf.tlsCertFile, conf.tlsKeyFile, 1)
+
+	listeners := serveListeners(t, conf)
+	addr := listeners[0].Addr().String()
+
+	first, _ := dialTLS(t, addr, cert)
+	first.do(t, "DBSIZE")
+
+	// over maxclients, so the server rejects it, and it never starts the handshake
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silent.Close() })
+	time.Sleep(50 * time.Millisecond)
+
+	first.Close()
+
+	// the slot is freed once the server notices the close, until then the reply is the maxclients error
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: time.Second},
+		Config:    &tls.Config{RootCAs: pool, ServerName: "localhost"},
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("no client got served after the silent one was rejected")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		tc := &testConn{Conn: conn, r: bufio.NewReader(conn)}
+		got := tc.do(t, "DBSIZE")
+		conn.Close()
+		if got != "" && got[0] == ':' {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
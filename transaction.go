@@ -1,7 +1,10 @@
 package main
 
 type Transaction struct {
-	cmds []*TxCommand
+	cmds    []*TxCommand
+	aborted bool // set when a command fails to queue, EXEC replies EXECABORT
+	running bool // EXEC is running the queued commands and holds the AOF lock
+	logged  bool // MULTI was written to the AOF, EXEC has to close it
 }
 
 func NewTransaction() *Transaction {
@@ -9,6 +12,15 @@ func NewTransaction() *Transaction {
 }
 
 type TxCommand struct {
-	v       *Value
-	handler Handler
+	v   *Value
+	cmd *Command
+}
+
+func (tx *Transaction) hasWrites() bool {
+	for _, txcmd := range tx.cmds {
+		if txcmd.cmd.has(CmdWrite) {
+			return true
+		}
+	}
+	return false
 }
@@ -1,5 +1,7 @@
 package main
 
+import "os"
+
 func contains(slice []string, item string) bool {
 	for _, i := range slice {
 		if item == i {
@@ -8,3 +10,17 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
+
+// makes renames and file creations in dir durable
+func fsyncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"strconv"
@@ -42,26 +41,29 @@ func readLine(r *bufio.Reader) (string, error) {
 // since we are reading one array at a time and instantiating a new bufio reader for every array
 // we loose continuity in the file
 
-func (v *Value) readArray(r *bufio.Reader) error {
+// maxLen caps the number of arguments and the length of each, lengths come from the client
+// and are checked before anything is allocated for them
+func (v *Value) readArray(r *bufio.Reader, maxLen int64) error {
 	line, err := readLine(r)
 	if err != nil {
 		return err
 	}
 
-	if line[0] != '*' {
+	if len(line) == 0 || line[0] != '*' {
 		return errors.New("expected array")
 	}
 
-	arrLen, err := strconv.Atoi(string(line[1:]))
-	if err != nil {
-		return err
+	// *-1 is a null array, any other negative count is an error like in redis
+	arrLen, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || arrLen < -1 || arrLen > maxLen {
+		return ErrProtoMultiLen
 	}
 
+	// a command cut short, e.g. by the client going away, must not run with the args read so far
 	for range arrLen {
-		bulk, err := v.readBulk(r)
+		bulk, err := v.readBulk(r, maxLen)
 		if err != nil {
-			log.Println(err)
-			break
+			return err
 		}
 		v.array = append(v.array, bulk)
 	}
@@ -69,22 +71,29 @@ func (v *Value) readArray(r *bufio.Reader) error {
 	return nil
 }
 
-func (v *Value) readBulk(r *bufio.Reader) (Value, error) {
+func (v *Value) readBulk(r *bufio.Reader, maxLen int64) (Value, error) {
 	line, err := readLine(r)
 	if err != nil {
 		log.Println("error in reading bulk", err)
 		return Value{}, err
 	}
 
-	n, err := strconv.Atoi(string(line[1:]))
-	if err != nil {
-		fmt.Println(err)
-		return Value{}, err
+	if len(line) == 0 || line[0] != '$' {
+		return Value{}, errors.New("expected bulk string")
+	}
+
+	// $-1 is the RESP null, any other negative length is an error like in redis
+	n, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || n < -1 || n > maxLen {
+		return Value{}, ErrProtoBulkLen
+	}
+	if n == -1 {
+		return Value{typ: NULL}, nil
 	}
 
 	buf := make([]byte, n+2)
 	if _, err := io.ReadFull(r, buf); err != nil {
-		return Value{}, nil
+		return Value{}, err
 	}
 
 	bulk := string(buf[:n])
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadArrayLengths(t *testing.T) {
+	cases := []struct {
+		req  string
+		want error
+	}{
+		{"*1\r\n$-5\r\n", ErrProtoBulkLen},
+		{"*1\r\n$x\r\n", ErrProtoBulkLen},
+		{"*1\r\n$2000000\r\n", ErrProtoBulkLen},
+		{"*-2\r\n", ErrProtoMultiLen},
+		{"*2000000\r\n", ErrProtoMultiLen},
+		{"*2\r\n$3\r\nGET\r\n$-1\r\n", nil},
+		{"*-1\r\n", nil},
+	}
+
+	for _, tc := range cases {
+		v := Value{typ: ARRAY}
+		err := v.readArray(bufio.NewReader(strings.NewReader(tc.req)), 1024*1024)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("reading %q returned %v, want %v", tc.req, err, tc.want)
+		}
+	}
+}
+
+// a negative length used to panic in make, taking the whole server down before AUTH
+func TestBadBulkLengthClosesOnlyTheClient(t *testing.T) {
+	addr := startTestServer(t, NewAppState(NewConfig()))
+
+	bad := dialTest(t, addr)
+	if _, err := bad.Write([]byte("*1\r\n$-5\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(bad.r)
+	if err != nil || line != "-"+ErrProtoBulkLen.Error() {
+		t.Fatalf("got %q %v, want the protocol error", line, err)
+	}
+	if _, err := readLine(bad.r); err == nil {
+		t.Fatal("the connection stayed open after the protocol error")
+	}
+
+	if got := dialTest(t, addr).do(t, "DBSIZE"); !strings.HasPrefix(got, ":") {
+		t.Fatalf("DBSIZE on a new connection replied %q", got)
+	}
+}
@@ -2,48 +2,90 @@ package main
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"sync"
 )
 
+// encoded chunks bigger than this are handed to the bufio.Writer right away,
+// so huge arrays (e.g. a big KEYS reply) are streamed instead of materialized
+const streamChunkSize = 16 * 1024
+
+// scratch buffers shared by all writers, they are only held for the duration of a Write
+var encodeBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+var errorNewlines = [256]bool{'\r': true, '\n': true}
+
 type Writer struct {
-	writer io.Writer
+	writer *bufio.Writer
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{writer: bufio.NewWriter(w)} // wrapping conn with bufio.Writer
 }
 
-func (w *Writer) Deserialize(v *Value) (reply string) {
+func (w *Writer) Write(v *Value) {
+	bp := encodeBufPool.Get().(*[]byte)
+	buf := w.encode((*bp)[:0], v)
+	w.writer.Write(buf)
+
+	*bp = buf[:0]
+	encodeBufPool.Put(bp)
+}
+
+// appends the RESP encoding of v to buf, spilling full chunks into the bufio.Writer
+func (w *Writer) encode(buf []byte, v *Value) []byte {
 	switch v.typ {
 	case ARRAY:
-		reply = fmt.Sprintf("*%d\r\n", len(v.array))
-		for _, sub := range v.array {
-			reply += w.Deserialize(&sub) // recursive array parsing for resp conversion
+		buf = appendPrefixedInt(buf, '*', len(v.array))
+		for i := range v.array {
+			buf = w.encode(buf, &v.array[i]) // recursive array parsing for resp conversion
+			if len(buf) >= streamChunkSize {
+				w.writer.Write(buf)
+				buf = buf[:0]
+			}
 		}
 	case INTEGER:
-		reply = fmt.Sprintf("%s%d\r\n", v.typ, v.num)
+		buf = appendPrefixedInt(buf, ':', v.num)
 	case STRING:
-		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.str)
+		buf = append(buf, '+')
+		buf = append(buf, v.str...)
+		buf = append(buf, '\r', '\n')
 	case BULK:
-		reply = fmt.Sprintf("%s%d\r\n%s\r\n", v.typ, len(v.bulk), v.bulk)
+		buf = appendPrefixedInt(buf, '$', len(v.bulk))
+		buf = append(buf, v.bulk...)
+		buf = append(buf, '\r', '\n')
 	case ERROR:
-		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.bulk)
+		// error text can't span lines, redis swaps newlines for spaces
+		buf = append(buf, '-')
+		for i := 0; i < len(v.err); i++ {
+			if errorNewlines[v.err[i]] {
+				buf = append(buf, ' ')
+			} else {
+				buf = append(buf, v.err[i])
+			}
+		}
+		buf = append(buf, '\r', '\n')
 	case NULL:
-		reply = "$-1\r\n"
+		buf = append(buf, "$-1\r\n"...)
 	default:
 		log.Println("invalid typ received")
-		return reply
 	}
-	return reply
+	return buf
 }
 
-func (w *Writer) Write(v *Value) {
-	reply := w.Deserialize(v)
-	w.writer.Write([]byte(reply))
+func appendPrefixedInt(buf []byte, prefix byte, n int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, '\r', '\n')
 }
 
-func (w *Writer) Flush() {
-	w.writer.(*bufio.Writer).Flush() // flushing the writer
+func (w *Writer) Flush() error {
+	return w.writer.Flush() // flushing the writer
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func bulkArray(n int) *Value {
+	v := &Value{typ: ARRAY}
+	for i := range n {
+		v.array = append(v.array, Value{typ: BULK, bulk: fmt.Sprintf("key:%d", i)})
+	}
+	return v
+}
+
+var writerBenchCases = []struct {
+	name string
+	v    *Value
+}{
+	{"array of 1 bulk", bulkArray(1)},
+	{"array of 100 bulks", bulkArray(100)},
+	{"array of 10000 bulks", bulkArray(10000)},
+	{"integer", &Value{typ: INTEGER, num: 123456}},
+	{"status", &Value{typ: STRING, str: "OK"}},
+}
+
+func BenchmarkWriterWrite(b *testing.B) {
+	for _, tc := range writerBenchCases {
+		b.Run(tc.name, func(b *testing.B) {
+			w := NewWriter(io.Discard)
+			b.ReportAllocs()
+			for range b.N {
+				w.Write(tc.v)
+				w.Flush()
+			}
+		})
+	}
+}
+
+// the serializer writer.go replaced, kept as the baseline for BenchmarkWriterWrite:
+// every reply is built with fmt.Sprintf and string concatenation before reaching the bufio.Writer
+func legacySerialize(v *Value) (reply string) {
+	switch v.typ {
+	case ARRAY:
+		reply = fmt.Sprintf("*%d\r\n", len(v.array))
+		for _, sub := range v.array {
+			reply += legacySerialize(&sub)
+		}
+	case INTEGER:
+		reply = fmt.Sprintf("%s%d\r\n", v.typ, v.num)
+	case STRING:
+		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.str)
+	case BULK:
+		reply = fmt.Sprintf("%s%d\r\n%s\r\n", v.typ, len(v.bulk), v.bulk)
+	case ERROR:
+		reply = fmt.Sprintf("%s%s\r\n", v.typ, v.err)
+	case NULL:
+		reply = "$-1\r\n"
+	}
+	return reply
+}
+
+func BenchmarkLegacyWriterWrite(b *testing.B) {
+	for _, tc := range writerBenchCases {
+		b.Run(tc.name, func(b *testing.B) {
+			w := bufio.NewWriter(io.Discard)
+			b.ReportAllocs()
+			for range b.N {
+				w.WriteString(legacySerialize(tc.v))
+				w.Flush()
+			}
+		})
+	}
+}
+
+// the baseline must produce the same bytes, otherwise the comparison is meaningless
+func TestLegacySerializeMatchesWriter(t *testing.T) {
+	for _, tc := range writerBenchCases {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Write(tc.v)
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != legacySerialize(tc.v) {
+			t.Errorf("%s: the encoders disagree", tc.name)
+		}
+	}
+}